@@ -0,0 +1,111 @@
+// Package cache simulates a memcached or EVCache server
+// Keeps a limited number of items, evicting the least recently or least frequently used, and expiring them after a time to live
+package cache
+
+import (
+	"fmt"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/discovery"
+	"github.com/adrianco/spigo/tooling/flow"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"github.com/adrianco/spigo/tooling/handlers"
+	"github.com/adrianco/spigo/tooling/random"
+	"github.com/adrianco/spigo/tooling/ribbon"
+	"github.com/adrianco/spigo/tooling/usl"
+	"time"
+)
+
+// items a cache holds by default
+const capacity = 1000
+
+// Start cache, all configuration and state is sent via messages
+func Start(listener chan gotocol.Message) {
+	microservices := ribbon.MakeRouter()
+	dependencies := make(map[string]time.Time)                                    // dependent services and time last updated
+	cache := discovery.MakeCache()                                                // local copy of the registry entries for the dependencies
+	var is *items                                                                 // cached items, made once the name is known
+	var parent chan gotocol.Message                                               // remember how to talk back to creator
+	var name string                                                               // remember my name
+	eureka := make(map[string]chan gotocol.Message, len(archaius.Conf.ZoneNames)) // service registry per zone
+	hist := collect.NewHist("")
+	var service *usl.Service // capacity model, nil responds instantly with no limit on workers
+	misses := 0              // since the last eureka poll
+	ep, _ := time.ParseDuration(archaius.Conf.EurekaPoll)
+	eurekaTicker := gotocol.NewTicker(listener, ep)
+	for {
+		select {
+		case msg := <-listener:
+			flow.Instrument(msg, name, hist)
+			switch msg.Imposition {
+			case gotocol.Hello:
+				if name == "" {
+					// if I don't have a name yet remember what I've been named
+					parent = msg.ResponseChan // remember how to talk to my namer
+					name = msg.Intention      // message body is my name
+					hist = collect.NewHist(name)
+					r := random.New(name) // my own random stream for routing and service time
+					microservices.SetRand(r)
+					service = usl.NewService(name, r, listener)
+					is = makeItems(archaius.String(name, "cache.eviction", LRU))
+					collect.ServiceGauge(name, "_items", 0)
+				}
+			case gotocol.Inform:
+				eureka[msg.Intention] = handlers.Inform(msg, name, listener)
+			case gotocol.NameDrop:
+				handlers.NameDrop(&dependencies, cache, microservices, msg, name, listener, eureka)
+			case gotocol.Fetch:
+				handlers.Fetch(&dependencies, cache, microservices, msg, name, listener, eureka)
+			case gotocol.Forget:
+				handlers.Forget(&dependencies, microservices, msg)
+			case gotocol.GetRequest:
+				if !service.Admit(msg) {
+					break // queued until a worker is free, or shed
+				}
+				// a hit returns the value, a miss or an expired item returns nothing so the caller looks further
+				is.Policy(archaius.String(name, "cache.eviction", LRU))
+				value, ok, expired := is.Get(msg.Intention, clock.Now())
+				switch {
+				case ok:
+					collect.ServiceCount(name, "_hits")
+				case expired:
+					collect.ServiceCount(name, "_expired")
+					fallthrough
+				default:
+					collect.ServiceCount(name, "_misses")
+					misses++
+				}
+				collect.ServiceGauge(name, "_items", is.Len())
+				handlers.Respond(gotocol.Message{gotocol.GetResponse, listener, clock.Now(), msg.Ctx, value}, name, msg.ResponseChan, service, 0)
+			case gotocol.Put:
+				// set a key value pair, evicting items to make room for a new key once the cache is at cache.capacity
+				var key, value string
+				fmt.Sscanf(msg.Intention, "%s%s", &key, &value)
+				if key != "" && value != "" {
+					is.Policy(archaius.String(name, "cache.eviction", LRU))
+					ttl := archaius.Duration(name, "cache.ttl", 0)
+					for n := is.Set(key, value, ttl, archaius.Int(name, "cache.capacity", capacity), clock.Now()); n > 0; n-- {
+						collect.ServiceCount(name, "_evictions")
+					}
+					collect.ServiceGauge(name, "_items", is.Len())
+				}
+			case gotocol.Goodbye:
+				service.Stop()                     // let go of the senders it blocked
+				handlers.Delete(msg, name, eureka) // tell name service I'm not going to be here
+				collect.ServiceGauge(name, "_items", 0)
+				collect.ServiceGauge(name, "_miss_rate", 0)
+				gotocol.Message{gotocol.Goodbye, nil, clock.Now(), gotocol.NilContext, name}.GoSend(parent)
+				return
+			}
+		case <-eurekaTicker.C: // check to see if any new dependencies have appeared
+			handlers.Renew(name, listener, eureka) // keep my lease alive
+			handlers.Poll(dependencies, cache, name, listener, eureka)
+			// misses per second since the last poll, a cold cache after a restart sends a stampede of them on to the next tier
+			if ep > 0 && name != "" {
+				collect.ServiceGauge(name, "_miss_rate", int(float64(misses)/ep.Seconds()))
+				misses = 0
+			}
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// Test the least recently used item is evicted to make room for a new key
+func TestLRU(t *testing.T) {
+	now := time.Now()
+	is := makeItems(LRU)
+	for _, k := range []string{"a", "b", "c"} {
+		if n := is.Set(k, "v", 0, 3, now); n != 0 {
+			t.Fatalf("evicted %v before the cache was full", n)
+		}
+	}
+	is.Get("a", now)
+	is.Set("b", "v2", 0, 3, now) // an update doesn't evict
+	if n := is.Set("d", "v", 0, 3, now); n != 1 || is.Len() != 3 {
+		t.Fatalf("evicted %v, %v left", n, is.Len())
+	}
+	if _, ok, _ := is.Get("c", now); ok {
+		t.Error("c was least recently used")
+	}
+	if v, ok, _ := is.Get("b", now); !ok || v != "v2" {
+		t.Errorf("b got %v", v)
+	}
+}
+
+// Test the least frequently used item is evicted, and the policy can change
+func TestLFU(t *testing.T) {
+	now := time.Now()
+	is := makeItems(LRU)
+	for _, k := range []string{"a", "b", "c"} {
+		is.Set(k, "v", 0, 3, now)
+	}
+	for i := 0; i < 3; i++ {
+		is.Get("a", now)
+		is.Get("c", now)
+	}
+	is.Get("b", now) // most recent, but least used
+	is.Policy(LFU)
+	is.Set("d", "v", 0, 3, now)
+	if _, ok, _ := is.Get("b", now); ok {
+		t.Error("b was least frequently used")
+	}
+	if _, ok, _ := is.Get("a", now); !ok {
+		t.Error("a was evicted")
+	}
+}
+
+// Test items expire after their time to live
+func TestTTL(t *testing.T) {
+	now := time.Now()
+	is := makeItems(LRU)
+	is.Set("a", "v", time.Second, 0, now)
+	is.Set("b", "v", 0, 0, now)
+	if _, ok, _ := is.Get("a", now.Add(time.Second/2)); !ok {
+		t.Error("a expired early")
+	}
+	if _, ok, expired := is.Get("a", now.Add(time.Second)); ok || !expired || is.Len() != 1 {
+		t.Error("a didn't expire")
+	}
+	if _, ok, expired := is.Get("a", now.Add(time.Second)); ok || expired {
+		t.Error("a is still there")
+	}
+	if _, ok, _ := is.Get("b", now.Add(time.Hour)); !ok {
+		t.Error("b expired without a time to live")
+	}
+}
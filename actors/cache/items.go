@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Eviction policies, set by the cache.eviction property
+const (
+	LRU = "lru" // evict the least recently used item, as memcached does
+	LFU = "lfu" // evict the least frequently used item, the least recently used of those that tie
+)
+
+// item in a cache
+type item struct {
+	key, value string
+	expires    time.Time // zero if it doesn't expire
+	uses       int       // gets and sets since it was added
+	used       int64     // when it was last used, in cache operations
+	index      int       // in the heap
+}
+
+// items in a cache, a heap with the next item to evict on top
+type items struct {
+	byKey  map[string]*item
+	heap   []*item
+	policy string
+	ops    int64 // operations so far, a logical clock for recency
+}
+
+func makeItems(policy string) *items {
+	var is items
+	is.byKey = make(map[string]*item)
+	is.policy = policy
+	return &is
+}
+
+// implement heap.Interface, least recently or least frequently used first
+func (is *items) Len() int { return len(is.heap) }
+func (is *items) Less(i, j int) bool {
+	a, b := is.heap[i], is.heap[j]
+	if is.policy == LFU && a.uses != b.uses {
+		return a.uses < b.uses
+	}
+	return a.used < b.used
+}
+func (is *items) Swap(i, j int) {
+	is.heap[i], is.heap[j] = is.heap[j], is.heap[i]
+	is.heap[i].index = i
+	is.heap[j].index = j
+}
+func (is *items) Push(x interface{}) {
+	it := x.(*item)
+	it.index = len(is.heap)
+	is.heap = append(is.heap, it)
+}
+func (is *items) Pop() interface{} {
+	it := is.heap[len(is.heap)-1]
+	is.heap = is.heap[:len(is.heap)-1]
+	return it
+}
+
+// Policy changes the eviction policy, reordering the items
+func (is *items) Policy(policy string) {
+	if policy != is.policy {
+		is.policy = policy
+		heap.Init(is)
+	}
+}
+
+// touch an item that was used
+func (is *items) touch(it *item) {
+	is.ops++
+	it.uses++
+	it.used = is.ops
+	heap.Fix(is, it.index)
+}
+
+// Get the value of a key, expired is true if it was there but has expired, it's removed as memcached does lazily
+func (is *items) Get(key string, now time.Time) (value string, ok, expired bool) {
+	it := is.byKey[key]
+	if it == nil {
+		return "", false, false
+	}
+	if !it.expires.IsZero() && !now.Before(it.expires) {
+		is.remove(it)
+		return "", false, true
+	}
+	is.touch(it)
+	return it.value, true, false
+}
+
+// Set the value of a key, with a time to live if ttl isn't zero. A new key evicts items to make room for it
+// if the cache holds capacity items already, returns how many were evicted
+func (is *items) Set(key, value string, ttl time.Duration, capacity int, now time.Time) int {
+	evicted := 0
+	it := is.byKey[key]
+	if it == nil {
+		for capacity > 0 && len(is.heap) >= capacity {
+			is.remove(is.heap[0])
+			evicted++
+		}
+		it = &item{key: key}
+		is.byKey[key] = it
+		heap.Push(is, it)
+	}
+	it.value = value
+	it.expires = time.Time{}
+	if ttl > 0 {
+		it.expires = now.Add(ttl)
+	}
+	is.touch(it)
+	return evicted
+}
+
+// remove an item
+func (is *items) remove(it *item) {
+	heap.Remove(is, it.index)
+	delete(is.byKey, it.key)
+}
@@ -5,13 +5,16 @@ package denominator
 import (
 	"fmt"
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/discovery"
 	"github.com/adrianco/spigo/tooling/flow"
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/handlers"
+	"github.com/adrianco/spigo/tooling/random"
 	"github.com/adrianco/spigo/tooling/ribbon"
+	"github.com/adrianco/spigo/tooling/workload"
 	"log"
-	"math/rand"
 	"time"
 )
 
@@ -19,19 +22,105 @@ import (
 func Start(listener chan gotocol.Message) {
 	microservices := ribbon.MakeRouter()
 	dependencies := make(map[string]time.Time)                                                          // dependent services and time last updated
+	cache := discovery.MakeCache()                                                                      // local copy of the registry entries for the dependencies
 	var parent chan gotocol.Message                                                                     // remember how to talk back to creator
 	var name string                                                                                     // remember my name
 	nethist := collect.NewHist("")                                                                      // don't know name yet - message network latency
 	resphist := collect.NewHist("")                                                                     // response time history
 	servhist := collect.NewHist("")                                                                     // service time history
 	rthist := collect.NewHist("")                                                                       // round trip history
+	timeouts := collect.NewCounter("")                                                                  // requests that timed out
+	errors := collect.NewCounter("")                                                                    // requests that failed
+	abandoned := collect.NewCounter("")                                                                 // closed loop requests that users gave up waiting for
 	eureka := make(map[string]chan gotocol.Message, len(archaius.Conf.ZoneNames)*archaius.Conf.Regions) // service registry per zone and region
 	var chatrate time.Duration
+	var profile *workload.Profile                      // shapes the load, nil sends an even mix every chatrate
+	var interval time.Duration                         // current interval between requests
+	var started time.Time                              // when the load started, for the profile's rate curve
+	var sent int                                       // requests sent so far, for replaying arrivals
+	var idle int                                       // closed loop users waiting for somewhere to send requests
+	waiting := make(map[gotocol.TraceContextType]bool) // closed loop users waiting for a response
+	arrivals := workload.NewRecorder("")
 	ep, _ := time.ParseDuration(archaius.Conf.EurekaPoll)
-	eurekaTicker := time.NewTicker(ep)
-	chatTicker := time.NewTicker(time.Hour)
+	eurekaTicker := gotocol.NewTicker(listener, ep)
+	chatTicker := gotocol.NewTicker(listener, time.Hour)
 	chatTicker.Stop()
-	w := 1 // counter for random messages
+	w := 1              // counter for random messages
+	r := random.New("") // don't know name yet
+	// pick the next request from the mix
+	pick := func() gotocol.Message {
+		ctx := gotocol.NewTrace()
+		now := clock.Now()
+		var kind int
+		if profile == nil {
+			kind = r.Intn(3)
+		} else {
+			kind = profile.Kind(r)
+		}
+		switch kind {
+		case workload.Miss:
+			return gotocol.Message{gotocol.GetRequest, listener, now, ctx, "why?"}
+		case workload.Get:
+			q := r.Intn(w) // pick a random key that has already been put
+			if profile != nil {
+				q = profile.Key(r, w)
+			}
+			return gotocol.Message{gotocol.GetRequest, listener, now, ctx, fmt.Sprintf("Why%v%v", q, q*q)}
+		case workload.Update:
+			if w > 0 { // overwrite a key that has already been put, otherwise put a new one
+				q := profile.Key(r, w)
+				return gotocol.Message{gotocol.Put, listener, now, ctx, fmt.Sprintf("Why%v%v again", q, q*q)}
+			}
+		}
+		sm := gotocol.Message{gotocol.Put, listener, now, ctx, fmt.Sprintf("Why%v%v me", w, w*w)}
+		w++ // put a new key each time
+		return sm
+	}
+	// send a request once a delay has passed
+	send := func(sm gotocol.Message, c chan gotocol.Message, after time.Duration) {
+		sent++
+		if after <= 0 {
+			arrivals.Record()
+			flow.AnnotateSend(sm, name) // service send logs creation time for this flow
+			sm.GoSend(c)
+			return
+		}
+		clock.After(after, func() {
+			sm.Sent = clock.Now()
+			arrivals.Record()
+			flow.AnnotateSend(sm, name)
+			sm.GoSend(c)
+		})
+	}
+	// a closed loop user thinks then sends its next request, puts aren't answered so the user carries on after them
+	user := func(think time.Duration) {
+		c := microservices.Random()
+		if c == nil {
+			idle++ // try again once there's somewhere to send to
+			return
+		}
+		for {
+			sm := pick()
+			send(sm, c, think)
+			if sm.Imposition != gotocol.Put {
+				waiting[sm.Ctx.Trace] = true
+				ctx := sm.Ctx
+				clock.After(think+profile.Patience(), func() {
+					gotocol.Message{gotocol.Timeout, nil, clock.Now(), ctx, ""}.Redeliver(listener)
+				})
+				return
+			}
+			think += profile.ThinkTime(r)
+		}
+	}
+	closed := func() bool { return profile != nil && profile.Arrivals.Process == workload.Closed }
+	// a closed loop user got a response, or gave up waiting, so thinks about the next request
+	done := func(ctx gotocol.Context) {
+		if closed() && waiting[ctx.Trace] {
+			delete(waiting, ctx.Trace)
+			user(profile.ThinkTime(r))
+		}
+	}
 	for {
 		select {
 		case msg := <-listener:
@@ -46,24 +135,80 @@ func Start(listener chan gotocol.Message) {
 					resphist = collect.NewHist(name + "_resp")
 					servhist = collect.NewHist(name + "_serv")
 					rthist = collect.NewHist(name + "_rt")
+					arrivals = workload.NewRecorder(name)
+					timeouts = collect.NewCounter(name + "_timeouts")
+					errors = collect.NewCounter(name + "_errors")
+					abandoned = collect.NewCounter(name + "_abandoned")
+					r = random.New(name) // my own random stream, shared with my router
+					microservices.SetRand(r)
+					microservices.SetOwner(name) // for its load balancing rule
 				}
 			case gotocol.Inform:
 				eureka[msg.Intention] = handlers.Inform(msg, name, listener)
 			case gotocol.NameDrop:
-				handlers.NameDrop(&dependencies, microservices, msg, name, listener, eureka, true)
+				handlers.NameDrop(&dependencies, cache, microservices, msg, name, listener, eureka, true)
+			case gotocol.Fetch:
+				// update buddies with what changed in the service registry
+				handlers.Fetch(&dependencies, cache, microservices, msg, name, listener, eureka, true)
 			case gotocol.Forget:
 				// forget a buddy
 				handlers.Forget(&dependencies, microservices, msg)
 			case gotocol.Chat:
-				// setup the ticker to run at the specified rate
-				d, e := time.ParseDuration(msg.Intention)
+				// setup the ticker to run at the specified rate, optionally shaped by a named workload profile
+				var rate, p string
+				fmt.Sscanf(msg.Intention, "%s%s", &rate, &p)
+				d, e := time.ParseDuration(rate)
 				if e == nil && d >= time.Millisecond && d <= time.Hour {
 					chatrate = d
-					chatTicker = time.NewTicker(chatrate)
+					interval = d
+					if p != "" {
+						profile = workload.Lookup(p)
+						interval = profile.Interval(0, chatrate)
+					}
+					started = clock.Now()
+					chatTicker.Stop()
+					if closed() {
+						for i := 0; i < profile.Arrivals.Users; i++ {
+							user(profile.ThinkTime(r))
+						}
+						break
+					}
+					if profile != nil {
+						interval = profile.Gap(r, 0, chatrate, sent)
+					}
+					chatTicker = gotocol.NewTicker(listener, interval)
+				}
+			case gotocol.Config:
+				// a property changed while running, follow a new chat rate
+				d, e := time.ParseDuration(archaius.String(name, "chat", chatrate.String()))
+				if e == nil && chatrate > 0 && d != chatrate && d >= time.Millisecond && d <= time.Hour {
+					chatrate = d
+					if !closed() {
+						interval = d
+						if profile != nil {
+							interval = profile.Gap(r, clock.Since(started), chatrate, sent)
+						}
+						chatTicker.Stop()
+						chatTicker = gotocol.NewTicker(listener, interval)
+					}
 				}
 			case gotocol.GetResponse:
 				// return path from a request, terminate and log response time in histograms
 				flow.End(msg, resphist, servhist, rthist)
+				done(msg.Ctx)
+			case gotocol.Timeout:
+				if msg.ResponseChan == nil { // a closed loop user ran out of patience
+					if waiting[msg.Ctx.Trace] {
+						collect.Count(abandoned)
+					}
+				} else { // the request gave up somewhere along the way
+					collect.Count(timeouts)
+				}
+				done(msg.Ctx)
+			case gotocol.Error:
+				// the request failed somewhere along the way
+				collect.Count(errors)
+				done(msg.Ctx)
 			case gotocol.Goodbye:
 				if archaius.Conf.Msglog {
 					log.Printf("%v: Going away, was chatting every %v\n", name, chatrate)
@@ -72,34 +217,28 @@ func Start(listener chan gotocol.Message) {
 				collect.SaveHist(resphist, name, "_resp")
 				collect.SaveHist(servhist, name, "_serv")
 				collect.SaveHist(rthist, name, "_rt")
+				arrivals.Save(name)
 				collect.SaveAllGuesses(name)
-				gotocol.Message{gotocol.Goodbye, nil, time.Now(), gotocol.NilContext, name}.GoSend(parent)
+				gotocol.Message{gotocol.Goodbye, nil, clock.Now(), gotocol.NilContext, name}.GoSend(parent)
 				return
 			}
 		case <-eurekaTicker.C: // check to see if any new dependencies have appeared
-			for dep := range dependencies {
-				for _, ch := range eureka {
-					ch <- gotocol.Message{gotocol.GetRequest, listener, time.Now(), gotocol.NilContext, dep}
-				}
+			handlers.Renew(name, listener, eureka) // keep my lease alive
+			handlers.Poll(dependencies, cache, name, listener, eureka)
+			for n := idle; n > 0; n-- {
+				idle--
+				user(0)
 			}
 		case <-chatTicker.C:
-			c := microservices.Random()
-			if c != nil {
-				ctx := gotocol.NewTrace()
-				now := time.Now()
-				var sm gotocol.Message
-				switch rand.Intn(3) {
-				case 0:
-					sm = gotocol.Message{gotocol.GetRequest, listener, now, ctx, "why?"}
-				case 1:
-					q := rand.Intn(w) // pick a random key that has already been put
-					sm = gotocol.Message{gotocol.GetRequest, listener, now, ctx, fmt.Sprintf("Why%v%v", q, q*q)}
-				case 2:
-					sm = gotocol.Message{gotocol.Put, listener, now, ctx, fmt.Sprintf("Why%v%v me", w, w*w)}
-					w++ // put a new key each time
+			if c := microservices.Random(); c != nil {
+				send(pick(), c, 0)
+			}
+			if profile != nil { // follow the rate curve and arrival process
+				if d := profile.Gap(r, clock.Since(started), chatrate, sent); d != interval {
+					interval = d
+					chatTicker.Stop()
+					chatTicker = gotocol.NewTicker(listener, interval)
 				}
-				flow.AnnotateSend(sm, name) // service send logs creation time for this flow
-				sm.GoSend(c)
 			}
 		}
 	}
@@ -2,7 +2,9 @@
 package edda
 
 import (
+	"fmt"
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/collect"
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/graphjson"
@@ -12,7 +14,6 @@ import (
 	"log"
 	"strings"
 	"sync"
-	"time"
 )
 
 // Logchan is a buffered channel for sending logging messages to, or nil if logging is off
@@ -33,6 +34,7 @@ func Start(name string) {
 	var msg gotocol.Message
 	microservices := make(map[string]bool, archaius.Conf.Dunbar)
 	edges := make(map[string]bool, archaius.Conf.Dunbar)
+	circuits := make(map[string]string) // circuit breaker state by edge
 	var ok bool
 	hist := collect.NewHist(name)
 	log.Println(name + ": starting")
@@ -47,7 +49,7 @@ func Start(name string) {
 	}
 	for {
 		msg, ok = <-Logchan
-		collect.Measure(hist, time.Since(msg.Sent))
+		collect.Measure(hist, clock.Since(msg.Sent))
 		if !ok {
 			break // channel was closed
 		}
@@ -80,6 +82,32 @@ func Start(name string) {
 				edges[edge] = false
 				graphjson.WriteForget(edge, msg.Sent)
 			}
+		case gotocol.Circuit: // a circuit breaker changed state
+			var from, to, state string
+			fmt.Sscanf(msg.Intention, "%s%s%s", &from, &to, &state)
+			edge := names.FilterEdge(from + " " + to)
+			if circuits[edge] != state { // instances of a service share an edge, only log when it changes
+				circuits[edge] = state
+				graphjson.WriteCircuit(edge, state, msg.Sent)
+			}
+		case gotocol.Chaos: // chaosmonkey acted on a node
+			var action, node string
+			fmt.Sscanf(msg.Intention, "%s%s", &action, &node)
+			if names.Package(node) != "" { // a node rather than a network location
+				node = names.FilterNode(node)
+			}
+			graphjson.WriteChaos(node, action, msg.Sent)
+		case gotocol.Lease: // a registry evicted a node, registered it again, or changed self preservation mode
+			var event, registry, node string
+			fmt.Sscanf(msg.Intention, "%s%s%s", &event, &registry, &node)
+			if node != "" {
+				node = names.FilterNode(node)
+			}
+			graphjson.WriteLease(names.FilterNode(registry), node, event, msg.Sent)
+			if event == "evict" && microservices[node] == true { // every registry evicts it, only log it gone once
+				microservices[node] = false
+				graphjson.WriteDone(node, msg.Sent)
+			}
 		case gotocol.Delete: // remove the node
 			node := names.FilterNode(msg.Intention)
 			if microservices[node] == true { // only remove nodes that exist, and only log it once
@@ -3,12 +3,15 @@
 package eureka
 
 import (
+	"fmt"
 	"github.com/adrianco/spigo/actors/edda"
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/collect"
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/names"
 	"log"
+	"strings"
 	"sync"
 	"time"
 )
@@ -16,18 +19,32 @@ import (
 // Wg waitgroup to pause for termination
 var Wg sync.WaitGroup
 
+// Registered is told when an instance registers, set it before the registries start, asgard uses it to time recovery
+var Registered func(name string, at time.Time)
+
 // metadata about a registered service
 type meta struct {
 	online     bool
-	registered time.Time
+	registered time.Time // when it last changed state
+	renewed    time.Time // when its lease was last renewed
 }
 
-// interest in a specific service
-type callback struct {
-	lookup string
-	who    chan gotocol.Message
+// change to the state of an instance, kept for a while so clients can fetch the changes since the version they have
+type change struct {
+	version  int
+	instance string
+	at       time.Time
 }
 
+// Instances renew their lease every eureka poll interval, and are evicted if it hasn't been renewed for the lease time,
+// checked every eviction interval. If more than one minus the renewal percent of online instances expire at once,
+// it's more likely that the registry has been partitioned away from them, so it preserves itself by evicting nothing
+// until enough renewals come back. Properties eureka.lease, eureka.eviction, eureka.renewalpercent and
+// eureka.selfpreservation change the defaults of 3 polls, 1 poll, 0.85 and true.
+// Clients fetch the changes since the version of the registry they have, if they're too far behind for the changes
+// kept for eureka.retention (default 3m), or haven't fetched before, they get everything. Registrations, deletes
+// and renewals are replicated to the other registries in the region after eureka.replication (default 500ms).
+
 // Start eureka discovery service and set name directly
 func Start(listener chan gotocol.Message, name string) {
 	// use a waitgroup so whoever starts eureka can tell it's ready and when stopping that the logs have been flushed
@@ -36,89 +53,247 @@ func Start(listener chan gotocol.Message, name string) {
 	var msg gotocol.Message
 	var ok bool
 	hist := collect.NewHist(name)
+	registered := collect.NewGauge(name + "_registered") // online instances, registries diverge when a partition stops replication
 	microservices := make(map[string]chan gotocol.Message, archaius.Conf.Dunbar)
 	eurekaservices := make(map[string]chan gotocol.Message, 2)
 	metadata := make(map[string]meta, archaius.Conf.Dunbar)
-	lastrequest := make(map[callback]time.Time) // remember time of last request for a service from this requestor
-	log.Println(name + ": starting")
-	for {
-		msg, ok = <-listener
-		collect.Measure(hist, time.Since(msg.Sent))
-		if !ok {
-			break // channel was closed
-		}
-		//commented out because name service traffic is too much noise in the log
-		//if archaius.Conf.Msglog {
-		//	log.Printf("%v(backlog %v): %v\n", name, len(listener), msg)
-		//}
-		switch msg.Imposition {
-		// used to wire up connections to other eureka nodes only
-		case gotocol.NameDrop:
-			if msg.Intention != name { // don't talk to myself
-				eurekaservices[msg.Intention] = msg.ResponseChan
+	preserving := false // in self preservation mode, not evicting anything
+	version := 0        // counts changes to the registry
+	trimmed := 0        // version of the last change that's no longer kept
+	var changes []change
+	ep, _ := time.ParseDuration(archaius.Conf.EurekaPoll)
+	if ep <= 0 {
+		ep = time.Second
+	}
+	evictionTicker := gotocol.NewTicker(listener, archaius.Duration(name, "eviction", ep))
+	online := func() {
+		n := 0
+		for _, m := range metadata {
+			if m.online {
+				n++
 			}
-		// for new nodes record the data, replicate and maybe pass on to be logged
-		case gotocol.Put:
-			if microservices[msg.Intention] == nil { // ignore duplicate requests
-				microservices[msg.Intention] = msg.ResponseChan
-				metadata[msg.Intention] = meta{true, msg.Sent}
-				// replicate request, everyone ends up with the same timestamp for state change of this service
-				for _, c := range eurekaservices {
-					gotocol.Message{gotocol.Replicate, msg.ResponseChan, msg.Sent, gotocol.NilContext, msg.Intention}.GoSend(c)
+		}
+		collect.Gauge(registered, n)
+	}
+	changed := func(instance string) {
+		version++
+		changes = append(changes, change{version, instance, clock.Now()})
+	}
+	// forget changes older than the retention time, clients that haven't fetched since then get everything
+	trim := func() {
+		retention := archaius.Duration(name, "retention", 3*time.Minute)
+		i := 0
+		for i < len(changes) && clock.Since(changes[i].at) > retention {
+			trimmed = changes[i].version
+			i++
+		}
+		changes = changes[i:]
+	}
+	// replicate to the other registries, after a delay that batches up replication
+	replicate := func(msg gotocol.Message) {
+		for _, n := range gotocol.Names(eurekaservices) {
+			peer := eurekaservices[n]
+			clock.After(archaius.Duration(name, "replication", 500*time.Millisecond), func() { msg.GoSendFrom(listener, peer) })
+		}
+	}
+	// reply to a fetch with the instances of the services that changed since the client's version, or all of them
+	fetch := func(msg gotocol.Message) {
+		var since int
+		var services []string
+		fields := strings.Fields(msg.Intention)
+		if len(fields) > 0 {
+			fmt.Sscanf(fields[0], "%d", &since)
+			services = fields[1:]
+		}
+		wanted := make(map[string]bool, len(services))
+		for _, s := range services {
+			wanted[s] = true
+		}
+		kind := "delta"
+		instances := make(map[string]bool)
+		if since <= 0 || since < trimmed || since > version {
+			kind = "full"
+			for n, m := range metadata {
+				if m.online {
+					instances[n] = true
 				}
-				if edda.Logchan != nil {
-					edda.Logchan <- msg
+			}
+		} else {
+			for _, c := range changes {
+				if c.version > since {
+					instances[c.instance] = true
 				}
 			}
-		case gotocol.Replicate:
-			if microservices[msg.Intention] == nil { // ignore multiple requests
-				microservices[msg.Intention] = msg.ResponseChan
-				metadata[msg.Intention] = meta{true, msg.Sent}
+		}
+		reply := fmt.Sprintf("%v %v %v", name, version, kind)
+		var updates []string
+		count := 0
+		for n, m := range metadata {
+			if m.online && wanted[names.Service(n)] {
+				count++
+			}
+		}
+		for _, n := range gotocol.Names(microservices) { // in a repeatable order
+			if !instances[n] || !wanted[names.Service(n)] {
+				continue
+			}
+			if metadata[n].online {
+				gotocol.Message{gotocol.NameDrop, microservices[n], clock.Now(), gotocol.NilContext, n}.GoSendFrom(listener, msg.ResponseChan)
+				updates = append(updates, "+"+n)
+			} else {
+				updates = append(updates, "-"+n)
+			}
+		}
+		reply = fmt.Sprintf("%v %v %v", reply, count, strings.Join(updates, " "))
+		gotocol.Message{gotocol.Fetch, nil, clock.Now(), gotocol.NilContext, reply}.GoSendFrom(listener, msg.ResponseChan)
+	}
+	lease := func(event, instance string) {
+		if edda.Logchan != nil {
+			edda.Logchan <- gotocol.Message{gotocol.Lease, nil, clock.Now(), gotocol.NilContext, event + " " + name + " " + instance}
+		}
+	}
+	// register an instance that was evicted but has renewed its lease, it was hung or partitioned away
+	register := func(msg gotocol.Message) {
+		microservices[msg.Intention] = msg.ResponseChan
+		metadata[msg.Intention] = meta{true, msg.Sent, clock.Now()}
+		changed(msg.Intention)
+		online()
+		if edda.Logchan != nil {
+			edda.Logchan <- gotocol.Message{gotocol.Put, msg.ResponseChan, msg.Sent, gotocol.NilContext, msg.Intention}
+		}
+		lease("register", msg.Intention)
+	}
+	// evict the online instances whose lease expired, unless so many expired that it's time for self preservation
+	evict := func() {
+		now := clock.Now()
+		var expired []string
+		n := 0
+		for _, s := range gotocol.Names(microservices) {
+			if metadata[s].online {
+				n++
+				if now.Sub(metadata[s].renewed) > archaius.Duration(name, "lease", 3*ep) {
+					expired = append(expired, s)
+				}
 			}
-		case gotocol.Inform:
-			// don't store edges in discovery but do log them
-			if edda.Logchan != nil {
-				edda.Logchan <- msg
+		}
+		if archaius.Bool(name, "selfpreservation", true) && float64(len(expired)) > (1-archaius.Float(name, "renewalpercent", 0.85))*float64(n) {
+			if !preserving {
+				preserving = true
+				log.Printf("%v: self preservation, %v of %v leases expired\n", name, len(expired), n)
+				lease("preserve", "")
 			}
-		case gotocol.GetRequest:
-			if msg.Intention == "" {
-				log.Fatal(name + ": empty GetRequest")
+			return
+		}
+		if preserving {
+			preserving = false
+			log.Printf("%v: leaving self preservation, %v of %v leases expired\n", name, len(expired), n)
+			lease("release", "")
+		}
+		for _, s := range expired { // each registry evicts on its own, evictions aren't replicated
+			metadata[s] = meta{false, now, metadata[s].renewed}
+			changed(s)
+			lease("evict", s)
+		}
+		if len(expired) > 0 {
+			online()
+		}
+	}
+	log.Println(name + ": starting")
+	for {
+		select {
+		case msg, ok = <-listener:
+			if !ok {
+				evictionTicker.Stop()
+				return // channel was closed
 			}
-			if microservices[msg.Intention] != nil { // matched a unique full name
-				gotocol.Message{gotocol.NameDrop, microservices[msg.Intention], time.Now(), gotocol.NilContext, msg.Intention}.GoSend(msg.ResponseChan)
-				break
+			if msg.Imposition == gotocol.Barrier {
+				continue // only used to pace virtual time
 			}
-			for n, ch := range microservices { // respond with all the online names that match the service component
-				if names.Service(n) == msg.Intention {
-					// if there was an update for the looked up service since last check
-					// log.Printf("%v: matching %v with %v, last: %v metadata: %v\n", name, n, msg.Intention, lastrequest[callback{n, msg.ResponseChan}], metadata[n].registered)
-					if metadata[n].registered.After(lastrequest[callback{n, msg.ResponseChan}]) {
-						if metadata[n].online {
-							gotocol.Message{gotocol.NameDrop, ch, time.Now(), gotocol.NilContext, n}.GoSend(msg.ResponseChan)
-						} else {
-							//log.Printf("%v:Forget %v\n", name, n)
-							gotocol.Message{gotocol.Forget, ch, time.Now(), gotocol.NilContext, n}.GoSend(msg.ResponseChan)
-						}
+			collect.Measure(hist, clock.Since(msg.Sent))
+			//commented out because name service traffic is too much noise in the log
+			//if archaius.Conf.Msglog {
+			//	log.Printf("%v(backlog %v): %v\n", name, len(listener), msg)
+			//}
+			switch msg.Imposition {
+			// used to wire up connections to other eureka nodes only
+			case gotocol.NameDrop:
+				if msg.Intention != name { // don't talk to myself
+					eurekaservices[msg.Intention] = msg.ResponseChan
+				}
+			// for new nodes record the data, replicate and maybe pass on to be logged
+			case gotocol.Put:
+				if microservices[msg.Intention] == nil { // ignore duplicate requests
+					microservices[msg.Intention] = msg.ResponseChan
+					metadata[msg.Intention] = meta{true, msg.Sent, clock.Now()}
+					changed(msg.Intention)
+					// replicate request, everyone ends up with the same timestamp for state change of this service
+					replicate(gotocol.Message{gotocol.Replicate, msg.ResponseChan, msg.Sent, gotocol.NilContext, msg.Intention})
+					online()
+					if edda.Logchan != nil {
+						edda.Logchan <- msg
+					}
+					if Registered != nil {
+						Registered(msg.Intention, clock.Now())
 					}
-					// remember for next time
-					lastrequest[callback{n, msg.ResponseChan}] = msg.Sent
 				}
-			}
-		case gotocol.Delete: // remove a node
-			if microservices[msg.Intention] != nil { // matched a unique full name
-				metadata[msg.Intention] = meta{false, time.Now()}
-				// replicate request
-				for _, c := range eurekaservices {
-					gotocol.Message{gotocol.Replicate, nil, time.Now(), gotocol.NilContext, msg.Intention}.GoSend(c)
+			case gotocol.Replicate:
+				if msg.ResponseChan == nil { // a replicated delete
+					if microservices[msg.Intention] != nil && metadata[msg.Intention].online {
+						metadata[msg.Intention] = meta{false, msg.Sent, metadata[msg.Intention].renewed}
+						changed(msg.Intention)
+					}
+				} else if m := metadata[msg.Intention]; microservices[msg.Intention] != nil && m.online { // a replicated renewal
+					m.renewed = clock.Now()
+					metadata[msg.Intention] = m
+				} else if microservices[msg.Intention] == nil || msg.Sent.After(m.registered) { // a new or evicted instance, not a renewal overtaken by its delete
+					microservices[msg.Intention] = msg.ResponseChan
+					metadata[msg.Intention] = meta{true, msg.Sent, clock.Now()}
+					changed(msg.Intention)
 				}
+				online()
+			case gotocol.Renew:
+				if m := metadata[msg.Intention]; microservices[msg.Intention] != nil && m.online {
+					m.renewed = clock.Now()
+					metadata[msg.Intention] = m
+				} else if microservices[msg.Intention] == nil || msg.Sent.After(m.registered) {
+					register(msg)
+				}
+				// replicate the renewal, so instances that only talk to this registry keep their lease everywhere
+				replicate(gotocol.Message{gotocol.Replicate, msg.ResponseChan, msg.Sent, gotocol.NilContext, msg.Intention})
+			case gotocol.Fetch:
+				fetch(msg)
+			case gotocol.Inform:
+				// don't store edges in discovery but do log them
 				if edda.Logchan != nil {
 					edda.Logchan <- msg
 				}
+			case gotocol.GetRequest:
+				if msg.Intention == "" {
+					log.Fatal(name + ": empty GetRequest")
+				}
+				if microservices[msg.Intention] != nil { // matched a unique full name
+					gotocol.Message{gotocol.NameDrop, microservices[msg.Intention], clock.Now(), gotocol.NilContext, msg.Intention}.GoSend(msg.ResponseChan)
+				}
+			case gotocol.Delete: // remove a node
+				if microservices[msg.Intention] != nil { // matched a unique full name
+					metadata[msg.Intention] = meta{false, clock.Now(), metadata[msg.Intention].renewed}
+					changed(msg.Intention)
+					online()
+					// replicate request
+					replicate(gotocol.Message{gotocol.Replicate, nil, clock.Now(), gotocol.NilContext, msg.Intention})
+					if edda.Logchan != nil {
+						edda.Logchan <- msg
+					}
+				}
+			case gotocol.Goodbye:
+				evictionTicker.Stop()
+				gotocol.Message{gotocol.Goodbye, nil, clock.Now(), gotocol.NilContext, name}.GoSend(msg.ResponseChan)
+				log.Println(name + ": closing")
+				return
 			}
-		case gotocol.Goodbye:
-			gotocol.Message{gotocol.Goodbye, nil, time.Now(), gotocol.NilContext, name}.GoSend(msg.ResponseChan)
-			log.Println(name + ": closing")
-			return
+		case <-evictionTicker.C:
+			trim()
+			evict()
 		}
 	}
 }
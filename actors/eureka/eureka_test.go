@@ -10,6 +10,47 @@ import (
 	"time"
 )
 
+// Test that instances that stop renewing are evicted, unless too many stop at once
+func TestLease(t *testing.T) {
+	archaius.Conf.Msglog = false
+	archaius.Set("eureka.eviction", "10ms")
+	archaius.Set("eureka.lease", "50ms")
+	archaius.Set("eureka.renewalpercent", "0.5")
+	edda.Logchan = make(chan gotocol.Message, 100) // read here rather than by edda, so run before any test starts edda
+	eureka := make(chan gotocol.Message, 10)
+	go Start(eureka, "eureka")
+	instance := make(chan gotocol.Message, 100)
+	renew := func(names ...string) {
+		for i := 0; i < 15; i++ {
+			for _, n := range names {
+				eureka <- gotocol.Message{gotocol.Renew, instance, time.Now(), gotocol.NilContext, n}
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for _, n := range []string{"test0", "test1", "test2", "test3"} {
+		eureka <- gotocol.Message{gotocol.Put, instance, time.Now(), gotocol.NilContext, n}
+	}
+	renew("test0", "test1", "test2") // one of four expires, and is evicted
+	renew("test0")                   // two of three expire, so eureka preserves itself
+	listener := make(chan gotocol.Message)
+	eureka <- gotocol.Message{gotocol.Goodbye, listener, time.Now(), gotocol.NilContext, ""}
+	<-listener
+	close(edda.Logchan)
+	var events []string
+	for msg := range edda.Logchan {
+		if msg.Imposition == gotocol.Lease {
+			events = append(events, msg.Intention)
+		}
+	}
+	want := []string{"evict eureka test3", "preserve eureka "}
+	if fmt.Sprint(events) != fmt.Sprint(want) {
+		t.Errorf("lease events %q, want %q", events, want)
+	}
+	edda.Logchan = nil
+	archaius.Set("eureka.renewalpercent", "0.85")
+}
+
 // Test the discovery process by writing and reading back service information
 func TestDiscovery(t *testing.T) {
 	fmt.Println("eureka_test start")
@@ -0,0 +1,30 @@
+package karyon
+
+import (
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"testing"
+	"time"
+)
+
+// Test a service with a worker pool and no dependencies answers every request, freeing the worker each time
+func TestLeaf(t *testing.T) {
+	archaius.Conf.EurekaPoll = "1s"
+	archaius.Conf.Capacity = map[string]archaius.Capacity{"karyon": {Workers: 1}}
+	listener := make(chan gotocol.Message, 10)
+	go Start(listener)
+	listener <- gotocol.Message{gotocol.Hello, nil, time.Now(), gotocol.NilContext, "test.us-east-1.zoneA..karyon00...karyon.karyon"}
+	caller := make(chan gotocol.Message, 10)
+	for i := 0; i < 3; i++ {
+		listener <- gotocol.Message{gotocol.GetRequest, caller, time.Now(), gotocol.NewTrace(), "why?"}
+		select {
+		case msg := <-caller:
+			if msg.Imposition != gotocol.GetResponse {
+				t.Fatalf("request %v got %v", i, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("request %v wasn't answered", i)
+		}
+	}
+	archaius.Conf.Capacity = nil
+}
@@ -5,11 +5,12 @@ package pirate
 import (
 	"fmt"
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/collect"
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/handlers"
+	"github.com/adrianco/spigo/tooling/random"
 	"log"
-	"math/rand"
 	"time"
 )
 
@@ -25,13 +26,17 @@ func Start(listener chan gotocol.Message) {
 	var name string                 // remember my name
 	var logger chan gotocol.Message // if set, send updates
 	var chatrate time.Duration
+	r := random.New("") // don't know name yet
 	hist := collect.NewHist("")
-	chatTicker := time.NewTicker(time.Hour)
+	chatTicker := gotocol.NewTicker(listener, time.Hour)
 	chatTicker.Stop()
 	for {
 		select {
 		case msg := <-listener:
-			collect.Measure(hist, time.Since(msg.Sent))
+			if msg.Imposition == gotocol.Barrier {
+				break // only used to pace virtual time
+			}
+			collect.Measure(hist, clock.Since(msg.Sent))
 			if archaius.Conf.Msglog {
 				log.Printf("%v: %v\n", name, msg)
 			}
@@ -42,6 +47,7 @@ func Start(listener chan gotocol.Message) {
 					fsm = msg.ResponseChan // remember how to talk to my namer
 					name = msg.Intention   // message body is my name
 					hist = collect.NewHist(name)
+					r = random.New(name) // my own random stream
 				}
 			case gotocol.Inform:
 				// remember where to send updates
@@ -54,7 +60,7 @@ func Start(listener chan gotocol.Message) {
 					buddies[buddy] = msg.ResponseChan // message channel is buddy's listener
 					if logger != nil {
 						// if it's setup, tell the logger I have a new buddy to talk to
-						logger <- gotocol.Message{gotocol.Inform, listener, time.Now(), gotocol.NilContext, name + " " + buddy}
+						logger <- gotocol.Message{gotocol.Inform, listener, clock.Now(), gotocol.NilContext, name + " " + buddy}
 					}
 				}
 			case gotocol.Chat:
@@ -62,17 +68,16 @@ func Start(listener chan gotocol.Message) {
 				d, e := time.ParseDuration(msg.Intention)
 				if e == nil && d >= time.Millisecond && d <= time.Hour {
 					chatrate = d
-					chatTicker = time.NewTicker(chatrate)
-					// assume we got paid before we started chatting
-					rand.Seed(int64(booty))
+					chatTicker.Stop()
+					chatTicker = gotocol.NewTicker(listener, chatrate)
 				}
 			case gotocol.GoldCoin:
 				var coin int
 				_, e := fmt.Sscanf(msg.Intention, "%d", &coin)
 				if e == nil && coin > 0 {
 					booty += coin
-					for name, ch := range buddies {
-						if ch == msg.ResponseChan {
+					for _, name := range gotocol.Names(buddies) {
+						if buddies[name] == msg.ResponseChan {
 							benefactors[name] += coin
 						}
 					}
@@ -81,34 +86,34 @@ func Start(listener chan gotocol.Message) {
 				if archaius.Conf.Msglog {
 					log.Printf("%v: Going away with %v gold coins, chatting every %v\n", name, booty, chatrate)
 				}
-				gotocol.Message{gotocol.Goodbye, nil, time.Now(), gotocol.NilContext, name}.GoSend(fsm)
+				gotocol.Message{gotocol.Goodbye, nil, clock.Now(), gotocol.NilContext, name}.GoSend(fsm)
 				return
 			}
 		case <-chatTicker.C:
-			if rand.Intn(100) < 50 { // 50% of the time
+			if r.Intn(100) < 50 { // 50% of the time
 				// use Namedrop to tell the last buddy about the first
 				var firstBuddyName string
 				var firstBuddyChan, lastBuddyChan chan gotocol.Message
 				if len(buddies) >= 2 {
-					for name, ch := range buddies {
+					for _, name := range gotocol.Names(buddies) {
 						if firstBuddyName == "" {
 							firstBuddyName = name
-							firstBuddyChan = ch
+							firstBuddyChan = buddies[name]
 						} else {
-							lastBuddyChan = ch
+							lastBuddyChan = buddies[name]
 						}
-						gotocol.Message{gotocol.NameDrop, firstBuddyChan, time.Now(), gotocol.NewTrace(), firstBuddyName}.GoSend(lastBuddyChan)
+						gotocol.Message{gotocol.NameDrop, firstBuddyChan, clock.Now(), gotocol.NewTrace(), firstBuddyName}.GoSend(lastBuddyChan)
 					}
 				}
 			} else {
 				// send a buddy some money
 				if booty > 0 {
-					donation := rand.Intn(booty)
-					luckyNumber := rand.Intn(len(buddies))
+					donation := r.Intn(booty)
+					luckyNumber := r.Intn(len(buddies))
 					if donation > 0 {
-						for _, ch := range buddies {
+						for _, name := range gotocol.Names(buddies) {
 							if luckyNumber == 0 {
-								gotocol.Message{gotocol.GoldCoin, listener, time.Now(), gotocol.NewTrace(), fmt.Sprintf("%d", donation)}.GoSend(ch)
+								gotocol.Message{gotocol.GoldCoin, listener, clock.Now(), gotocol.NewTrace(), fmt.Sprintf("%d", donation)}.GoSend(buddies[name])
 								booty -= donation
 								break
 							} else {
@@ -0,0 +1,465 @@
+package priamCassandra
+
+import (
+	"fmt"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/flow"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"github.com/adrianco/spigo/tooling/handlers"
+	"github.com/adrianco/spigo/tooling/names"
+	"github.com/adrianco/spigo/tooling/ribbon"
+	"github.com/adrianco/spigo/tooling/usl"
+	"github.com/adrianco/spigo/tooling/versions"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Consistency levels, how many replicas have to answer before the coordinator of a request responds
+const (
+	One         = "one"          // the closest replica
+	Quorum      = "quorum"       // a majority of the replicas in every region
+	LocalQuorum = "local_quorum" // a majority of the replicas in the coordinator's region
+	All         = "all"          // every replica
+)
+
+// defaults, one copy in each of the three zones of a region, requests time out as cassandra's writes do
+const (
+	replication = 3
+	timeout     = 2 * time.Second
+	readRepair  = 0.1 // chance that a read asks every replica for a digest, as read_repair_chance
+)
+
+// kinds of op
+const (
+	reading   = "read"
+	writing   = "write"
+	repairing = "repair" // read repair, the full values of a key from the replicas whose digests didn't match
+	handoff   = "hint"   // a hint replayed to a replica that's back
+)
+
+// op is a request that a coordinator has passed on to replicas, and is waiting for
+type op struct {
+	kind    string
+	key     string
+	value   string               // written, encoded with its version
+	ctx     gotocol.Context      // of the request from the client, or a new trace for repairs
+	client  chan gotocol.Message // where to respond to a read
+	level   string               // consistency level
+	local   string               // region whose replicas count for local quorum
+	need    int                  // replies that count needed
+	sent    int                  // replicas asked
+	counted int                  // replies that count towards the consistency level
+	replies int                  // replicas that answered
+	failed  int                  // replicas that answered with an error
+	asked   []string             // replicas in the order they were asked
+	data    string               // replica asked for the value of a read, the others are asked for a digest
+	values  map[string]string    // replies from each replica
+	latest  versions.Values      // committed when a read started, a read that doesn't cover it is stale
+	done    bool                 // the consistency level was met or can't be
+	started time.Time
+}
+
+// request for a replica
+type request struct {
+	to, intention string
+}
+
+// coordinator of the requests made to a node, each node coordinates the requests that clients send it
+type coordinator struct {
+	name      string
+	listener  chan gotocol.Message
+	router    *ribbon.Router
+	service   *usl.Service
+	rand      *rand.Rand
+	store     map[string]string
+	ring      ByToken
+	pending   map[string]*op               // by the route of the requests to the replicas
+	streams   map[string]map[string]string // keys and values waiting to be streamed to each node that has taken over a range
+	hints     map[string]map[string]string // writes waiting to be handed off to each replica that missed them
+	down      map[string]time.Time         // when the first hint was kept for a replica
+	replaying map[string]bool              // hints being handed off, by replica and key
+	repaired  int                          // keys that read repair found replicas disagreeing about
+	divergent map[string]int               // keys that the last anti-entropy repair with each node found it disagreed about
+	ticks     int                          // eureka polls since the last anti-entropy repair
+}
+
+// makeCoordinator for a node
+func makeCoordinator(listener chan gotocol.Message, router *ribbon.Router, store map[string]string) *coordinator {
+	var c coordinator
+	c.listener = listener
+	c.router = router
+	c.store = store
+	c.pending = make(map[string]*op)
+	c.streams = make(map[string]map[string]string)
+	c.hints = make(map[string]map[string]string)
+	c.down = make(map[string]time.Time)
+	c.replaying = make(map[string]bool)
+	c.divergent = make(map[string]int)
+	return &c
+}
+
+// replication factor, replicas in each region
+func (c *coordinator) rf() int {
+	return archaius.Int(c.name, "cassandra.replication", replication)
+}
+
+// live replicas are this node and the ones it can route to, the ones it can't route to are known to be down
+func (c *coordinator) live(n string) bool {
+	return n == c.name || c.router.Named(n) != nil
+}
+
+// counts is true if a reply from a replica counts towards the consistency level
+func (o *op) counts(n string) bool {
+	return o.level != LocalQuorum || names.Region(n) == o.local
+}
+
+// needed replies for a consistency level, from the replicas of a key
+func needed(level, name string, replicas []string) int {
+	switch level {
+	case One:
+		return 1
+	case Quorum:
+		return len(replicas)/2 + 1
+	case LocalQuorum:
+		local := 0
+		for _, n := range replicas {
+			if names.Region(n) == names.Region(name) {
+				local++
+			}
+		}
+		return local/2 + 1
+	case All:
+		return len(replicas)
+	}
+	log.Fatalf("%v: unknown consistency level %v\n", name, level)
+	return 0
+}
+
+// closest replicas first, this node, then its zone, then its region, in ring order otherwise
+func closest(name string, replicas []string) []string {
+	var distance [4][]string
+	for _, n := range replicas {
+		switch {
+		case n == name:
+			distance[0] = append(distance[0], n)
+		case names.RegionZone(n) == names.RegionZone(name):
+			distance[1] = append(distance[1], n)
+		case names.Region(n) == names.Region(name):
+			distance[2] = append(distance[2], n)
+		default:
+			distance[3] = append(distance[3], n)
+		}
+	}
+	ordered := make([]string, 0, len(replicas))
+	for _, d := range distance {
+		ordered = append(ordered, d...)
+	}
+	return ordered
+}
+
+// newOp on a key
+func newOp(kind, key string, ctx gotocol.Context, client chan gotocol.Message) *op {
+	return &op{kind: kind, key: key, ctx: ctx, client: client, values: make(map[string]string), started: clock.Now()}
+}
+
+// start an op on the replicas of a key, returning the ones that are up closest first, or nil if too few of them are up to meet the consistency level
+func (c *coordinator) start(msg gotocol.Message, kind, key, level string, client chan gotocol.Message) (*op, []string) {
+	replicas := c.ring.Replicas(ringHash(key), c.rf())
+	o := newOp(kind, key, msg.Ctx, client)
+	o.level = strings.ToLower(level)
+	o.local = names.Region(c.name)
+	o.need = needed(o.level, c.name, replicas)
+	var up []string
+	counted := 0
+	for _, n := range closest(c.name, replicas) {
+		if c.live(n) {
+			up = append(up, n)
+			if o.counts(n) {
+				counted++
+			}
+		}
+	}
+	if counted < o.need {
+		return nil, nil
+	}
+	return o, up
+}
+
+// Read a key from enough of the closest replicas to meet the read consistency level, cassandra.read, which defaults to one.
+// The closest is asked for the value and the others for a digest of it, and with a chance of cassandra.readrepair,
+// which defaults to 0.1, every replica that's up is asked so that the ones that differ are repaired.
+func (c *coordinator) Read(msg gotocol.Message) {
+	o, up := c.start(msg, reading, msg.Intention, archaius.String(c.name, "cassandra.read", One), msg.ResponseChan)
+	if o == nil {
+		c.fail(newOp(reading, msg.Intention, msg.Ctx, msg.ResponseChan), gotocol.Unavailable)
+		return
+	}
+	o.latest = versions.Latest(c.name, o.key)
+	all := c.rand.Float64() < archaius.Float(c.name, "cassandra.readrepair", readRepair)
+	var reqs []request
+	for _, n := range up {
+		switch {
+		case o.data == "" && o.counts(n):
+			o.data = n
+			reqs = append(reqs, request{n, o.key})
+		case all || len(reqs) < o.need && o.counts(n):
+			reqs = append(reqs, request{n, o.key + " digest"})
+		}
+	}
+	c.send(o, gotocol.Read, reqs)
+}
+
+// Write a new version of a key and value to every replica that's up, and wait for the write consistency level, cassandra.write,
+// which defaults to one. The coordinator keeps a hint for each replica that's down or doesn't acknowledge the write.
+func (c *coordinator) Write(msg gotocol.Message, key, value string) {
+	o, up := c.start(msg, writing, key, archaius.String(c.name, "cassandra.write", One), nil)
+	if o == nil {
+		collect.ServiceCount(c.name, "_write_unavailable")
+		return
+	}
+	o.value = versions.New(c.name, value, versions.Parse(c.store[key])).String()
+	for _, n := range c.ring.Replicas(ringHash(key), c.rf()) {
+		if !contains(up, n) {
+			c.hint(n, o.key, o.value)
+		}
+	}
+	var reqs []request
+	for _, n := range up {
+		reqs = append(reqs, request{n, key + " " + o.value})
+	}
+	c.send(o, gotocol.Replicate, reqs)
+}
+
+// send requests to replicas, answering for this node straight away, and start the timer
+func (c *coordinator) send(o *op, imp gotocol.Impositions, reqs []request) {
+	ctx := o.ctx.NewParent()
+	c.pending[ctx.Route()] = o
+	o.sent = len(reqs) // before any replies
+	for _, r := range reqs {
+		o.asked = append(o.asked, r.to)
+	}
+	for _, r := range reqs {
+		if r.to == c.name {
+			c.reply(ctx, r.to, c.local(imp, r.intention))
+			continue
+		}
+		outmsg := gotocol.Message{imp, c.listener, clock.Now(), o.ctx.NewParent(), r.intention}
+		flow.AnnotateSend(outmsg, c.name)
+		outmsg.GoSend(c.router.Named(r.to))
+	}
+	if c.pending[ctx.Route()] == o { // still waiting
+		clock.After(archaius.Duration(c.name, "cassandra.timeout", timeout), func() {
+			gotocol.Message{gotocol.Timeout, nil, clock.Now(), ctx, ""}.Redeliver(c.listener)
+		})
+	}
+}
+
+// local read or write of a key on this node as a replica, returns the reply, the value or digest of a read, or an ack.
+// A write is merged with the versions this node has, so replicas converge whatever order they're written in.
+func (c *coordinator) local(imp gotocol.Impositions, intention string) string {
+	var key, value string
+	fmt.Sscanf(intention, "%s%s", &key, &value)
+	if imp == gotocol.Read {
+		if value == "digest" {
+			return digest(c.store[key])
+		}
+		return c.store[key]
+	}
+	if key != "" && value != "" {
+		c.store[key] = c.resolve(c.store[key], value)
+	}
+	return "ack"
+}
+
+// resolve two encoded values of a key into one, by cassandra's last write wins or by keeping siblings, as versions.resolution
+func (c *coordinator) resolve(a, b string) string {
+	return versions.Merge(versions.Resolution(c.name), versions.Parse(a), versions.Parse(b)).String()
+}
+
+// digest of a value, so replicas can be compared without sending it
+func digest(value string) string {
+	return fmt.Sprintf("%08x", ringHash(value))
+}
+
+// Replica handles a read or write sent by a coordinator, a read takes the service time of this node
+func (c *coordinator) Replica(msg gotocol.Message) {
+	outmsg := gotocol.Message{gotocol.GetResponse, c.listener, clock.Now(), msg.Ctx, c.local(msg.Imposition, msg.Intention)}
+	if msg.Imposition == gotocol.Read {
+		handlers.Respond(outmsg, c.name, msg.ResponseChan, c.service, len(c.pending))
+		return
+	}
+	flow.AnnotateSend(outmsg, c.name)
+	outmsg.GoSend(msg.ResponseChan)
+}
+
+// Reply from a replica, once enough have answered the read is returned to the client, and the latency is measured
+func (c *coordinator) Reply(msg gotocol.Message) {
+	c.reply(msg.Ctx, c.router.NameChan(msg.ResponseChan), msg.Intention)
+}
+
+func (c *coordinator) reply(ctx gotocol.Context, from, value string) {
+	o := c.pending[ctx.Route()]
+	if o == nil {
+		return // timed out, or an ack for a repair that isn't waited for
+	}
+	o.values[from] = value
+	o.replies++
+	if o.counts(from) {
+		o.counted++
+	}
+	if _, ok := o.values[o.data]; !o.done && o.counted >= o.need && (o.data == "" || ok) {
+		o.done = true
+		c.complete(o)
+	}
+	if o.replies+o.failed >= o.sent {
+		delete(c.pending, ctx.Route())
+		if !o.done { // the replica asked for the value of a read failed
+			o.done = true
+			c.fail(o, gotocol.Failed)
+		}
+		c.finish(o)
+	}
+}
+
+// complete an op that has met its consistency level, a read is returned to the client, the rest of the replies are still waited for
+func (c *coordinator) complete(o *op) {
+	switch o.kind {
+	case writing:
+		collect.Measure(collect.ServiceHist(c.name, "_write"), clock.Since(o.started))
+		versions.Committed(c.name, o.key, versions.Parse(o.value))
+	case reading:
+		collect.Measure(collect.ServiceHist(c.name, "_read"), clock.Since(o.started))
+		got := versions.Parse(o.values[o.data])
+		versions.Check(c.name, o.latest, got)
+		handlers.Respond(gotocol.Message{gotocol.GetResponse, c.listener, clock.Now(), o.ctx, got.Data()}, c.name, o.client, c.service, len(c.pending))
+	}
+}
+
+// finish an op once every replica has answered or it timed out, digests that don't match are read repaired,
+// read repairs write the merged versions back to the replicas that differ, and writes that weren't acknowledged are hinted
+func (c *coordinator) finish(o *op) {
+	switch o.kind {
+	case reading:
+		v, ok := o.values[o.data]
+		if !ok {
+			return
+		}
+		differ := []string{o.data}
+		for _, n := range o.asked {
+			if d, ok := o.values[n]; ok && n != o.data && d != digest(v) {
+				differ = append(differ, n)
+			}
+		}
+		if len(differ) > 1 {
+			c.repaired++
+			collect.ServiceGauge(c.name, "_read_repairs", c.repaired)
+			c.readRepair(o.key, differ)
+		}
+	case repairing:
+		merged := ""
+		for _, n := range o.asked {
+			merged = c.resolve(merged, o.values[n])
+		}
+		for _, n := range o.asked {
+			if v, ok := o.values[n]; ok && v != merged && merged != "" {
+				c.push(n, o.key, merged)
+			}
+		}
+	case writing:
+		for _, n := range o.asked {
+			if _, ok := o.values[n]; !ok {
+				c.hint(n, o.key, o.value)
+			}
+		}
+	case handoff:
+		c.handedOff(o)
+	}
+}
+
+// readRepair asks replicas that disagree about a key for their values
+func (c *coordinator) readRepair(key string, replicas []string) {
+	o := newOp(repairing, key, gotocol.NewTrace(), nil)
+	var reqs []request
+	for _, n := range replicas {
+		if c.live(n) {
+			reqs = append(reqs, request{n, key})
+		}
+	}
+	o.need = len(reqs)
+	c.send(o, gotocol.Read, reqs)
+}
+
+// push a value to a replica that's missing it or has a different one, the ack isn't waited for
+func (c *coordinator) push(n, key, value string) {
+	intention := key + " " + value
+	if n == c.name {
+		c.local(gotocol.Replicate, intention)
+		return
+	}
+	if ch := c.router.Named(n); ch != nil {
+		outmsg := gotocol.Message{gotocol.Replicate, c.listener, clock.Now(), gotocol.NewTrace(), intention}
+		flow.AnnotateSend(outmsg, c.name)
+		outmsg.GoSend(ch)
+	}
+}
+
+// Failed reply from a replica, such as load shedding, the op fails if too few replicas are left to meet the consistency level
+func (c *coordinator) Failed(msg gotocol.Message) {
+	o := c.pending[msg.Ctx.Route()]
+	if o == nil {
+		return
+	}
+	o.failed++
+	if !o.done && o.sent-o.failed < o.need {
+		o.done = true
+		c.fail(o, msg.Intention)
+	}
+	if o.replies+o.failed >= o.sent {
+		delete(c.pending, msg.Ctx.Route())
+		if !o.done {
+			o.done = true
+			c.fail(o, msg.Intention)
+		}
+		c.finish(o)
+	}
+}
+
+// Timeout of an op that hasn't had every reply, it fails if it hasn't met its consistency level
+func (c *coordinator) Timeout(msg gotocol.Message) {
+	o := c.pending[msg.Ctx.Route()]
+	if o == nil {
+		return
+	}
+	delete(c.pending, msg.Ctx.Route())
+	if !o.done {
+		o.done = true
+		c.fail(o, "")
+	}
+	c.finish(o)
+}
+
+// fail a read or write, counted as <service>_<kind>_unavailable or _timeouts, a read is answered with the error or a timeout
+func (c *coordinator) fail(o *op, status string) {
+	if o.kind != reading && o.kind != writing {
+		return
+	}
+	if status == gotocol.Unavailable {
+		collect.ServiceCount(c.name, "_"+o.kind+"_unavailable")
+	} else {
+		collect.ServiceCount(c.name, "_"+o.kind+"_timeouts")
+	}
+	if o.client == nil {
+		return
+	}
+	c.service.Release()
+	outmsg := gotocol.Message{gotocol.Timeout, c.listener, clock.Now(), o.ctx, c.name}
+	if status != "" {
+		outmsg = gotocol.Message{gotocol.Error, c.listener, clock.Now(), o.ctx, status}
+	}
+	flow.AnnotateSend(outmsg, c.name)
+	outmsg.GoSend(o.client)
+}
@@ -0,0 +1,84 @@
+package priamCassandra
+
+import (
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"sort"
+	"time"
+)
+
+// hints are kept for a replica that has been down for less than this, as max_hint_window
+const hintWindow = 3 * time.Hour
+
+// hint a write for a replica that's down or didn't acknowledge it, to hand off when it's back,
+// unless the replica has been missing writes for longer than cassandra.hintwindow
+func (c *coordinator) hint(n, key, value string) {
+	if value == "" {
+		return
+	}
+	if c.hints[n] == nil {
+		c.hints[n] = make(map[string]string)
+		c.down[n] = clock.Now()
+	}
+	if clock.Since(c.down[n]) > archaius.Duration(c.name, "cassandra.hintwindow", hintWindow) {
+		return // anti-entropy repair has to catch it up
+	}
+	c.hints[n][key] = c.resolve(c.hints[n][key], value)
+	c.hinted()
+}
+
+// hinted keys waiting to be handed off, the number of keys the replicas are known to be missing, in <service>_hinted
+func (c *coordinator) hinted() {
+	total := 0
+	for _, h := range c.hints {
+		total += len(h)
+	}
+	collect.ServiceGauge(c.name, "_hinted", total)
+}
+
+// Handoff the hints for each replica that can be routed to, a hint is replayed until the replica acknowledges it
+func (c *coordinator) Handoff() {
+	ns := make([]string, 0, len(c.hints))
+	for n := range c.hints {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	for _, n := range ns {
+		if !c.ring.member(n) {
+			delete(c.hints, n) // it was replaced or left, and its ranges were streamed
+			delete(c.down, n)
+			continue
+		}
+		if c.router.Named(n) == nil {
+			continue
+		}
+		for _, key := range sorted(c.hints[n]) {
+			if c.replaying[n+" "+key] {
+				continue
+			}
+			c.replaying[n+" "+key] = true
+			o := newOp(handoff, key, gotocol.NewTrace(), nil)
+			o.value = c.hints[n][key]
+			o.need = 1
+			c.send(o, gotocol.Replicate, []request{{n, key + " " + o.value}})
+		}
+	}
+	c.hinted()
+}
+
+// handedOff a hint, it's dropped if the replica acknowledged it and it wasn't replaced by a newer one
+func (c *coordinator) handedOff(o *op) {
+	n := o.asked[0]
+	delete(c.replaying, n+" "+o.key)
+	if _, ok := o.values[n]; !ok || c.hints[n][o.key] != o.value {
+		return
+	}
+	delete(c.hints[n], o.key)
+	if len(c.hints[n]) == 0 {
+		delete(c.hints, n)
+		delete(c.down, n)
+	}
+	c.hinted()
+}
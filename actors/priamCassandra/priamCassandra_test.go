@@ -2,8 +2,15 @@ package priamCassandra
 
 import (
 	"fmt"
+	"github.com/adrianco/spigo/tooling/archaius"
 	"github.com/adrianco/spigo/tooling/gotocol"
+	"github.com/adrianco/spigo/tooling/names"
+	"github.com/adrianco/spigo/tooling/ribbon"
+	"github.com/adrianco/spigo/tooling/versions"
+	"math/rand"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestPriamCassandra(t *testing.T) {
@@ -25,3 +32,301 @@ func TestPriamCassandra(t *testing.T) {
 	}
 	fmt.Println(c)
 }
+
+func TestReplace(t *testing.T) {
+	cass := make(map[string]chan gotocol.Message, 4)
+	for i := 0; i < 4; i++ {
+		cass[fmt.Sprintf("cass%v", i)] = nil
+	}
+	before := RingConfig(Distribute(cass))
+	after := RingConfig(Replace(cass, Distribute(cass), "cass2", "cass9"))
+	if len(after) != len(before) {
+		t.Fatalf("ring changed size: %v", after)
+	}
+	for i := range before {
+		want := before[i].name
+		if want == "cass2" {
+			want = "cass9"
+		}
+		if after[i].name != want || after[i].token != before[i].token {
+			t.Fatalf("got %v, want %v with the token of %v", after[i], want, before[i])
+		}
+	}
+}
+
+// a cluster with count nodes in each region, spread across three zones
+func cluster(regions, count int) map[string]chan gotocol.Message {
+	rs := []string{"us-east-1", "us-west-2", "eu-west-1"}
+	zs := []string{"zoneA", "zoneB", "zoneC"}
+	cass := make(map[string]chan gotocol.Message)
+	for r := 0; r < regions; r++ {
+		for i := r * count; i < (r+1)*count; i++ {
+			cass[names.Make("test", rs[r], zs[i%len(zs)], "cass", "priamCassandra", i)] = nil
+		}
+	}
+	return cass
+}
+
+func TestFind(t *testing.T) {
+	r := RingConfig("a:100,b:200,c:300")
+	for h, want := range map[uint32]string{0: "c", 99: "c", 100: "a", 150: "a", 200: "b", 299: "b", 300: "c", 0xFFFFFFFF: "c"} {
+		if n := r[r.Find(h)].name; n != want {
+			t.Errorf("Find(%v) got %v, want %v", h, n, want)
+		}
+	}
+	if ByToken(nil).Find(5) != 0 {
+		t.Error("Find on an empty ring")
+	}
+	r = RingConfig("test.us-east-1.zoneA.cass:42,bad")
+	if len(r) != 1 || r[0].name != "test.us-east-1.zoneA.cass" || r[0].token != 42 {
+		t.Errorf("RingConfig with colons got %v", r)
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	defer archaius.Set("cassandra.vnodes", "1")
+	for _, vnodes := range []string{"1", "8"} {
+		archaius.Set("cassandra.vnodes", vnodes)
+		r := RingConfig(Distribute(cluster(2, 6)))
+		if vnodes == "8" && len(r) != 12*8 {
+			t.Fatalf("got %v tokens with vnodes", len(r))
+		}
+		for i := 0; i < 100; i++ {
+			replicas := r.Replicas(ringHash(fmt.Sprintf("key%v", i)), 3)
+			if len(replicas) != 6 {
+				t.Fatalf("got %v replicas, want 3 in each region", replicas)
+			}
+			zones := make(map[string]bool)
+			for _, n := range replicas {
+				zones[names.RegionZone(n)] = true
+			}
+			if len(zones) != 6 {
+				t.Fatalf("replicas share a zone %v", replicas)
+			}
+		}
+		// more replicas than zones in a region fill up with the nodes that were skipped
+		if replicas := r.Replicas(ringHash("key"), 4); len(replicas) != 8 {
+			t.Fatalf("got %v replicas, want 4 in each region", replicas)
+		}
+	}
+}
+
+func TestConsistency(t *testing.T) {
+	ns := gotocol.Names(cluster(2, 3))
+	me := ns[4] // us-west-2.zoneB
+	for level, want := range map[string]int{One: 1, Quorum: 4, LocalQuorum: 2, All: 6} {
+		if n := needed(level, me, ns); n != want {
+			t.Errorf("%v needs %v, want %v", level, n, want)
+		}
+	}
+	c := closest(me, ns)
+	if c[0] != me || names.Region(c[1]) != names.Region(me) || names.Region(c[2]) != names.Region(me) || names.Region(c[3]) == names.Region(me) {
+		t.Errorf("closest got %v", c)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	cass := cluster(1, 3)
+	ns := gotocol.Names(cass)
+	r := RingConfig(Distribute(cass))
+	joined := RingConfig(Bootstrap(cass, r.String(), "new"))
+	if len(joined) != 4 || !joined.member("new") {
+		t.Fatalf("bootstrap got %v", joined)
+	}
+	// the new node takes half the largest range, so the others keep their tokens
+	for _, n := range r {
+		if joined[joined.Find(n.token)] != n {
+			t.Errorf("%v moved when a node joined: %v", n, joined)
+		}
+	}
+	if h := joined[joined.Find(r.bisect())]; h.name != "new" || h.token != r.bisect() {
+		t.Errorf("bisect got %v, want the new node", h)
+	}
+	left := RingConfig(Decommission(cass, joined.String(), ns[1]))
+	if len(left) != 3 || left.member(ns[1]) {
+		t.Fatalf("decommission got %v", left)
+	}
+	archaius.Set("cassandra.rebalance", "true")
+	defer archaius.Set("cassandra.rebalance", "false")
+	even := RingConfig(Bootstrap(cass, r.String(), "new"))
+	if len(even) != 4 || even[1].token-even[0].token != even[2].token-even[1].token {
+		t.Errorf("rebalance got %v, want evenly spaced tokens", even)
+	}
+	archaius.Set("cassandra.vnodes", "4")
+	defer archaius.Set("cassandra.vnodes", "1")
+	if v := RingConfig(Bootstrap(cass, r.String(), "new")); len(v) != 3+4 {
+		t.Errorf("vnodes bootstrap got %v", v)
+	}
+}
+
+func TestStream(t *testing.T) {
+	cass := cluster(1, 4)
+	ns := gotocol.Names(cass)
+	ring := Distribute(cass)
+	router := ribbon.MakeRouter()
+	inbox := make(map[string]chan gotocol.Message)
+	for _, n := range ns[1:] {
+		inbox[n] = make(chan gotocol.Message, 100)
+		router.Add(n, inbox[n], time.Now())
+	}
+	c := makeCoordinator(nil, router, make(map[string]string))
+	c.name = ns[0]
+	c.Change(ring)
+	for i := 0; i < 20; i++ {
+		c.store[fmt.Sprintf("key%v", i)] = "value"
+	}
+	// the node that leaves sends every key it held to the one that takes it over, the three left are in different zones
+	c.Change(Decommission(cass, ring, ns[0]))
+	want := 0
+	for k := range c.store {
+		if contains(RingConfig(ring).Replicas(ringHash(k), 3), ns[0]) {
+			want++
+		}
+	}
+	got := make(chan gotocol.Message, 100)
+	for _, n := range ns[1:] {
+		go func(in chan gotocol.Message) {
+			for msg := range in {
+				got <- msg
+			}
+		}(inbox[n])
+	}
+	for i := 0; i < want; i++ {
+		select {
+		case msg := <-got:
+			if msg.Imposition != gotocol.Stream || len(strings.Fields(msg.Intention)) != 3 {
+				t.Fatalf("got %v", msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("streamed %v keys, want %v", i, want)
+		}
+	}
+	if len(c.streams) != 0 {
+		t.Errorf("still waiting to stream %v", c.streams)
+	}
+}
+
+// member of a test cluster, a coordinator that can route to the other nodes that are up, with an inbox for what they're sent
+func member(cass map[string]chan gotocol.Message, ring, name string, up ...string) *coordinator {
+	router := ribbon.MakeRouter()
+	for _, n := range up {
+		router.Add(n, cass[n], time.Now())
+	}
+	c := makeCoordinator(cass[name], router, make(map[string]string))
+	c.name = name
+	c.rand = rand.New(rand.NewSource(1))
+	c.Change(ring)
+	return c
+}
+
+// inboxes for the nodes of a test cluster
+func inboxes(cass map[string]chan gotocol.Message) {
+	for n := range cass {
+		cass[n] = make(chan gotocol.Message, 100)
+	}
+}
+
+// next message sent to a node
+func next(t *testing.T, in chan gotocol.Message, imp gotocol.Impositions) gotocol.Message {
+	select {
+	case msg := <-in:
+		if msg.Imposition != imp {
+			t.Fatalf("got %v, want %v", msg, imp)
+		}
+		return msg
+	case <-time.After(time.Second):
+		t.Fatalf("no %v sent", imp)
+	}
+	return gotocol.Message{}
+}
+
+func TestHints(t *testing.T) {
+	cass := cluster(1, 3)
+	ring := Distribute(cass)
+	inboxes(cass)
+	ns := gotocol.Names(cass)
+	c := member(cass, ring, ns[0], ns[1]) // ns[2] is down
+	c.Write(gotocol.Message{gotocol.Put, nil, time.Now(), gotocol.NewTrace(), "key value"}, "key", "value")
+	next(t, cass[ns[1]], gotocol.Replicate)
+	written := c.hints[ns[2]]["key"]
+	if versions.Parse(written).Data() != "value" || len(c.hints) != 1 {
+		t.Fatalf("hints got %v", c.hints)
+	}
+	// the replica is back, it's handed the hint once until it acknowledges it
+	c.router.Add(ns[2], cass[ns[2]], time.Now())
+	c.Handoff()
+	c.Handoff()
+	msg := next(t, cass[ns[2]], gotocol.Replicate)
+	if msg.Intention != "key "+written || len(cass[ns[2]]) != 0 {
+		t.Fatalf("handoff got %v", msg)
+	}
+	c.Reply(gotocol.Message{gotocol.GetResponse, cass[ns[2]], time.Now(), msg.Ctx, "ack"})
+	if len(c.hints) != 0 || len(c.replaying) != 0 || len(c.down) != 0 {
+		t.Errorf("hints left %v", c.hints)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	cass := cluster(1, 3)
+	ring := Distribute(cass)
+	inboxes(cass)
+	ns := gotocol.Names(cass)
+	c := member(cass, ring, ns[0], ns[1], ns[2])
+	old := versions.Version{"old", 100, map[string]int{ns[2]: 1}}
+	latest := versions.Version{"new", 200, map[string]int{ns[2]: 1, ns[0]: 1}}
+	c.store["key"] = latest.String()
+	archaius.Set("cassandra.readrepair", "1")
+	defer archaius.Set("cassandra.readrepair", "0.1")
+	client := make(chan gotocol.Message, 1)
+	c.Read(gotocol.Message{gotocol.GetRequest, client, time.Now(), gotocol.NewTrace(), "key"})
+	if msg := next(t, client, gotocol.GetResponse); msg.Intention != "new" {
+		t.Fatalf("read got %v", msg)
+	}
+	// every replica is asked for a digest, and the one that's out of date is repaired
+	for n, value := range map[string]string{ns[1]: latest.String(), ns[2]: old.String()} {
+		msg := next(t, cass[n], gotocol.Read)
+		if msg.Intention != "key digest" {
+			t.Fatalf("digest request got %v", msg)
+		}
+		c.Reply(gotocol.Message{gotocol.GetResponse, cass[n], time.Now(), msg.Ctx, digest(value)})
+	}
+	if c.repaired != 1 || len(cass[ns[1]]) != 0 {
+		t.Fatalf("read repaired %v keys", c.repaired)
+	}
+	msg := next(t, cass[ns[2]], gotocol.Read)
+	c.Reply(gotocol.Message{gotocol.GetResponse, cass[ns[2]], time.Now(), msg.Ctx, old.String()})
+	if msg = next(t, cass[ns[2]], gotocol.Replicate); msg.Intention != "key "+latest.String() {
+		t.Errorf("repair got %v", msg)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	cass := cluster(1, 3)
+	ring := Distribute(cass)
+	inboxes(cass)
+	ns := gotocol.Names(cass)
+	a := member(cass, ring, ns[0], ns[1], ns[2])
+	b := member(cass, ring, ns[1], ns[0], ns[2])
+	for i := 0; i < 50; i++ {
+		a.store[fmt.Sprintf("key%v", i)] = "value"
+		b.store[fmt.Sprintf("key%v", i)] = "value"
+	}
+	b.store["key3"] = "stale"
+	delete(b.store, "key7")
+	delete(a.store, "key9")
+	if *a.tree(ns[1]) == *b.tree(ns[0]) {
+		t.Fatal("trees match")
+	}
+	a.Repair()
+	b.Compare(next(t, cass[ns[1]], gotocol.Repair))
+	a.Compare(next(t, cass[ns[0]], gotocol.Repair))
+	if a.divergent[ns[1]] != 3 || a.store["key9"] != "value" {
+		t.Fatalf("repair found %v divergent keys", a.divergent)
+	}
+	for i := 0; i < 2; i++ {
+		b.Replica(next(t, cass[ns[1]], gotocol.Replicate))
+	}
+	if *a.tree(ns[1]) != *b.tree(ns[0]) {
+		t.Errorf("trees differ after repair %v %v", a.tree(ns[1]), b.tree(ns[0]))
+	}
+}
@@ -0,0 +1,169 @@
+package priamCassandra
+
+import (
+	"fmt"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/flow"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"strings"
+	"time"
+)
+
+// anti-entropy repair runs this often by default, nodetool repair is usually weekly but a simulation is short
+const repairEvery = 5 * time.Second
+
+// leaves of the hash tree, each covers the keys that hash into it
+const leaves = 16
+
+// tree of hashes of the keys and values a node shares with another, only the leaves are sent as they are few
+type tree [leaves]uint32
+
+// leaf a key belongs in
+func leaf(key string) int {
+	return int(ringHash(key) % leaves)
+}
+
+// String of the leaf hashes for a Repair message
+func (t *tree) String() string {
+	s := make([]string, leaves)
+	for i, h := range t {
+		s[i] = fmt.Sprintf("%x", h)
+	}
+	return strings.Join(s, " ")
+}
+
+// shared is true if this node and another are both replicas of a key
+func (c *coordinator) shared(key, n string) bool {
+	rs := c.ring.Replicas(ringHash(key), c.rf())
+	return contains(rs, c.name) && contains(rs, n)
+}
+
+// tree of the keys this node shares with another, the hashes of each key and value are combined so order doesn't matter
+func (c *coordinator) tree(n string) *tree {
+	var t tree
+	for key, value := range c.store {
+		if c.shared(key, n) {
+			t[leaf(key)] ^= ringHash(key + " " + value)
+		}
+	}
+	return &t
+}
+
+// Due counts a eureka poll, it's time for anti-entropy repair every cassandra.repair, rounded to whole polls, zero turns it off
+func (c *coordinator) Due() bool {
+	every := archaius.Duration(c.name, "cassandra.repair", repairEvery)
+	ep, _ := time.ParseDuration(archaius.Conf.EurekaPoll)
+	if every <= 0 || len(c.ring) == 0 {
+		return false
+	}
+	n := 1
+	if ep > 0 {
+		n = int(every / ep)
+	}
+	c.ticks++
+	if c.ticks < n {
+		return false
+	}
+	c.ticks = 0
+	return true
+}
+
+// Repair this node's ranges with every other node in the ring it can route to, by sending each the hash tree of the keys they share
+func (c *coordinator) Repair() {
+	c.divergent = make(map[string]int)
+	for _, n := range c.ring.members() {
+		ch := c.router.Named(n)
+		if n == c.name || ch == nil {
+			continue
+		}
+		outmsg := gotocol.Message{gotocol.Repair, c.listener, clock.Now(), gotocol.NewTrace(), "tree " + c.tree(n).String()}
+		flow.AnnotateSend(outmsg, c.name)
+		outmsg.GoSend(ch)
+	}
+}
+
+// Compare a hash tree from another node with this node's and reply with the keys in the leaves that differ,
+// or merge the keys sent in reply to this node's tree
+func (c *coordinator) Compare(msg gotocol.Message) {
+	from := c.router.NameChan(msg.ResponseChan)
+	fields := strings.Fields(msg.Intention)
+	if from == "" || len(fields) < 2 {
+		return // not found yet
+	}
+	if fields[0] == "keys" {
+		c.merge(from, fields[1], fields[2:])
+		return
+	}
+	mine := c.tree(from)
+	differ := make(map[int]bool)
+	var ls []string
+	for i, f := range fields[1:] {
+		var h uint32
+		fmt.Sscanf(f, "%x", &h)
+		if i < leaves && h != mine[i] {
+			differ[i] = true
+			ls = append(ls, fmt.Sprint(i))
+		}
+	}
+	reply := "keys -"
+	if len(ls) > 0 {
+		reply = "keys " + strings.Join(ls, ",")
+		for _, key := range sorted(c.store) {
+			if differ[leaf(key)] && c.shared(key, from) {
+				reply += " " + key + " " + c.store[key]
+			}
+		}
+	}
+	outmsg := gotocol.Message{gotocol.Repair, c.listener, clock.Now(), msg.Ctx.NewParent(), reply}
+	flow.AnnotateSend(outmsg, c.name)
+	outmsg.GoSend(msg.ResponseChan)
+}
+
+// merge the keys in the leaves that differ from another node with this node's. The versions of a key on both
+// nodes are merged, and the result is stored here and sent to the other node if it's missing it. The keys that
+// differ are counted for each node this one repaired with, and their total is in <service>_repair_divergent.
+func (c *coordinator) merge(from, ls string, pairs []string) {
+	differ := make(map[int]bool)
+	for _, l := range strings.Split(ls, ",") {
+		var i int
+		if _, err := fmt.Sscanf(l, "%d", &i); err == nil {
+			differ[i] = true
+		}
+	}
+	theirs := make(map[string]string)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		theirs[pairs[i]] = pairs[i+1]
+	}
+	keys := make(map[string]string)
+	for key := range c.store {
+		if differ[leaf(key)] && c.shared(key, from) {
+			keys[key] = ""
+		}
+	}
+	for key := range theirs {
+		keys[key] = ""
+	}
+	divergent := 0
+	for _, key := range sorted(keys) {
+		mine := c.store[key]
+		if mine == theirs[key] {
+			continue
+		}
+		divergent++
+		merged := c.resolve(mine, theirs[key])
+		if merged != mine {
+			c.store[key] = merged
+		}
+		if merged != theirs[key] {
+			c.push(from, key, merged)
+		}
+	}
+	c.divergent[from] = divergent
+	total := 0
+	for _, d := range c.divergent {
+		total += d
+	}
+	collect.ServiceGauge(c.name, "_repair_divergent", total)
+}
@@ -0,0 +1,272 @@
+package priamCassandra
+
+import (
+	"fmt"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"github.com/adrianco/spigo/tooling/names"
+	"hash/crc32"
+	"sort"
+	"strings"
+)
+
+// cassandra token to server map
+type node struct {
+	name  string
+	token uint32
+}
+
+// ByToken ring of node names sorted by token, a node has one token for each of its virtual nodes
+type ByToken []node
+
+// implement node array sortable by Token interface
+func (a ByToken) Len() int           { return len(a) }
+func (a ByToken) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByToken) Less(i, j int) bool { return a[i].token < a[j].token }
+
+// hash a string into the ring
+func ringHash(s string) uint32 {
+	return crc32.ChecksumIEEE([]byte(s))
+}
+
+// Find the node in the ring for a token, the one with the highest token at or below it, wrapping round to the last
+func (a ByToken) Find(h uint32) int {
+	i := sort.Search(len(a), func(i int) bool { return a[i].token > h }) - 1
+	if i < 0 {
+		i = len(a) - 1
+	}
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+// Replicas of a token, walking the ring from the node that owns it to pick rf distinct nodes in each region,
+// in different zones while there are zones left, like Cassandra's NetworkTopologyStrategy with a rack per zone
+func (a ByToken) Replicas(h uint32, rf int) []string {
+	var replicas []string
+	picked := make(map[string]bool)
+	count := make(map[string]int)        // replicas picked in each region
+	zones := make(map[string]bool)       // region.zones with a replica
+	skipped := make(map[string][]string) // nodes passed over in each region because their zone had a replica
+	regions := make([]string, 0, len(a)) // in the order they're found, so the result is repeatable
+	start := a.Find(h)
+	for i := range a {
+		n := a[(start+i)%len(a)].name
+		r := names.Region(n)
+		if picked[n] || count[r] >= rf {
+			continue
+		}
+		if _, ok := count[r]; !ok {
+			regions = append(regions, r)
+			count[r] = 0
+		}
+		picked[n] = true
+		if zones[names.RegionZone(n)] {
+			skipped[r] = append(skipped[r], n)
+			continue
+		}
+		zones[names.RegionZone(n)] = true
+		replicas = append(replicas, n)
+		count[r]++
+	}
+	for _, r := range regions {
+		for _, n := range skipped[r] {
+			if count[r] >= rf {
+				break
+			}
+			replicas = append(replicas, n)
+			count[r]++
+		}
+	}
+	return replicas
+}
+
+// Distribute tokens to the nodes of a cassandra cluster, in every zone and region. Nodes join with Bootstrap,
+// leave with Decommission and dead nodes are replaced with Replace.
+func Distribute(cass map[string]chan gotocol.Message) string {
+	ns := gotocol.Names(cass)
+	if len(ns) == 0 {
+		return ""
+	}
+	s := tokens(ns)
+	tell(cass, s)
+	return s // for logging and test
+}
+
+// tokens for the nodes of a ring, in a config string of the form cass1:0,cass4:1000,cass2:2000
+// With one token per node they are evenly spaced, and handed out to each zone in turn as Priam does, so the
+// replicas of a range are in different zones. With cassandra.vnodes tokens per node they are placed at random by hashing.
+func tokens(ns []string) string {
+	vnodes := archaius.Int(ns[0], "cassandra.vnodes", 1)
+	s := ""
+	if vnodes <= 1 {
+		ns = interleave(ns)
+		// each node owns a share of the full range
+		hashrange := uint32(0xFFFFFFFF) / uint32(len(ns))
+		for i, n := range ns {
+			s += fmt.Sprintf("%s:%v,", n, hashrange*uint32(i))
+		}
+	} else {
+		for _, n := range ns {
+			s += hashed(n, vnodes)
+		}
+	}
+	return strings.TrimSuffix(s, ",")
+}
+
+// hashed tokens for the virtual nodes of a node
+func hashed(n string, vnodes int) string {
+	s := ""
+	for v := 0; v < vnodes; v++ {
+		s += fmt.Sprintf("%s:%v,", n, ringHash(fmt.Sprintf("%s#%v", n, v)))
+	}
+	return s
+}
+
+// tell the nodes of a cluster about a new ring, repurposing the Chat message type as a kind of Gossip setup
+func tell(cass map[string]chan gotocol.Message, s string) {
+	for _, n := range gotocol.Names(cass) {
+		gotocol.Send(cass[n], gotocol.Message{gotocol.Chat, nil, clock.Now(), gotocol.NilContext, s})
+	}
+}
+
+// interleave sorted node names so that each region and zone takes a turn
+func interleave(ns []string) []string {
+	var zones []string
+	byZone := make(map[string][]string)
+	for _, n := range ns {
+		rz := names.RegionZone(n)
+		if byZone[rz] == nil {
+			zones = append(zones, rz)
+		}
+		byZone[rz] = append(byZone[rz], n)
+	}
+	sort.Strings(zones)
+	turns := make([]string, 0, len(ns))
+	for i := 0; len(turns) < len(ns); i++ {
+		for _, rz := range zones {
+			if i < len(byZone[rz]) {
+				turns = append(turns, byZone[rz][i])
+			}
+		}
+	}
+	return turns
+}
+
+// Replace a dead node of a cassandra cluster with a new node that takes over its tokens, and send the new config to the nodes
+func Replace(cass map[string]chan gotocol.Message, config, dead, replacement string) string {
+	r := RingConfig(config)
+	for i := range r {
+		if r[i].name == dead {
+			r[i].name = replacement
+		}
+	}
+	s := r.String()
+	tell(cass, s)
+	return s
+}
+
+// Bootstrap a node that joins a cassandra cluster, and send the new config to the nodes, including the one joining.
+// With one token per node it takes half of the largest range, or if cassandra.rebalance is set every node moves
+// to evenly spaced tokens. With vnodes it gets tokens placed by hashing, so it takes a little from every node.
+func Bootstrap(cass map[string]chan gotocol.Message, config, joining string) string {
+	r := RingConfig(config)
+	var s string
+	switch vnodes := archaius.Int(joining, "cassandra.vnodes", 1); {
+	case len(r) == 0:
+		s = tokens([]string{joining})
+	case vnodes > 1:
+		s = r.String() + "," + strings.TrimSuffix(hashed(joining, vnodes), ",")
+	case archaius.Bool(joining, "cassandra.rebalance", false):
+		s = tokens(append(r.members(), joining))
+	default:
+		s = r.String() + fmt.Sprintf(",%s:%v", joining, r.bisect())
+	}
+	tell(cass, s)
+	return s
+}
+
+// Decommission a node that leaves a cassandra cluster, and send the new config to the nodes, including the one leaving.
+// The next nodes on the ring take over its ranges, or if cassandra.rebalance is set with one token per node,
+// the nodes that are left move to evenly spaced tokens.
+func Decommission(cass map[string]chan gotocol.Message, config, leaving string) string {
+	var r ByToken
+	for _, n := range RingConfig(config) {
+		if n.name != leaving {
+			r = append(r, n)
+		}
+	}
+	s := r.String()
+	if len(r) > 0 && archaius.Int(leaving, "cassandra.vnodes", 1) <= 1 && archaius.Bool(leaving, "cassandra.rebalance", false) {
+		s = tokens(r.members())
+	}
+	tell(cass, s)
+	return s
+}
+
+// String makes the config of a ring
+func (a ByToken) String() string {
+	s := ""
+	for _, n := range a {
+		s += fmt.Sprintf("%s:%v,", n.name, n.token)
+	}
+	return strings.TrimSuffix(s, ",")
+}
+
+// members of a ring, sorted by name
+func (a ByToken) members() []string {
+	m := make(map[string]bool)
+	var ns []string
+	for _, n := range a {
+		if !m[n.name] {
+			m[n.name] = true
+			ns = append(ns, n.name)
+		}
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// member is true if a node has a token in the ring
+func (a ByToken) member(name string) bool {
+	for _, n := range a {
+		if n.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bisect the largest range in the ring, a node owns the range from its token up to the next one
+func (a ByToken) bisect() uint32 {
+	best, size := 0, uint64(0)
+	for i := range a {
+		next := uint64(a[(i+1)%len(a)].token)
+		if i == len(a)-1 {
+			next += 1 << 32 // wrap round
+		}
+		if d := next - uint64(a[i].token); d > size {
+			best, size = i, d
+		}
+	}
+	return uint32(uint64(a[best].token) + size/2)
+}
+
+// RingConfig gets the tokens for a ring, a name can contain colons so the token follows the last one
+func RingConfig(m string) ByToken {
+	s := strings.Split(m, ",")
+	r := make(ByToken, 0, len(s))
+	for _, n := range s {
+		i := strings.LastIndex(n, ":")
+		if i < 0 {
+			continue
+		}
+		var h uint32
+		fmt.Sscanf(n[i+1:], "%d", &h)
+		r = append(r, node{n[:i], h})
+	}
+	sort.Sort(ByToken(r))
+	return r
+}
@@ -0,0 +1,100 @@
+package priamCassandra
+
+import (
+	"fmt"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/flow"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"sort"
+)
+
+// Change to a new ring, the keys this node holds that have a new replica are streamed to it, by the first of the
+// old replicas that is still in the ring, and by a node that is leaving, which is told Goodbye once it has been sent the ring
+func (c *coordinator) Change(config string) {
+	old := c.ring
+	c.ring = RingConfig(config)
+	if len(old) == 0 {
+		return // the first ring, nothing has moved yet
+	}
+	leaving := !c.ring.member(c.name)
+	rf := c.rf()
+	for _, key := range sorted(c.store) {
+		was := old.Replicas(ringHash(key), rf)
+		if !contains(was, c.name) || !leaving && c.first(was) != c.name {
+			continue // another replica streams it
+		}
+		for _, n := range c.ring.Replicas(ringHash(key), rf) {
+			if !contains(was, n) {
+				if c.streams[n] == nil {
+					c.streams[n] = make(map[string]string)
+				}
+				c.streams[n][key] = c.store[key]
+			}
+		}
+	}
+	for n := range c.streams {
+		if !c.ring.member(n) {
+			delete(c.streams, n) // it left before it could be streamed to
+		}
+	}
+	c.Stream()
+	if leaving {
+		c.streams = make(map[string]map[string]string) // it can't wait for nodes it hasn't found yet
+	}
+}
+
+// first of the replicas of a key that is still in the ring
+func (c *coordinator) first(replicas []string) string {
+	for _, n := range replicas {
+		if c.ring.member(n) {
+			return n
+		}
+	}
+	return ""
+}
+
+// Stream the keys waiting for each node that can be routed to, a node that has just joined waits until it's discovered.
+// Each stream is a trace in the flow, and each key is a span tagged with the progress of the stream.
+func (c *coordinator) Stream() {
+	ns := make([]string, 0, len(c.streams))
+	for n := range c.streams {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	for _, n := range ns {
+		ch := c.router.Named(n)
+		if ch == nil {
+			continue
+		}
+		keys := sorted(c.streams[n])
+		ctx := gotocol.NewTrace()
+		for i, key := range keys {
+			outmsg := gotocol.Message{gotocol.Stream, c.listener, clock.Now(), ctx.NewParent(), fmt.Sprintf("%v %v %v/%v", key, c.streams[n][key], i+1, len(keys))}
+			flow.AnnotateSend(outmsg, c.name)
+			outmsg.GoSend(ch)
+			collect.ServiceCount(c.name, "_streamed")
+		}
+		delete(c.streams, n)
+	}
+}
+
+// contains is true if a node is one of the replicas
+func contains(replicas []string, name string) bool {
+	for _, n := range replicas {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// sorted keys of a map, so streams are repeatable
+func sorted(m map[string]string) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
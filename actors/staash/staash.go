@@ -3,14 +3,19 @@
 package staash
 
 import (
+	"fmt"
 	. "github.com/adrianco/spigo/actors/packagenames"
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/discovery"
 	"github.com/adrianco/spigo/tooling/flow"
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/handlers"
 	"github.com/adrianco/spigo/tooling/names"
+	"github.com/adrianco/spigo/tooling/random"
 	"github.com/adrianco/spigo/tooling/ribbon"
+	"github.com/adrianco/spigo/tooling/usl"
 	"time"
 )
 
@@ -27,15 +32,52 @@ const (
 // Start staash, all configuration and state is sent via messages
 func Start(listener chan gotocol.Message) {
 	microservices := ribbon.MakeRouter()                     // outbound routes
-	var caches, stores, volumes, cass, staash *ribbon.Router // subsets of the router
+	var caches, stores, volumes, cass, staash *ribbon.Router // subsets of the router, kept up to date as it changes
 	dependencies := make(map[string]time.Time)               // dependent service names and time last updated
+	cache := discovery.MakeCache()                           // local copy of the registry entries for the dependencies
 	var parent chan gotocol.Message                          // remember how to talk back to creator
 	requestor := make(map[string]gotocol.Routetype)          // remember where requests came from when responding
 	var name string                                          // remember my name
 	eureka := make(map[string]chan gotocol.Message, 1)       // service registry
+	caches, volumes, stores = microservices.All(CachePkg), microservices.All(VolumePkg), microservices.All(StorePkg)
+	cass, staash = microservices.All(PriamCassandraPkg), microservices.All(StaashPkg)
 	hist := collect.NewHist("")
+	var service *usl.Service // capacity model, nil responds instantly with no limit on workers
 	ep, _ := time.ParseDuration(archaius.Conf.EurekaPoll)
-	eurekaTicker := time.NewTicker(ep)
+	eurekaTicker := gotocol.NewTicker(listener, ep)
+	// tiers a get looks in, in order of the lookup states
+	tiers := []*ribbon.Router{cacheLookup: caches, volumeLookup: volumes, cassandraLookup: cass, storeLookup: stores, staashLookup: staash}
+	// next tier after a state that has any routes, newRequest if there are none left
+	next := func(state int) int {
+		for s := state + 1; s < len(tiers); s++ {
+			if tiers[s].Len() > 0 {
+				return s
+			}
+		}
+		return newRequest
+	}
+	// lookup a request in the next tier, caches are sharded by key
+	lookup := func(r gotocol.Routetype) {
+		r.State = next(r.State)
+		switch r.State {
+		case newRequest:
+			handlers.Respond(gotocol.Message{gotocol.GetResponse, listener, clock.Now(), r.Ctx, ""}, name, r.ResponseChan, service, len(requestor))
+		case cacheLookup:
+			handlers.LookupKey(r, name, listener, &requestor, caches, service)
+		default:
+			handlers.Lookup(r, name, listener, &requestor, tiers[r.State], service)
+		}
+	}
+	// fill the cache a key belongs on with its value
+	fill := func(ctx gotocol.Context, intention string) {
+		var key string
+		fmt.Sscanf(intention, "%s", &key)
+		if _, c := caches.KeyRoute(key); c != nil {
+			outmsg := gotocol.Message{gotocol.Put, listener, clock.Now(), ctx.NewParent(), intention}
+			flow.AnnotateSend(outmsg, name)
+			outmsg.GoSend(c)
+		}
+	}
 	for {
 		select {
 		case msg := <-listener:
@@ -47,121 +89,71 @@ func Start(listener chan gotocol.Message) {
 					parent = msg.ResponseChan // remember how to talk to my namer
 					name = msg.Intention      // message body is my name
 					hist = collect.NewHist(name)
+					r := random.New(name) // my own random stream for routing and service time
+					microservices.SetRand(r)
+					microservices.UseBreakers(name)
+					service = usl.NewService(name, r, listener)
 				}
 			case gotocol.Inform:
 				eureka[msg.Intention] = handlers.Inform(msg, name, listener)
 			case gotocol.NameDrop:
-				handlers.NameDrop(&dependencies, microservices, msg, name, listener, eureka, true) // true to setup cross zone routing
-				caches = microservices.All(CachePkg)
-				volumes = microservices.All(VolumePkg)
-				stores = microservices.All(StorePkg)
-				cass = microservices.All(PriamCassandraPkg)
-				staash = microservices.All(StaashPkg)
+				handlers.NameDrop(&dependencies, cache, microservices, msg, name, listener, eureka, true) // true to setup cross zone routing
+			case gotocol.Fetch:
+				// update buddies with what changed in the service registry
+				handlers.Fetch(&dependencies, cache, microservices, msg, name, listener, eureka, true)
 			case gotocol.Forget:
 				// forget a buddy
 				handlers.Forget(&dependencies, microservices, msg)
-				caches = microservices.All(CachePkg)
-				volumes = microservices.All(VolumePkg)
-				stores = microservices.All(StorePkg)
-				cass = microservices.All(PriamCassandraPkg)
-				staash = microservices.All(StaashPkg)
 			case gotocol.GetRequest:
-				// route the request on to a cache first if configured
-				r := gotocol.PickRoute(requestor, msg)
-				if caches.Len() > 0 {
-					handlers.GetRequest(msg, name, listener, &requestor, caches)
-					r.State = cacheLookup
-				} else {
-					// route to any volumes if configured
-					if volumes.Len() > 0 {
-						handlers.GetRequest(msg, name, listener, &requestor, volumes)
-						r.State = volumeLookup
-					} else {
-						// route to any cassandra if configured
-						if cass.Len() > 0 {
-							handlers.GetRequest(msg, name, listener, &requestor, cass)
-							r.State = cassandraLookup
-						} else {
-							// route to stores if configured
-							if stores.Len() > 0 {
-								handlers.GetRequest(msg, name, listener, &requestor, stores)
-								r.State = storeLookup
-							} else {
-								// route to more staash layers if configured
-								if staash.Len() > 0 {
-									handlers.GetRequest(msg, name, listener, &requestor, staash)
-									r.State = staashLookup
-								}
-							}
-						}
-					}
+				if !service.Admit(msg) {
+					break // queued until a worker is free, or shed
 				}
-				//log.Printf("%v: %v route: %v", name, msg.Context, r)
+				// look in a cache first if configured, then each storage tier in turn
+				r := msg.Route()
+				r.Intention = msg.Intention
+				lookup(r)
 			case gotocol.GetResponse:
 				// return path from a request, resend or send payload back up using saved span context - server send
-				r := gotocol.PickRoute(requestor, msg)
-				if msg.Intention != "" { // we got a value, so pass it back up
-					handlers.GetResponse(msg, name, listener, &requestor)
-				} else {
-					switch r.State {
-					case cacheLookup:
-						if volumes.Len() > 0 {
-							handlers.GetRequest(msg, name, listener, &requestor, volumes)
-							r.State = volumeLookup
-							break
-						}
-						fallthrough // no volumes so look for cassandra
-					case volumeLookup:
-						if cass.Len() > 0 {
-							handlers.GetRequest(msg, name, listener, &requestor, cass)
-							r.State = cassandraLookup
-							break
-						}
-						fallthrough // no cassandra so look for stores
-					case cassandraLookup:
-						if stores.Len() > 0 {
-							handlers.GetRequest(msg, name, listener, &requestor, stores)
-							r.State = storeLookup
-							break
-						}
-						fallthrough // no stores
-					case storeLookup:
-						if staash.Len() > 0 {
-							handlers.GetRequest(msg, name, listener, &requestor, staash)
-							r.State = staashLookup
-							break
-						}
-						fallthrough // no staash
-					case staashLookup:
-						// ran out of options to find anything so pass empty response back up
-						handlers.GetResponse(msg, name, listener, &requestor)
-					case newRequest:
-					default:
+				handlers.Success(msg, &requestor, microservices) // close a half open circuit
+				r, ok := requestor[msg.Ctx.Route()]
+				switch {
+				case !ok: // it already timed out
+				case msg.Intention == "" && next(r.State) != newRequest:
+					// not found, so look in the next tier
+					delete(requestor, msg.Ctx.Route())
+					lookup(r)
+				default:
+					if msg.Intention != "" && r.State > cacheLookup {
+						fill(r.Ctx, r.Intention+" "+msg.Intention) // a cache missed, so it gets the value
 					}
+					// pass the value back up, or an empty response once every tier has been tried
+					handlers.GetResponse(msg, name, listener, &requestor, service)
 				}
+			case gotocol.Timeout:
+				// retry or give up on a request that took too long
+				handlers.Timeout(msg, name, listener, &requestor, microservices, service)
+			case gotocol.Error:
+				// retry or pass back an error from a dependency
+				handlers.Error(msg, name, listener, &requestor, microservices, service)
 			case gotocol.Put:
 				// duplicate the request to any cache, volumes, stores, and cassandra but only to one of each type
 				// storage class packages sideways Replicate if configured
 				// to get a lossy write, configure multiple stores that don't cross replicate
-				handlers.Put(msg, name, listener, &requestor, caches)
+				fill(msg.Ctx, msg.Intention)
 				handlers.Put(msg, name, listener, &requestor, cass)
 				handlers.Put(msg, name, listener, &requestor, staash)
 				handlers.Put(msg, name, listener, &requestor, stores)
 				msg.Intention = names.Instance(name) + "/" + msg.Intention // store to an instance specific volume namespace
 				handlers.Put(msg, name, listener, &requestor, volumes)
 			case gotocol.Goodbye:
-				for _, ch := range eureka { // tell name service I'm not going to be here
-					ch <- gotocol.Message{gotocol.Delete, nil, time.Now(), gotocol.NilContext, name}
-				}
-				gotocol.Message{gotocol.Goodbye, nil, time.Now(), gotocol.NilContext, name}.GoSend(parent)
+				service.Stop()                     // let go of the senders it blocked
+				handlers.Delete(msg, name, eureka) // tell name service I'm not going to be here
+				gotocol.Message{gotocol.Goodbye, nil, clock.Now(), gotocol.NilContext, name}.GoSend(parent)
 				return
 			}
 		case <-eurekaTicker.C: // check to see if any new dependencies have appeared
-			for dep := range dependencies {
-				for _, ch := range eureka {
-					ch <- gotocol.Message{gotocol.GetRequest, listener, time.Now(), gotocol.NilContext, dep}
-				}
-			}
+			handlers.Renew(name, listener, eureka) // keep my lease alive
+			handlers.Poll(dependencies, cache, name, listener, eureka)
 		}
 	}
 }
@@ -5,12 +5,17 @@ package store
 import (
 	"fmt"
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/discovery"
 	"github.com/adrianco/spigo/tooling/flow"
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/handlers"
 	"github.com/adrianco/spigo/tooling/names"
+	"github.com/adrianco/spigo/tooling/random"
 	"github.com/adrianco/spigo/tooling/ribbon"
+	"github.com/adrianco/spigo/tooling/usl"
+	"github.com/adrianco/spigo/tooling/versions"
 	"time"
 )
 
@@ -19,14 +24,16 @@ func Start(listener chan gotocol.Message) {
 	// remember the channel to talk to microservices
 	microservices := ribbon.MakeRouter()
 	dependencies := make(map[string]time.Time) // dependent services and time last updated
-	store := make(map[string]string, 4)        // key value store
+	cache := discovery.MakeCache()             // local copy of the registry entries for the dependencies
+	store := make(map[string]string, 4)        // key value store, values are encoded with their versions
 	store["why?"] = "because..."
 	var netflixoss chan gotocol.Message                                           // remember creator and how to talk back to incoming requests
 	var name string                                                               // remember my name
 	eureka := make(map[string]chan gotocol.Message, len(archaius.Conf.ZoneNames)) // service registry per zone
 	hist := collect.NewHist("")
+	var service *usl.Service // capacity model, nil responds instantly with no limit on workers
 	ep, _ := time.ParseDuration(archaius.Conf.EurekaPoll)
-	eurekaTicker := time.NewTicker(ep)
+	eurekaTicker := gotocol.NewTicker(listener, ep)
 	for {
 		select {
 		case msg := <-listener:
@@ -38,30 +45,42 @@ func Start(listener chan gotocol.Message) {
 					netflixoss = msg.ResponseChan // remember how to talk to my namer
 					name = msg.Intention          // message body is my name
 					hist = collect.NewHist(name)
+					r := random.New(name) // my own random stream for routing and service time
+					microservices.SetRand(r)
+					service = usl.NewService(name, r, listener)
 				}
 			case gotocol.Inform:
 				eureka[msg.Intention] = handlers.Inform(msg, name, listener)
 			case gotocol.NameDrop: // cross zone = true
-				handlers.NameDrop(&dependencies, microservices, msg, name, listener, eureka, true)
+				handlers.NameDrop(&dependencies, cache, microservices, msg, name, listener, eureka, true)
+			case gotocol.Fetch:
+				// update buddies with what changed in the service registry
+				handlers.Fetch(&dependencies, cache, microservices, msg, name, listener, eureka, true)
 			case gotocol.Forget:
 				// forget a buddy
 				handlers.Forget(&dependencies, microservices, msg)
 			case gotocol.GetRequest:
-				// return any stored value for this key
-				outmsg := gotocol.Message{gotocol.GetResponse, listener, time.Now(), msg.Ctx, store[msg.Intention]}
-				flow.AnnotateSend(outmsg, name)
-				outmsg.GoSend(msg.ResponseChan)
+				if !service.Admit(msg) {
+					break // queued until a worker is free, or shed
+				}
+				// return any stored value for this key, checking whether it's older than the latest write to any store node
+				got := versions.Parse(store[msg.Intention])
+				versions.Check(name, versions.Latest(name, msg.Intention), got)
+				handlers.Respond(gotocol.Message{gotocol.GetResponse, listener, clock.Now(), msg.Ctx, got.Data()}, name, msg.ResponseChan, service, 0)
 			case gotocol.GetResponse:
 				// return path from a request, send payload back up (not currently used)
 			case gotocol.Put:
-				// set a key value pair and replicate to other stores
+				// set a new version of a key value pair and replicate to other stores
 				var key, value string
 				fmt.Sscanf(msg.Intention, "%s%s", &key, &value)
 				if key != "" && value != "" {
-					store[key] = value
+					old := versions.Parse(store[key])
+					v := versions.Values{versions.New(name, value, old)}
+					store[key] = versions.Merge(versions.Resolution(name), old, v).String()
+					versions.Committed(name, key, v)
 					// duplicate the request on to all connected store nodes with the same package name as this one
 					for _, n := range microservices.All(names.Package(name)).Names() {
-						outmsg := gotocol.Message{gotocol.Replicate, listener, time.Now(), msg.Ctx.NewParent(), msg.Intention}
+						outmsg := gotocol.Message{gotocol.Replicate, listener, clock.Now(), msg.Ctx.NewParent(), key + " " + v.String()}
 						flow.AnnotateSend(outmsg, name)
 						outmsg.GoSend(microservices.Named(n))
 					}
@@ -73,18 +92,16 @@ func Start(listener chan gotocol.Message) {
 				fmt.Sscanf(msg.Intention, "%s%s", &key, &value)
 				// log.Printf("store: %v:%v", key, value)
 				if key != "" && value != "" {
-					store[key] = value
+					store[key] = versions.Merge(versions.Resolution(name), versions.Parse(store[key]), versions.Parse(value)).String()
 				}
 			case gotocol.Goodbye:
-				gotocol.Message{gotocol.Goodbye, nil, time.Now(), gotocol.NilContext, name}.GoSend(netflixoss)
+				service.Stop() // let go of the senders it blocked
+				gotocol.Message{gotocol.Goodbye, nil, clock.Now(), gotocol.NilContext, name}.GoSend(netflixoss)
 				return
 			}
 		case <-eurekaTicker.C: // check to see if any new dependencies have appeared
-			for dep := range dependencies {
-				for _, ch := range eureka {
-					ch <- gotocol.Message{gotocol.GetRequest, listener, time.Now(), gotocol.NilContext, dep}
-				}
-			}
+			handlers.Renew(name, listener, eureka) // keep my lease alive
+			handlers.Poll(dependencies, cache, name, listener, eureka)
 		}
 	}
 }
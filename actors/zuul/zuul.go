@@ -4,11 +4,15 @@ package zuul
 
 import (
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/discovery"
 	"github.com/adrianco/spigo/tooling/flow"
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/handlers"
+	"github.com/adrianco/spigo/tooling/random"
 	"github.com/adrianco/spigo/tooling/ribbon"
+	"github.com/adrianco/spigo/tooling/usl"
 	"time"
 )
 
@@ -16,13 +20,15 @@ import (
 func Start(listener chan gotocol.Message) {
 	microservices := ribbon.MakeRouter()
 	dependencies := make(map[string]time.Time)         // dependent services and time last updated
+	cache := discovery.MakeCache()                     // local copy of the registry entries for the dependencies
 	var parent chan gotocol.Message                    // remember how to talk back to creator
 	requestor := make(map[string]gotocol.Routetype)    // remember where requests came from when responding
 	var name string                                    // remember my name
 	eureka := make(map[string]chan gotocol.Message, 1) // service registry
 	hist := collect.NewHist("")
+	var service *usl.Service // capacity model, nil responds instantly with no limit on workers
 	ep, _ := time.ParseDuration(archaius.Conf.EurekaPoll)
-	eurekaTicker := time.NewTicker(ep)
+	eurekaTicker := gotocol.NewTicker(listener, ep)
 	for {
 		select {
 		case msg := <-listener:
@@ -34,36 +40,49 @@ func Start(listener chan gotocol.Message) {
 					parent = msg.ResponseChan // remember how to talk to my namer
 					name = msg.Intention      // message body is my name
 					hist = collect.NewHist(name)
+					r := random.New(name) // my own random stream for routing and service time
+					microservices.SetRand(r)
+					microservices.UseBreakers(name)
+					service = usl.NewService(name, r, listener)
 				}
 			case gotocol.Inform:
 				eureka[msg.Intention] = handlers.Inform(msg, name, listener)
 			case gotocol.NameDrop:
-				handlers.NameDrop(&dependencies, microservices, msg, name, listener, eureka)
+				handlers.NameDrop(&dependencies, cache, microservices, msg, name, listener, eureka)
+			case gotocol.Fetch:
+				// update buddies with what changed in the service registry
+				handlers.Fetch(&dependencies, cache, microservices, msg, name, listener, eureka)
 			case gotocol.Forget:
 				// forget a buddy
 				handlers.Forget(&dependencies, microservices, msg)
 			case gotocol.GetRequest:
+				if !service.Admit(msg) {
+					break // queued until a worker is free, or shed
+				}
 				// route the request on to microservices
-				handlers.GetRequest(msg, name, listener, &requestor, microservices)
+				handlers.GetRequest(msg, name, listener, &requestor, microservices, service)
 			case gotocol.GetResponse:
 				// return path from a request, send payload back up using saved span context - server send
-				handlers.GetResponse(msg, name, listener, &requestor)
+				handlers.Success(msg, &requestor, microservices) // close a half open circuit
+				handlers.GetResponse(msg, name, listener, &requestor, service)
+			case gotocol.Timeout:
+				// retry or give up on a request that took too long
+				handlers.Timeout(msg, name, listener, &requestor, microservices, service)
+			case gotocol.Error:
+				// retry or pass back an error from a dependency
+				handlers.Error(msg, name, listener, &requestor, microservices, service)
 			case gotocol.Put:
 				// route the request on to a random dependency
 				handlers.Put(msg, name, listener, &requestor, microservices)
 			case gotocol.Goodbye:
-				for _, ch := range eureka { // tell name service I'm not going to be here
-					ch <- gotocol.Message{gotocol.Delete, nil, time.Now(), gotocol.NilContext, name}
-				}
-				gotocol.Message{gotocol.Goodbye, nil, time.Now(), gotocol.NilContext, name}.GoSend(parent)
+				service.Stop()                     // let go of the senders it blocked
+				handlers.Delete(msg, name, eureka) // tell name service I'm not going to be here
+				gotocol.Message{gotocol.Goodbye, nil, clock.Now(), gotocol.NilContext, name}.GoSend(parent)
 				return
 			}
 		case <-eurekaTicker.C: // check to see if any new dependencies have appeared
-			for dep := range dependencies {
-				for _, ch := range eureka {
-					ch <- gotocol.Message{gotocol.GetRequest, listener, time.Now(), gotocol.NilContext, dep}
-				}
-			}
+			handlers.Renew(name, listener, eureka) // keep my lease alive
+			handlers.Poll(dependencies, cache, name, listener, eureka)
 		}
 	}
 }
@@ -19,11 +19,12 @@ import (
 	"github.com/adrianco/spigo/tooling/flow"         // flow logging
 	"github.com/adrianco/spigo/tooling/fsm"          // fsm and pirates
 	"github.com/adrianco/spigo/tooling/gotocol"      // message protocol spec
+	"github.com/adrianco/spigo/tooling/latency"      // network latency model
 	"github.com/adrianco/spigo/tooling/migration"    // migration from LAMP to netflixoss
 )
 
 var addrs string
-var reload, graphmlEnabled, graphjsonEnabled, neo4jEnabled bool
+var reload, graphmlEnabled, graphjsonEnabled, neo4jEnabled, latencyEnabled bool
 var duration, cpucount int
 
 // main handles command line flags and starts up an architecture
@@ -41,8 +42,13 @@ func main() {
 	flag.StringVar(&addrs, "k", "", "Send Zipkin spans to Kafka if Collect is enabled. Provide list of comma separated host:port addresses")
 	flag.IntVar(&archaius.Conf.StopStep, "s", 0, "Sequence number to create multiple runs for ui to step through in json/<arch><s>.json")
 	flag.StringVar(&archaius.Conf.EurekaPoll, "u", "1s", "Polling interval for Eureka name service, increase for large populations")
-	flag.StringVar(&archaius.Conf.Keyvals, "kv", "", "Configuration key:value - chat:10ms sets default message insert rate")
+	flag.Var(archaius.KvFlag{}, "kv", "Configuration property key=value, repeat for more - chat=10ms sets default message insert rate, karyon.homepage.timeout=50ms overrides a service")
 	flag.BoolVar(&archaius.Conf.Filter, "f", false, "Filter output names to simplify graph by collapsing instances to services")
+	flag.BoolVar(&archaius.Conf.VirtualTime, "vt", false, "Run on a deterministic virtual clock, repeatable and as fast as possible, rather than the wall clock")
+	flag.BoolVar(&latencyEnabled, "l", false, "Enable the default network latency model between zones and regions, the config file can set each tier")
+	flag.StringVar(&archaius.Conf.Workload, "wl", "", "Workload profile from json_arch/workloads.json applied by the root services, mix, key popularity and rate curve")
+	flag.StringVar(&archaius.Conf.Chaos, "chaos", "", "Chaos experiment from json_arch/<chaos>_chaos.json, a timeline of kills, zone and region outages and pauses, instead of one kill of the victim")
+	flag.Int64Var(&archaius.Conf.Seed, "seed", 1, "Seed for the per-service random number streams, change it to see the spread of results")
 	flag.IntVar(&cpucount, "cpus", runtime.NumCPU(), "Number of CPUs for Go runtime")
 	runtime.GOMAXPROCS(cpucount)
 	var cpuprofile = flag.String("cpuprofile", "", "Write cpu profile to file")
@@ -60,6 +66,9 @@ func main() {
 	if *confFile != "" {
 		archaius.ReadConf(*confFile)
 	}
+	if latencyEnabled && len(archaius.Conf.Latency) == 0 {
+		archaius.Conf.Latency = latency.Default
+	}
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
@@ -7,7 +7,6 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"strings"
 	"time"
 )
 
@@ -64,8 +63,141 @@ type Configuration struct {
 	// Filter spec for output names to simplify graph
 	Filter bool `json:"filter"`
 
-	// Keys and values for configuring services, passed in as one string
+	// Keyvals are comma separated key=value properties, as passed in with repeated -kv flags, they override Properties
 	Keyvals string `json:"keyvals"`
+
+	// Properties for configuring services, see Property
+	Properties map[string]string `json:"properties"`
+
+	// VirtualTime runs the simulation on a deterministic virtual clock rather than the wall clock
+	VirtualTime bool `json:"virtualtime"`
+
+	// Seed for the random number streams, each actor derives its own stream from the seed and its name
+	Seed int64 `json:"seed"`
+
+	// Latency models the network for each tier of the topology, zone, crosszone, crossregion and global
+	// messages are delivered instantly if it's empty
+	Latency map[string]Link `json:"latency"`
+
+	// Capacity models the service time of each service or package, services respond instantly if they aren't listed
+	Capacity map[string]Capacity `json:"capacity"`
+
+	// Clients sets how callers time out and retry requests to each service or package
+	Clients map[string]Client `json:"clients"`
+
+	// Rules sets the load balancing rule each service or package uses to pick instances of its dependencies, random if it isn't listed
+	Rules map[string]string `json:"rules"`
+
+	// Scaling sets up an auto scaling group for each service or package, services keep the count they were created with if they aren't listed
+	Scaling map[string]Scaling `json:"scaling"`
+
+	// Chaos names the experiment in json_arch/<chaos>_chaos.json that chaosmonkey runs, empty kills one instance of the victim half way through
+	Chaos string `json:"chaos"`
+
+	// Workload names the profile in json_arch/workloads.json that root services apply, empty sends an even mix at the chat rate
+	Workload string `json:"workload"`
+}
+
+// Client sets how callers treat requests to a service
+type Client struct {
+	// Timeout is how long to wait for a response, empty waits forever
+	Timeout string `json:"timeout" property:"duration"`
+
+	// Retries is how many times to send the request again after a timeout
+	Retries int `json:"retries"`
+
+	// Backoff is the wait before the first retry, doubling for each retry after that
+	Backoff string `json:"backoff" property:"duration"`
+
+	// Threshold is the percentage of failures and timeouts on a route that opens its circuit breaker, 0 has no breaker
+	Threshold float64 `json:"threshold"`
+
+	// Volume is how many requests a route must see in a window before its circuit can open
+	Volume int `json:"volume"`
+
+	// SleepWindow is how long an open circuit waits before letting a trial request through, also the window counts are kept over
+	SleepWindow string `json:"sleepwindow" property:"duration"`
+
+	// Fallback is the value served when the circuit is open, empty fails fast with a timeout
+	Fallback string `json:"fallback"`
+}
+
+// Link models the network between two services for one tier of the topology
+type Link struct {
+	// Distribution of the delay around the mean, fixed, uniform or exponential
+	Distribution string `json:"distribution"`
+
+	// Mean one way delay as a duration such as 1ms
+	Mean string `json:"mean" property:"duration"`
+
+	// Jitter adds up to this much extra delay, uniformly distributed
+	Jitter string `json:"jitter" property:"duration"`
+
+	// Loss is the probability that a message is dropped on the way
+	Loss float64 `json:"loss"`
+}
+
+// Capacity models how long a service takes to respond, and how that grows with concurrency
+type Capacity struct {
+	// Distribution of the service time around the mean, fixed, uniform or exponential
+	Distribution string `json:"distribution"`
+
+	// ServiceTime is the mean time to serve one request when nothing else is in progress
+	ServiceTime string `json:"servicetime" property:"duration"`
+
+	// Sigma is the Universal Scalability Law contention, the proportion of work that is serialized
+	Sigma float64 `json:"sigma"`
+
+	// Kappa is the Universal Scalability Law crosstalk, the coherency cost between concurrent requests
+	Kappa float64 `json:"kappa"`
+
+	// Workers limits how many requests are handled at once, 0 means no limit
+	Workers int `json:"workers"`
+
+	// Queue is how many requests can wait for a worker
+	Queue int `json:"queue"`
+
+	// Policy when the queue is full, reject the new request, drop-oldest from the queue, or block the sender
+	Policy string `json:"policy"`
+}
+
+// Scaling sets the size of a service's auto scaling group in each region, and the policies that resize it while running
+type Scaling struct {
+	// Min is the fewest instances the group shrinks to, defaults to 1
+	Min int `json:"min"`
+
+	// Max is the most instances the group grows to, defaults to the count the service was created with
+	Max int `json:"max"`
+
+	// Desired is how many instances to run, defaults to the count, setting it while running resizes the group
+	Desired int `json:"desired"`
+
+	// LaunchDelay is how long a new instance takes to boot before it starts and registers with eureka
+	LaunchDelay string `json:"launchdelay" property:"duration"`
+
+	// Cooldown is how long to wait after scaling before the policies are looked at again, defaults to the launch delay
+	Cooldown string `json:"cooldown" property:"duration"`
+
+	// Policies that scale the group out and in, driven by collected metrics, so -c is needed
+	Policies []Policy `json:"policies"`
+}
+
+// Policy scales a group by a step when a metric crosses a threshold
+type Policy struct {
+	// Metric is rate in responses per second per instance, queue depth per instance, or response time in milliseconds
+	Metric string `json:"metric"`
+
+	// Percentile of the response time seen by the root services, defaults to 99
+	Percentile float64 `json:"percentile"`
+
+	// Above this value the group scales out, 0 never scales out
+	Above float64 `json:"above"`
+
+	// Below this value the group scales in, 0 never scales in
+	Below float64 `json:"below"`
+
+	// Adjust is how many instances to add or remove at a time, defaults to 1
+	Adjust int `json:"adjust"`
 }
 
 // Conf data instance
@@ -84,6 +216,7 @@ var Conf = Configuration{
 
 func init() {
 	verifyConfig()
+	Load()
 }
 
 // verify the sizes of arrays above are equal at runtime
@@ -98,18 +231,6 @@ func verifyConfig() {
 	}
 }
 
-// Key finds a value given a key
-func Key(c Configuration, k string) string {
-	if c.Keyvals == "" {
-		return ""
-	}
-	kv := strings.Split(c.Keyvals, ":")
-	if len(kv) == 2 && kv[0] == k {
-		return kv[1]
-	}
-	return ""
-}
-
 // ReadConf parses json from a file
 func ReadConf(config string) {
 	fn := "json_arch/" + config + "_conf.json"
@@ -143,9 +264,10 @@ func AsJson() []byte {
 // FromJson imports a config from json
 func FromJson(confJSON []byte) {
 	json.Unmarshal(confJSON, &Conf)
+	Load()
 }
 
 // return formatted as string
 func (Configuration) String() string {
-	return fmt.Sprintf("Arch:       %v\nGraphML:    %v\nGraphJSON:  %v\nNeo4jURL:   %v\nRunDuration:%v\nDunbar:     %v\nPopulation: %v\nMsglog:     %v\nRegions:    %v\nRegionNames:%v\nZoneNames:  %v\nIPRanges:   %v\nCollect:    %v\nKafka:      %v\nStopStep:   %v\nEurekaPoll: %v\nKeyvals:    %v\n", Conf.Arch, Conf.GraphmlFile, Conf.GraphjsonFile, Conf.Neo4jURL, Conf.RunDuration, Conf.Dunbar, Conf.Population, Conf.Msglog, Conf.Regions, Conf.RegionNames, Conf.ZoneNames, Conf.IPRanges, Conf.Collect, Conf.Kafka, Conf.StopStep, Conf.EurekaPoll, Conf.Keyvals)
+	return fmt.Sprintf("Arch:       %v\nGraphML:    %v\nGraphJSON:  %v\nNeo4jURL:   %v\nRunDuration:%v\nDunbar:     %v\nPopulation: %v\nMsglog:     %v\nRegions:    %v\nRegionNames:%v\nZoneNames:  %v\nIPRanges:   %v\nCollect:    %v\nKafka:      %v\nStopStep:   %v\nEurekaPoll: %v\nKeyvals:    %v\nProperties: %v\nVirtualTime:%v\nSeed:       %v\nLatency:    %v\nCapacity:   %v\nClients:    %v\nRules:      %v\nScaling:    %v\nWorkload:   %v\nChaos:      %v\n", Conf.Arch, Conf.GraphmlFile, Conf.GraphjsonFile, Conf.Neo4jURL, Conf.RunDuration, Conf.Dunbar, Conf.Population, Conf.Msglog, Conf.Regions, Conf.RegionNames, Conf.ZoneNames, Conf.IPRanges, Conf.Collect, Conf.Kafka, Conf.StopStep, Conf.EurekaPoll, Conf.Keyvals, Conf.Properties, Conf.VirtualTime, Conf.Seed, Conf.Latency, Conf.Capacity, Conf.Clients, Conf.Rules, Conf.Scaling, Conf.Workload, Conf.Chaos)
 }
@@ -3,6 +3,7 @@ package archaius
 
 import (
 	"fmt"
+	"os"
 	"testing"
 	"time"
 )
@@ -25,5 +26,77 @@ func TestConf(t *testing.T) {
 	fmt.Println(string(AsJson()))
 	FromJson(AsJson())
 	fmt.Println(Conf)
-	fmt.Println("chat = " + Key(Conf, "chat"))
+	fmt.Println("chat = " + Key("", "chat"))
+	if Key("", "chat") != "0.01s" {
+		t.Fatal("chat key:value not found")
+	}
+}
+
+func TestProperties(t *testing.T) {
+	defer func(kv string, p map[string]string) { Conf.Keyvals, Conf.Properties = kv, p; Load() }(Conf.Keyvals, Conf.Properties)
+	Conf.Keyvals = ""
+	Conf.Properties = map[string]string{"timeout": "1s", "karyon.timeout": "2s", "homepage.timeout": "3s", "retries": "2", "threshold": "50"}
+	os.Setenv("SPIGO_KARYON_HOMEPAGE_RETRIES", "4")
+	defer os.Unsetenv("SPIGO_KARYON_HOMEPAGE_RETRIES")
+	Load()
+	var f KvFlag
+	f.Set("karyon.homepage.timeout=4s")
+	f.Set("chat:5ms")
+	if err := f.Set("nothing"); err == nil {
+		t.Fatal("bad flag accepted")
+	}
+	home := "arch.us-east-1.zoneA.ecs.docker:0.homepage:1.node:100.homepage.karyon"
+	other := "arch.us-east-1.zoneA.ecs.docker:0.login:1.node:100.login.karyon"
+	for _, c := range []struct {
+		name string
+		want time.Duration
+	}{
+		{home, 4 * time.Second},
+		{"homepage", 3 * time.Second},
+		{other, 2 * time.Second},
+		{"", time.Second},
+	} {
+		if d := Duration(c.name, "timeout", 0); d != c.want {
+			t.Fatalf("timeout for %v is %v, want %v", c.name, d, c.want)
+		}
+	}
+	if Duration("", "chat", 0) != 5*time.Millisecond || Int(home, "retries", 0) != 4 || Int(other, "retries", 0) != 2 || Float(home, "sigma", 0.5) != 0.5 || Bool("", "missing", true) != true {
+		t.Fatal("typed lookups failed")
+	}
+	Conf.Clients = map[string]Client{"karyon": {Timeout: "10s", Volume: 20}}
+	defer func() { Conf.Clients = nil }()
+	c, ok := ClientFor(home)
+	if !ok || c.Timeout != "4s" || c.Retries != 4 || c.Volume != 20 || c.Threshold != 50 {
+		t.Fatalf("client for %v: %+v", home, c)
+	}
+	Set("homepage.volume", "30") // the cached client is resolved again once a property changes
+	if c, _ := ClientFor(home); c.Volume != 30 || c.Timeout != "4s" {
+		t.Fatalf("client for %v after a change: %+v", home, c)
+	}
+	// a value that can't be read as the type of its key is refused, and the old value kept
+	if Set("karyon.homepage.timeout", "abc") == nil || Set("homepage.volume", "many") == nil || Key(home, "timeout") != "4s" {
+		t.Fatal("bad client values were set")
+	}
+	Duration(home, "eureka.lease", time.Second)
+	if Set("eureka.lease", "abc") == nil || Set("eureka.lease", "2s") != nil || Duration(home, "eureka.lease", time.Second) != 2*time.Second {
+		t.Fatal("bad duration was set")
+	}
+	Conf.Scaling = map[string]Scaling{"homepage": {Min: 2, Max: 10, Policies: []Policy{{Metric: "queue", Above: 5}}}}
+	defer func() { Conf.Scaling = nil }()
+	Conf.Properties["homepage.asg.desired"] = "6"
+	Load()
+	s, ok := ScalingFor(home)
+	if !ok || s.Min != 2 || s.Max != 10 || s.Desired != 6 || len(s.Policies) != 1 {
+		t.Fatalf("scaling for %v: %+v", home, s)
+	}
+	if _, ok := ScalingFor(other); ok {
+		t.Fatal("login shouldn't scale")
+	}
+	Conf.Rules = map[string]string{"karyon": "p2c", "login": "roundrobin"}
+	defer func() { Conf.Rules = nil }()
+	Conf.Properties["homepage.ribbon.rule"] = "zoneaffinity"
+	Load()
+	if RuleFor(home) != "zoneaffinity" || RuleFor(other) != "roundrobin" || RuleFor("karyon") != "p2c" || RuleFor("") != "" {
+		t.Fatalf("rules %v %v", RuleFor(home), RuleFor(other))
+	}
 }
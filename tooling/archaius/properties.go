@@ -0,0 +1,405 @@
+package archaius
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Properties are typed, hierarchical key/value settings, a key can be overridden for a package, a service,
+// or a service in a package, so karyon.homepage.timeout beats homepage.timeout beats karyon.timeout beats timeout.
+// They're read from the properties in the _conf.json, then SPIGO_ environment variables, then the -kv flags,
+// later sources override earlier ones, and changes Set while the simulation runs override them all. Keys aren't case sensitive.
+
+// EnvPrefix marks environment variables that set properties, SPIGO_HOMEPAGE_TIMEOUT=50ms sets homepage.timeout
+const EnvPrefix = "SPIGO_"
+
+var props struct {
+	sync.RWMutex
+	values   map[string]string         // loaded from the config, environment and flags
+	dynamic  map[string]string         // set while running
+	watchers []func(key, value string) // told about each change
+	version  int                       // counts changes, so cached settings know when to look again
+	kinds    map[string]string         // the type each key is read as, so a value Set while running can be checked
+}
+
+// Change to a property at a time after the simulation starts running
+type Change struct {
+	At    string `json:"at"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Load rebuilds the properties from the config, the environment and the -kv flags
+func Load() {
+	values := make(map[string]string)
+	for k, v := range Conf.Properties {
+		values[strings.ToLower(k)] = v
+	}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, EnvPrefix) {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(e, EnvPrefix), "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			values[strings.ToLower(strings.Replace(kv[0], "_", ".", -1))] = kv[1]
+		}
+	}
+	for _, p := range strings.Split(Conf.Keyvals, ",") {
+		if k, v, ok := pair(p); ok {
+			values[strings.ToLower(k)] = v
+		}
+	}
+	props.Lock()
+	props.values = values
+	props.version++
+	props.Unlock()
+}
+
+// Set a property while the simulation is running, and tell the watchers. A value that can't be read as the type
+// of its key is an error and the old value is kept, so a bad change can't stop the simulation
+func Set(key, value string) error {
+	key = strings.ToLower(key)
+	if err := valid(key, value); err != nil {
+		log.Printf("archaius: %v\n", err)
+		return err
+	}
+	props.Lock()
+	if props.dynamic == nil {
+		props.dynamic = make(map[string]string)
+	}
+	props.dynamic[key] = value
+	props.version++
+	watchers := props.watchers
+	props.Unlock()
+	log.Printf("archaius: %v=%v\n", key, value)
+	for _, w := range watchers {
+		w(key, value)
+	}
+	return nil
+}
+
+// kind records the type a key is read as, the first time it's read
+func kind(key, k string) {
+	key = strings.ToLower(key)
+	props.RLock()
+	_, ok := props.kinds[key]
+	props.RUnlock()
+	if ok {
+		return
+	}
+	props.Lock()
+	if props.kinds == nil {
+		props.kinds = make(map[string]string)
+	}
+	props.kinds[key] = k
+	props.Unlock()
+}
+
+// valid checks a value can be read as the type of its key, the longest key that has been read that it ends with,
+// as homepage.timeout and karyon.homepage.timeout are read as timeout. Keys that haven't been read yet can be anything
+func valid(key, value string) error {
+	props.RLock()
+	k, read := "", ""
+	for r, rk := range props.kinds {
+		if (key == r || strings.HasSuffix(key, "."+r)) && len(r) > len(read) {
+			k, read = rk, r
+		}
+	}
+	props.RUnlock()
+	var err error
+	switch k {
+	case "int":
+		_, err = strconv.Atoi(value)
+	case "float":
+		_, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	case "duration":
+		_, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return fmt.Errorf("%v=%v isn't a valid %v", key, value, k)
+	}
+	return nil
+}
+
+// Watch for properties that are Set while running
+func Watch(w func(key, value string)) {
+	props.Lock()
+	props.watchers = append(props.watchers, w)
+	props.Unlock()
+}
+
+// Version counts the changes to properties
+func Version() int {
+	props.RLock()
+	defer props.RUnlock()
+	return props.version
+}
+
+// Properties that are set, from every source
+func Properties() map[string]string {
+	props.RLock()
+	defer props.RUnlock()
+	all := make(map[string]string, len(props.values)+len(props.dynamic))
+	for k, v := range props.values {
+		all[k] = v
+	}
+	for k, v := range props.dynamic {
+		all[k] = v
+	}
+	return all
+}
+
+// pair splits key=value or the older key:value
+func pair(p string) (k, v string, ok bool) {
+	p = strings.TrimSpace(p)
+	i := strings.IndexAny(p, "=:")
+	if i <= 0 {
+		return "", "", false
+	}
+	return p[:i], p[i+1:], true
+}
+
+// KvFlag collects repeated -kv flags into Conf.Keyvals
+type KvFlag struct{}
+
+// String of the flags seen so far
+func (KvFlag) String() string {
+	return Conf.Keyvals
+}
+
+// Set adds a key=value or key:value flag
+func (KvFlag) Set(p string) error {
+	if _, _, ok := pair(p); !ok {
+		return fmt.Errorf("expected key=value, got %q", p)
+	}
+	if Conf.Keyvals != "" {
+		Conf.Keyvals += ","
+	}
+	Conf.Keyvals += p
+	Load()
+	return nil
+}
+
+// hierarchy of a name, its service and package, using the offsets of the names package
+// a name without dots is taken to be a service name
+func hierarchy(name string) (service, pkg string) {
+	s := strings.Split(name, ".")
+	switch {
+	case len(s) == 1:
+		return name, ""
+	case len(s) > 8:
+		return s[7], s[8]
+	case len(s) > 7:
+		return s[7], ""
+	}
+	return "", ""
+}
+
+// Property finds the most specific value of a property for a named service instance, an empty name looks up the default
+func Property(name, key string) (string, bool) {
+	service, pkg := hierarchy(name)
+	var keys []string
+	if service != "" && pkg != "" {
+		keys = append(keys, pkg+"."+service+"."+key)
+	}
+	if service != "" {
+		keys = append(keys, service+"."+key)
+	}
+	if pkg != "" {
+		keys = append(keys, pkg+"."+key)
+	}
+	keys = append(keys, key)
+	props.RLock()
+	defer props.RUnlock()
+	for _, k := range keys {
+		k = strings.ToLower(k)
+		if v, ok := props.dynamic[k]; ok {
+			return v, true
+		}
+		if v, ok := props.values[k]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Key finds the value of a property for a named service instance, empty if it isn't set
+func Key(name, key string) string {
+	v, _ := Property(name, key)
+	return v
+}
+
+// String property, or the default
+func String(name, key, def string) string {
+	if v, ok := Property(name, key); ok {
+		return v
+	}
+	return def
+}
+
+// Int property, or the default
+func Int(name, key string, def int) int {
+	kind(key, "int")
+	if v, ok := Property(name, key); ok {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("archaius: %v %v: %v\n", name, key, err)
+		}
+		return i
+	}
+	return def
+}
+
+// Float property, or the default
+func Float(name, key string, def float64) float64 {
+	kind(key, "float")
+	if v, ok := Property(name, key); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("archaius: %v %v: %v\n", name, key, err)
+		}
+		return f
+	}
+	return def
+}
+
+// Bool property, or the default
+func Bool(name, key string, def bool) bool {
+	kind(key, "bool")
+	if v, ok := Property(name, key); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			log.Fatalf("archaius: %v %v: %v\n", name, key, err)
+		}
+		return b
+	}
+	return def
+}
+
+// Duration property, or the default
+func Duration(name, key string, def time.Duration) time.Duration {
+	kind(key, "duration")
+	if v, ok := Property(name, key); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("archaius: %v %v: %v\n", name, key, err)
+		}
+		return d
+	}
+	return def
+}
+
+// clients resolved by service and package, as they are looked up on every request. They're resolved again once
+// the properties change, or Conf.Clients is replaced
+var clients struct {
+	sync.Mutex
+	version  int
+	conf     uintptr // Conf.Clients they were resolved from
+	resolved map[string]resolvedClient
+}
+
+type resolvedClient struct {
+	client Client
+	ok     bool
+}
+
+// ClientFor a named service, by service then package from Conf.Clients, with any properties overriding its fields
+func ClientFor(name string) (Client, bool) {
+	service, pkg := hierarchy(name)
+	v, conf := Version(), reflect.ValueOf(Conf.Clients).Pointer()
+	clients.Lock()
+	defer clients.Unlock()
+	if clients.resolved == nil || clients.version != v || clients.conf != conf {
+		clients.resolved = make(map[string]resolvedClient)
+		clients.version, clients.conf = v, conf
+	}
+	key := service + " " + pkg
+	if r, ok := clients.resolved[key]; ok {
+		return r.client, r.ok
+	}
+	c, ok := Conf.Clients[service]
+	if !ok {
+		c, ok = Conf.Clients[pkg]
+	}
+	ok = override(name, "", &c) || ok
+	clients.resolved[key] = resolvedClient{c, ok}
+	return c, ok
+}
+
+// RuleFor a named service, the load balancing rule it uses from Conf.Rules by service then package, overridden by the ribbon.rule property
+func RuleFor(name string) string {
+	if v, ok := Property(name, "ribbon.rule"); ok {
+		return v
+	}
+	service, pkg := hierarchy(name)
+	if r, ok := Conf.Rules[service]; ok {
+		return r
+	}
+	return Conf.Rules[pkg]
+}
+
+// CapacityFor a named service, by service then package from Conf.Capacity, with any properties overriding its fields
+func CapacityFor(name string) (Capacity, bool) {
+	service, pkg := hierarchy(name)
+	c, ok := Conf.Capacity[service]
+	if !ok {
+		c, ok = Conf.Capacity[pkg]
+	}
+	return c, override(name, "", &c) || ok
+}
+
+// ScalingFor a named service, by service then package from Conf.Scaling, with properties such as homepage.asg.desired overriding its fields
+func ScalingFor(name string) (Scaling, bool) {
+	service, pkg := hierarchy(name)
+	s, ok := Conf.Scaling[service]
+	if !ok {
+		s, ok = Conf.Scaling[pkg]
+	}
+	return s, override(name, "asg.", &s) || ok
+}
+
+// LinkFor a tier of the network from Conf.Latency, with properties such as latency.zone.mean overriding its fields
+func LinkFor(tier string) (Link, bool) {
+	l, ok := Conf.Latency[tier]
+	return l, override("", "latency."+tier+".", &l) || ok
+}
+
+// override the fields of a struct with properties named by their json tags after a prefix, true if any were set
+func override(name, prefix string, s interface{}) bool {
+	found := false
+	v := reflect.ValueOf(s).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := prefix + v.Type().Field(i).Tag.Get("json")
+		f := v.Field(i)
+		switch {
+		case f.Kind() == reflect.Int:
+			kind(key, "int")
+		case f.Kind() == reflect.Float64:
+			kind(key, "float")
+		case v.Type().Field(i).Tag.Get("property") == "duration":
+			kind(key, "duration") // a string the caller parses
+		}
+		p, ok := Property(name, key)
+		if !ok {
+			continue
+		}
+		found = true
+		switch f.Kind() {
+		case reflect.String:
+			f.SetString(p)
+		case reflect.Int:
+			f.SetInt(int64(Int(name, key, 0)))
+		case reflect.Float64:
+			f.SetFloat(Float(name, key, 0))
+		}
+	}
+	return found
+}
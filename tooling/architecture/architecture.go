@@ -8,6 +8,7 @@ import (
 	"github.com/adrianco/spigo/actors/packagenames" // name definitions
 	"github.com/adrianco/spigo/tooling/archaius"    // global configuration
 	"github.com/adrianco/spigo/tooling/asgard"      // tools to create an architecture
+	"github.com/adrianco/spigo/tooling/ribbon"      // load balancing rules
 	"io/ioutil"
 	"log"
 	"os"
@@ -15,13 +16,14 @@ import (
 )
 
 type archV0r1 struct {
-	Arch        string          `json:"arch"`
-	Version     string          `json:"version"`
-	Description string          `json:"description,omitempty"`
-	Args        string          `json:"args,omitempty"`
-	Date        string          `json:"date,omitempty"`
-	Victim      string          `json:"victim,omitempty"`
-	Services    []containerV0r0 `json:"services"`
+	Arch        string            `json:"arch"`
+	Version     string            `json:"version"`
+	Description string            `json:"description,omitempty"`
+	Args        string            `json:"args,omitempty"`
+	Date        string            `json:"date,omitempty"`
+	Victim      string            `json:"victim,omitempty"`
+	Config      []archaius.Change `json:"config,omitempty"` // property changes to make while running
+	Services    []containerV0r0   `json:"services"`
 }
 
 type serviceV0r0 struct {
@@ -33,15 +35,19 @@ type serviceV0r0 struct {
 }
 
 type containerV0r0 struct {
-	Name         string   `json:"name"`
-	Machine      string   `json:"machine,omitempty"`
-	Instance     string   `json:"instance,omitempty"`
-	Container    string   `json:"container,omitempty"`
-	Process      string   `json:"process,omitempty"`
-	Gopackage    string   `json:"package"`
-	Regions      int      `json:"regions,omitempty"`
-	Count        int      `json:"count"`
-	Dependencies []string `json:"dependencies"`
+	Name         string             `json:"name"`
+	Machine      string             `json:"machine,omitempty"`
+	Instance     string             `json:"instance,omitempty"`
+	Container    string             `json:"container,omitempty"`
+	Process      string             `json:"process,omitempty"`
+	Gopackage    string             `json:"package"`
+	Regions      int                `json:"regions,omitempty"`
+	Count        int                `json:"count"`
+	Dependencies []string           `json:"dependencies"`
+	Capacity     *archaius.Capacity `json:"capacity,omitempty"` // service time and scalability, nil responds instantly
+	Client       *archaius.Client   `json:"client,omitempty"`   // how callers time out and retry, nil waits forever
+	Scaling      *archaius.Scaling  `json:"scaling,omitempty"`  // auto scaling group, nil keeps the count
+	Rule         string             `json:"rule,omitempty"`     // load balancing rule for its dependencies, empty picks at random
 }
 
 // Start architecture
@@ -55,10 +61,37 @@ func Start(a *archV0r1) {
 	asgard.CreateChannels()
 	asgard.CreateEureka() // service registries for each zone
 
+	for _, s := range a.Services {
+		if s.Capacity != nil {
+			if archaius.Conf.Capacity == nil {
+				archaius.Conf.Capacity = make(map[string]archaius.Capacity)
+			}
+			archaius.Conf.Capacity[s.Name] = *s.Capacity // actors look up their own capacity model by service name
+		}
+		if s.Client != nil {
+			if archaius.Conf.Clients == nil {
+				archaius.Conf.Clients = make(map[string]archaius.Client)
+			}
+			archaius.Conf.Clients[s.Name] = *s.Client // callers look up timeouts by the name of the service they call
+		}
+		if s.Scaling != nil {
+			if archaius.Conf.Scaling == nil {
+				archaius.Conf.Scaling = make(map[string]archaius.Scaling)
+			}
+			archaius.Conf.Scaling[s.Name] = *s.Scaling // asgard makes a scaling group for the service
+		}
+		if s.Rule != "" {
+			if archaius.Conf.Rules == nil {
+				archaius.Conf.Rules = make(map[string]string)
+			}
+			archaius.Conf.Rules[s.Name] = s.Rule // its router picks instances of its dependencies with the rule
+		}
+	}
 	for _, s := range a.Services {
 		log.Printf("Starting: %v\n", s)
 		r = asgard.Create(s.Name, s.Gopackage, s.Regions*archaius.Conf.Regions, s.Count*archaius.Conf.Population/100, s.Dependencies...)
 	}
+	asgard.Script(a.Config)
 	asgard.Run(r, a.Victim) // run the last service in the list, and point chaos monkey at the victim
 }
 
@@ -108,6 +141,10 @@ func ReadArch(arch string) *archV0r1 {
 				log.Println(s)
 				log.Fatal("Unknown package name in architecture: " + s.Gopackage)
 			}
+			if _, ok := ribbon.Rules[s.Rule]; s.Rule != "" && !ok {
+				log.Println(s)
+				log.Fatal("Unknown load balancing rule in architecture: " + s.Rule)
+			}
 		}
 		// check all the dependencies
 		for _, s := range a.Services {
@@ -3,6 +3,7 @@ package asgard
 
 import (
 	"fmt"
+	"github.com/adrianco/spigo/actors/cache"          // memcached or EVCache server
 	"github.com/adrianco/spigo/actors/denominator"    // DNS service
 	"github.com/adrianco/spigo/actors/elb"            // elastic load balancer
 	"github.com/adrianco/spigo/actors/eureka"         // service and attribute registry
@@ -16,12 +17,15 @@ import (
 	"github.com/adrianco/spigo/actors/zuul"           // API proxy microservice router
 	"github.com/adrianco/spigo/tooling/archaius"      // global configuration
 	"github.com/adrianco/spigo/tooling/chaosmonkey"   // delete nodes at random
+	"github.com/adrianco/spigo/tooling/clock"         // simulation time
 	"github.com/adrianco/spigo/tooling/collect"       // metrics collector
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/graphjson"
 	"github.com/adrianco/spigo/tooling/handlers"
 	"github.com/adrianco/spigo/tooling/names" // manage service name hierarchy
+	"github.com/go-kit/kit/metrics/generic"
 	"log"
+	"sync"
 	"time"
 )
 
@@ -30,13 +34,44 @@ var (
 	eurekachan map[string]chan gotocol.Message // eureka for each region and zone
 	// noodles channels mapped by microservice name connects netflixoss to everyone
 	noodles map[string]chan gotocol.Message
+	script  []archaius.Change // property changes to make while running
+	rlock   sync.Mutex
+	running []chan gotocol.Message // actors to tell about property changes, they can come from the http server
+	rings   map[string]string      // cassandra token config for each cluster, by service, so a replacement can take over a dead node's tokens
 )
 
+func init() {
+	archaius.Watch(tell)
+}
+
+// Script property changes to make at times after Run starts
+func Script(changes []archaius.Change) {
+	script = changes
+}
+
+// tell the running actors that a property changed
+func tell(key, value string) {
+	rlock.Lock()
+	defer rlock.Unlock()
+	for _, c := range running {
+		gotocol.Message{gotocol.Config, nil, clock.Now(), gotocol.NilContext, key + " " + value}.GoSend(c)
+	}
+}
+
 // CreateChannels makes the maps of channels
 func CreateChannels() {
 	listener = make(chan gotocol.Message) // listener for architecture
+	gotocol.Inbox(listener)               // asgard isn't an actor, it waits for replies during shutdown
 	noodles = make(map[string]chan gotocol.Message, archaius.Conf.Population)
 	eurekachan = make(map[string]chan gotocol.Message, len(archaius.Conf.ZoneNames)*archaius.Conf.Regions)
+	groups = nil
+	next = make(map[string]int)
+	served = make(map[string]float64)
+	recovery = make(map[string]*generic.Histogram)
+	replaced = make(map[string]*generic.Counter)
+	recovering = make(map[string]launch)
+	eureka.Registered = recovered
+	rings = make(map[string]string)
 }
 
 type mapchan map[string]chan gotocol.Message
@@ -52,6 +87,7 @@ func Create(servicename, packagename string, regions, count int, dependencies ..
 		name = names.Make(arch, "*", "*", servicename, packagename, 0)
 		StartNode(name, dependencies...)
 	}
+	cass := make(mapchan) // for token distribution, one ring across every region
 	for r := 0; r < regions; r++ {
 		if count == 0 { // for AWS services that are cross zone like elb and S3
 			//log.Printf("Create cross zone: " + servicename)
@@ -59,27 +95,35 @@ func Create(servicename, packagename string, regions, count int, dependencies ..
 			StartNode(name, dependencies...)
 		} else {
 			//log.Printf("Create service: " + servicename)
-			cass := make(map[string]mapchan) // for token distribution
-			for i := r * count; i < (r+1)*count; i++ {
+			s, scaled := scaling(names.Make(arch, rnames[r], znames[0], servicename, packagename, 0), count)
+			n := count
+			if scaled && s.Desired > 0 {
+				n = clamp(s, s.Desired)
+			}
+			if next[servicename] < r*count {
+				next[servicename] = r * count // the same names as without a group, unless the desired count differs
+			}
+			var live []string
+			for j := 0; j < n; j++ {
+				i := next[servicename]
+				next[servicename]++
 				name = names.Make(arch, rnames[r], znames[i%len(archaius.Conf.ZoneNames)], servicename, packagename, i)
 				//log.Println(dependencies)
 				StartNode(name, dependencies...)
+				live = append(live, name)
 				if packagename == "priamCassandra" {
-					rz := names.RegionZone(name)
-					if cass[rz] == nil {
-						cass[rz] = make(mapchan)
-					}
-					cass[rz][name] = noodles[name] // remember the nodes
+					cass[name] = noodles[name] // remember the nodes
 				}
 			}
-			if packagename == "priamCassandra" {
-				// split by zone
-				for _, v := range cass {
-					priamCassandra.Distribute(v) // returns a string if it needs logging
-				}
+			if packagename != EurekaPkg && packagename != DenominatorPkg && len(live) > 0 {
+				// every instance is in a group, so it gets replaced if it dies
+				groups = append(groups, newGroup(s, scaled, live, count, dependencies))
 			}
 		}
 	}
+	if len(cass) > 0 {
+		rings[servicename] = priamCassandra.Distribute(cass) // replicas are placed by region and zone within the ring
+	}
 	return name
 }
 
@@ -98,7 +142,8 @@ func Reload(arch string) string {
 	CreateEureka()
 	// eureka and edda aren't recorded in the json file to simplify the graph
 	// Start all the services
-	cass := make(map[string]chan gotocol.Message) // for token distribution
+	cass := make(map[string]mapchan) // for token distribution, a ring for each service
+	var services []string            // in the order they were found, so the rings are made in the same order every time
 	for _, element := range g.Graph {
 		if element.Node != "" {
 			name := element.Node
@@ -107,12 +152,17 @@ func Reload(arch string) string {
 				root = name
 			}
 			if names.Package(name) == "priamCassandra" {
-				cass[name] = noodles[name] // remember the nodes
+				s := names.Service(name)
+				if cass[s] == nil {
+					cass[s] = make(mapchan)
+					services = append(services, s)
+				}
+				cass[s][name] = noodles[name] // remember the nodes
 			}
 		}
 	}
-	if len(cass) > 0 { // currently doesn't handle multiple priamCassandra per arch
-		priamCassandra.Distribute(cass) // returns a string if it needs logging
+	for _, s := range services {
+		rings[s] = priamCassandra.Distribute(cass[s])
 	}
 	// Make all the connections
 	for _, element := range g.Graph {
@@ -130,7 +180,7 @@ func Reload(arch string) string {
 // Connect tells a source node how to connect to a target node directly by name, only used when Eureka can't be used
 func Connect(source, target string) {
 	if noodles[source] != nil && noodles[target] != nil {
-		gotocol.Send(noodles[source], gotocol.Message{gotocol.NameDrop, noodles[target], time.Now(), handlers.DebugContext(gotocol.NilContext), target})
+		gotocol.Send(noodles[source], gotocol.Message{gotocol.NameDrop, noodles[target], clock.Now(), handlers.DebugContext(gotocol.NilContext), target})
 		//log.Println("Link " + source + " > " + target)
 	} else {
 		log.Fatal("Asgard can't link " + source + " > " + target)
@@ -149,7 +199,12 @@ func SendToName(name string, msg gotocol.Message) {
 // StartNode starts a node using the named package, and connect it to any dependencies
 func StartNode(name string, dependencies ...string) {
 	if names.Package(name) == EurekaPkg {
-		eurekachan[name] = make(chan gotocol.Message, archaius.Conf.Population/len(archaius.Conf.ZoneNames)) // buffer sized to a zone
+		size := archaius.Conf.Population / len(archaius.Conf.ZoneNames) // buffer sized to a zone
+		if clock.Virtual() {
+			size = 0 // virtual time delivery needs to see when eureka has handled each message
+		}
+		eurekachan[name] = make(chan gotocol.Message, size)
+		gotocol.Known(eurekachan[name], name) // so partitions apply to replication between registries
 		go eureka.Start(eurekachan[name], name)
 		return
 	}
@@ -175,7 +230,7 @@ func StartNode(name string, dependencies ...string) {
 	case PriamCassandraPkg:
 		go priamCassandra.Start(noodles[name])
 	case CachePkg:
-		fallthrough // fake memcache using store
+		go cache.Start(noodles[name])
 	case VolumePkg:
 		fallthrough // fake disk volume using store
 	case StorePkg:
@@ -183,7 +238,7 @@ func StartNode(name string, dependencies ...string) {
 	default:
 		log.Fatal("asgard: unknown package: " + names.Package(name))
 	}
-	noodles[name] <- gotocol.Message{gotocol.Hello, listener, time.Now(), handlers.DebugContext(gotocol.NilContext), name}
+	gotocol.Send(noodles[name], gotocol.Message{gotocol.Hello, listener, clock.Now(), handlers.DebugContext(gotocol.NilContext), name})
 	// there is a eureka service registry in each zone, so in-zone services just get to talk to their local registry
 	// elb are cross zone, so need to see all registries in a region
 	// denominator are cross region so need to see all registries globally
@@ -194,18 +249,19 @@ func StartNode(name string, dependencies ...string) {
 			crossregion = true
 		}
 	}
-	for n, ch := range eurekachan {
+	for _, n := range gotocol.Names(eurekachan) {
+		ch := eurekachan[n]
 		if names.Region(name) == "*" || crossregion {
 			// need to know every eureka in all zones and regions
-			gotocol.Send(noodles[name], gotocol.Message{gotocol.Inform, ch, time.Now(), handlers.DebugContext(gotocol.NilContext), n})
+			gotocol.Send(noodles[name], gotocol.Message{gotocol.Inform, ch, clock.Now(), handlers.DebugContext(gotocol.NilContext), n})
 		} else {
 			if names.Zone(name) == "*" && names.Region(name) == names.Region(n) {
 				// need every eureka in my region
-				gotocol.Send(noodles[name], gotocol.Message{gotocol.Inform, ch, time.Now(), handlers.DebugContext(gotocol.NilContext), n})
+				gotocol.Send(noodles[name], gotocol.Message{gotocol.Inform, ch, clock.Now(), handlers.DebugContext(gotocol.NilContext), n})
 			} else {
 				if names.RegionZone(name) == names.RegionZone(n) {
 					// just the eureka in this specific zone
-					gotocol.Send(noodles[name], gotocol.Message{gotocol.Inform, ch, time.Now(), handlers.DebugContext(gotocol.NilContext), n})
+					gotocol.Send(noodles[name], gotocol.Message{gotocol.Inform, ch, clock.Now(), handlers.DebugContext(gotocol.NilContext), n})
 				}
 			}
 		}
@@ -215,7 +271,7 @@ func StartNode(name string, dependencies ...string) {
 	for _, dep := range dependencies {
 		if dep != "" && dep != "eureka" { // ignore special case of eureka in dependency list
 			//log.Println(name + " depends on " + dep)
-			gotocol.Send(noodles[name], gotocol.Message{gotocol.NameDrop, nil, time.Now(), handlers.DebugContext(gotocol.NilContext), dep})
+			gotocol.Send(noodles[name], gotocol.Message{gotocol.NameDrop, nil, clock.Now(), handlers.DebugContext(gotocol.NilContext), dep})
 		}
 	}
 }
@@ -225,7 +281,8 @@ func CreateEureka() {
 	// setup name service and cross zone replication links
 	znames := archaius.Conf.ZoneNames
 	Create("eureka", EurekaPkg, archaius.Conf.Regions, len(archaius.Conf.ZoneNames))
-	for n, ch := range eurekachan {
+	for _, n := range gotocol.Names(eurekachan) {
+		ch := eurekachan[n]
 		var n1, n2 string
 		switch names.Zone(n) {
 		case znames[0]:
@@ -238,10 +295,11 @@ func CreateEureka() {
 			n1 = znames[0]
 			n2 = znames[1]
 		}
-		for nn, cch := range eurekachan {
+		for _, nn := range gotocol.Names(eurekachan) {
+			cch := eurekachan[nn]
 			if names.Region(nn) == names.Region(n) && (names.Zone(nn) == n1 || names.Zone(nn) == n2) {
 				//log.Println("Eureka cross connect from: " + n + " to " + nn)
-				gotocol.Send(ch, gotocol.Message{gotocol.NameDrop, cch, time.Now(), handlers.DebugContext(gotocol.NilContext), nn})
+				gotocol.Send(ch, gotocol.Message{gotocol.NameDrop, cch, clock.Now(), handlers.DebugContext(gotocol.NilContext), nn})
 			}
 		}
 	}
@@ -249,39 +307,77 @@ func CreateEureka() {
 
 // ConnectEveryEureka service in every region
 func ConnectEveryEureka(name string) {
-	for n, ch := range eurekachan {
-		gotocol.Send(noodles[name], gotocol.Message{gotocol.Inform, ch, time.Now(), handlers.DebugContext(gotocol.NilContext), n})
+	for _, n := range gotocol.Names(eurekachan) {
+		gotocol.Send(noodles[name], gotocol.Message{gotocol.Inform, eurekachan[n], clock.Now(), handlers.DebugContext(gotocol.NilContext), n})
 	}
 }
 
 // Run architecture for a while then shut down
 func Run(rootservice, victim string) {
-	// tell denominator to start chatting with microservices every 0.01 secs by default
-	delay := archaius.Key(archaius.Conf, "chat")
-	if delay == "" {
-		delay = fmt.Sprintf("%dms", 10)
+	collect.Begin()
+	// tell each root to start chatting with microservices every 0.01 secs by default, a chat or workload property can set it for each one
+	for _, root := range roots(rootservice) {
+		delay := archaius.String(root, "chat", fmt.Sprintf("%dms", 10))
+		if wl := archaius.String(root, "workload", archaius.Conf.Workload); wl != "" {
+			delay += " " + wl // the profile shapes the load from the default rate
+		}
+		log.Println(root+" activity rate ", delay)
+		SendToName(root, gotocol.Message{gotocol.Chat, nil, clock.Now(), handlers.DebugContext(gotocol.NilContext), delay})
+	}
+	rlock.Lock()
+	for _, n := range gotocol.Names(noodles) {
+		running = append(running, noodles[n])
+	}
+	rlock.Unlock()
+	for _, c := range script {
+		at, err := time.ParseDuration(c.At)
+		if err != nil {
+			log.Fatalf("asgard: bad time for %v: %v\n", c.Key, err)
+		}
+		key, value := c.Key, c.Value
+		clock.After(at, func() { archaius.Set(key, value) }) // a bad value is logged and the old one kept
 	}
-	log.Println(rootservice+" activity rate ", delay)
-	SendToName(rootservice, gotocol.Message{gotocol.Chat, nil, time.Now(), handlers.DebugContext(gotocol.NilContext), delay})
-	// wait until the delay has finished
+	// wait until the delay has finished, while chaosmonkey runs its experiment and the scaling groups resize
 	if archaius.Conf.RunDuration >= time.Millisecond {
-		time.Sleep(archaius.Conf.RunDuration / 2)
-		chaosmonkey.Delete(&noodles, victim) // kill a random victim half way through
-		time.Sleep(archaius.Conf.RunDuration / 2)
+		experiment := chaosmonkey.Default(victim, archaius.Conf.RunDuration/2) // kill a random victim half way through
+		if archaius.Conf.Chaos != "" {
+			experiment = chaosmonkey.Read(archaius.Conf.Chaos)
+		}
+		chaosmonkey.Start(noodles, experiment)
+		autoscale(archaius.Conf.RunDuration)
 	}
 	log.Println("asgard: Shutdown")
+	rlock.Lock()
+	running = nil
+	rlock.Unlock()
+	chaosmonkey.Stop()
+	collect.Freeze() // gauges such as registry sizes show the end of the run, not the shutdown
 	ShutdownNodes()
 	ShutdownEureka()
+	saveRecovery()
+	collect.SaveServiceHists()
+	collect.SaveSeries()
 	collect.Save()
 }
 
+// roots are the services that generate load, every denominator, and the root service that was passed in
+func roots(rootservice string) []string {
+	rs := []string{rootservice}
+	for _, n := range gotocol.Names(noodles) {
+		if n != rootservice && names.Package(n) == DenominatorPkg {
+			rs = append(rs, n)
+		}
+	}
+	return rs
+}
+
 // ShutdownNodes - shut down the nodes and wait for them to go away
 func ShutdownNodes() {
-	for _, noodle := range noodles {
-		gotocol.Message{gotocol.Goodbye, nil, time.Now(), handlers.DebugContext(gotocol.NilContext), "shutdown"}.GoSend(noodle)
+	for _, n := range gotocol.Names(noodles) {
+		gotocol.Message{gotocol.Goodbye, nil, clock.Now(), handlers.DebugContext(gotocol.NilContext), "shutdown"}.GoSend(noodles[n])
 	}
 	for len(noodles) > 0 {
-		msg := <-listener
+		msg := gotocol.Receive(listener)
 		if archaius.Conf.Msglog {
 			log.Printf("asgard: %v\n", msg)
 		}
@@ -299,11 +395,11 @@ func ShutdownNodes() {
 func ShutdownEureka() {
 	// shutdown eureka and wait to catch eureka reply
 	//log.Println(eurekachan)
-	for _, ch := range eurekachan {
-		gotocol.Message{gotocol.Goodbye, listener, time.Now(), handlers.DebugContext(gotocol.NilContext), "shutdown"}.GoSend(ch)
+	for _, n := range gotocol.Names(eurekachan) {
+		gotocol.Message{gotocol.Goodbye, listener, clock.Now(), handlers.DebugContext(gotocol.NilContext), "shutdown"}.GoSend(eurekachan[n])
 	}
 	for range eurekachan {
-		<-listener
+		gotocol.Receive(listener)
 	}
 	// wait for all the eureka to flush messages and exit
 	eureka.Wg.Wait()
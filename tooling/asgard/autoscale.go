@@ -0,0 +1,527 @@
+package asgard
+
+import (
+	"github.com/adrianco/spigo/actors/priamCassandra"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/chaosmonkey"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"github.com/adrianco/spigo/tooling/handlers"
+	"github.com/adrianco/spigo/tooling/names"
+	"github.com/go-kit/kit/metrics/generic"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scaling policy metrics
+const (
+	Rate     = "rate"     // responses per second per instance of the service
+	Queue    = "queue"    // requests waiting for a worker per instance, needs a capacity model
+	Response = "response" // percentile of the response time seen by the root services, in milliseconds
+)
+
+// group is the auto scaling group for a service in a region, it replaces instances that die
+type group struct {
+	name         string    // of the first instance, to look up its scaling settings
+	count        int       // it was created with
+	zones        []string  // the instances are spread across
+	dependencies []string  // passed on to each new instance
+	live         []string  // instances in service, oldest first
+	pending      []launch  // instances that are still booting
+	desired      int       // instances wanted
+	set          int       // desired count in the settings the last time they were looked at
+	quiet        time.Time // policies are ignored until the cooldown is over
+	inservice    *generic.Gauge
+	target       *generic.Gauge
+}
+
+// launch of a new instance, it starts once it has booted
+type launch struct {
+	name     string
+	at       time.Time
+	replaces string    // the instance that died, if it's a replacement
+	died     time.Time // when it died, to measure how long recovery takes
+}
+
+var (
+	groups   []*group                      // in the order they were created
+	next     map[string]int                // index of the next instance of each service, so names are unique across regions
+	served   map[string]float64            // responses counted by each service at the last evaluation
+	recovery map[string]*generic.Histogram // time from an instance dying until its replacement registers, for each service
+	replaced map[string]*generic.Counter   // replacements made for each service
+
+	relock     sync.Mutex        // replacements register with eureka on its goroutines
+	recovering map[string]launch // replacements that have started but haven't registered yet, by name
+)
+
+// an instance takes a couple of minutes to boot and start its service, a simulation is short so it's scaled down
+const launchDelay = 5 * time.Second
+
+// scaling settings for a service instance with the defaults filled in, ok if its group can be resized
+func scaling(name string, count int) (archaius.Scaling, bool) {
+	s, ok := archaius.ScalingFor(name)
+	if s.Min < 1 {
+		s.Min = 1
+	}
+	if s.Max < 1 {
+		s.Max = count
+	}
+	if s.Max < s.Min {
+		s.Max = s.Min
+	}
+	if s.LaunchDelay == "" {
+		s.LaunchDelay = launchDelay.String()
+	}
+	for _, d := range []string{s.LaunchDelay, s.Cooldown} {
+		if d != "" {
+			if _, err := time.ParseDuration(d); err != nil {
+				log.Fatalf("asgard: bad scaling time for %v: %v\n", names.Service(name), err)
+			}
+		}
+	}
+	policies := make([]archaius.Policy, len(s.Policies))
+	for i, p := range s.Policies {
+		switch p.Metric {
+		case Rate, Queue, Response:
+		default:
+			log.Fatalf("asgard: unknown scaling metric %v for %v\n", p.Metric, names.Service(name))
+		}
+		if p.Percentile <= 0 || p.Percentile >= 100 {
+			p.Percentile = 99
+		}
+		if p.Adjust < 1 {
+			p.Adjust = 1
+		}
+		policies[i] = p
+	}
+	s.Policies = policies
+	return s, ok && count > 0
+}
+
+// clamp a count between the smallest and largest size of a group
+func clamp(s archaius.Scaling, n int) int {
+	switch {
+	case n < s.Min:
+		return s.Min
+	case n > s.Max:
+		return s.Max
+	}
+	return n
+}
+
+// newGroup for the instances of a service that were created in a region
+func newGroup(s archaius.Scaling, scaled bool, live []string, count int, dependencies []string) *group {
+	name := live[0]
+	service := names.Service(name)
+	prefix := service + "_" + names.Region(name)
+	g := &group{
+		name:         name,
+		count:        count,
+		zones:        archaius.Conf.ZoneNames,
+		dependencies: dependencies,
+		live:         live,
+		desired:      len(live),
+		set:          s.Desired,
+		inservice:    collect.NewGauge(prefix + "_inservice"),
+		target:       collect.NewGauge(prefix + "_desired"),
+	}
+	g.measure()
+	if scaled {
+		log.Printf("asgard: %v scaling group in %v has %v instances, min %v max %v\n", service, names.Region(name), len(live), s.Min, s.Max)
+	}
+	return g
+}
+
+// autoscale while the simulation runs for a while, departures, launches and policies are handled between sleeps
+func autoscale(d time.Duration) {
+	if len(groups) == 0 {
+		clock.Sleep(d)
+		return
+	}
+	for _, g := range groups {
+		if s, _ := scaling(g.name, g.count); len(s.Policies) > 0 && !archaius.Conf.Collect {
+			log.Println("asgard: scaling policies need -c to collect metrics, groups only resize when their desired count is set")
+			break
+		}
+	}
+	collect.Recent("_resp") // start keeping the response times seen by the roots
+	period := archaius.Duration("", "asg.period", time.Second)
+	end := clock.Now().Add(d)
+	eval := clock.Now().Add(period)
+	for {
+		wake := eval
+		for _, g := range groups {
+			for _, l := range g.pending {
+				if l.at.Before(wake) {
+					wake = l.at
+				}
+			}
+		}
+		if wake.After(end) {
+			wake = end
+		}
+		clock.Sleep(wake.Sub(clock.Now()))
+		for {
+			msg, ok := gotocol.Poll(listener)
+			if !ok {
+				break
+			}
+			departed(msg)
+		}
+		now := clock.Now()
+		for _, g := range groups {
+			g.boot(now)
+		}
+		if !now.Before(end) {
+			return
+		}
+		if !now.Before(eval) {
+			evaluate(period)
+			eval = now.Add(period)
+		}
+	}
+}
+
+// evaluate the scaling policies of every group, and resize them
+func evaluate(period time.Duration) {
+	responses := collect.Recent("_resp")
+	sort.Float64s(responses)
+	rates := make(map[string]float64)
+	for _, g := range groups {
+		service := names.Service(g.name)
+		if _, ok := rates[service]; ok {
+			continue
+		}
+		if n, ok := collect.Value(service + "_responses"); ok {
+			rates[service] = (n - served[service]) / period.Seconds() / float64(instances(service))
+			served[service] = n
+		}
+	}
+	now := clock.Now()
+	for _, g := range groups {
+		s, scaled := scaling(g.name, g.count)
+		if !scaled {
+			g.measure()
+			continue
+		}
+		size := g.desired
+		if s.Desired != g.set {
+			g.set = s.Desired // changed while running
+			if s.Desired > 0 {
+				size = s.Desired
+			}
+		} else if !now.Before(g.quiet) {
+			size += decide(s.Policies, func(p archaius.Policy) (float64, bool) {
+				switch p.Metric {
+				case Rate:
+					r, ok := rates[names.Service(g.name)]
+					return r, ok
+				case Queue:
+					return g.queue()
+				case Response:
+					if len(responses) == 0 {
+						return 0, false
+					}
+					return percentile(responses, p.Percentile) / float64(time.Millisecond), true
+				}
+				return 0, false
+			})
+		}
+		size = clamp(s, size)
+		if size != g.desired {
+			log.Printf("asgard: %v in %v scaling from %v to %v instances\n", names.Service(g.name), names.Region(g.name), g.desired, size)
+			g.desired = size
+			cooldown := s.Cooldown
+			if cooldown == "" {
+				cooldown = s.LaunchDelay
+			}
+			d, _ := time.ParseDuration(cooldown)
+			g.quiet = now.Add(d)
+		}
+		g.resize(s)
+		g.measure()
+	}
+}
+
+// decide how many instances to add, or remove if it's negative, any policy can scale out but they all have to agree to scale in
+func decide(policies []archaius.Policy, value func(archaius.Policy) (float64, bool)) int {
+	out, in, hold := 0, 0, false
+	for _, p := range policies {
+		v, ok := value(p)
+		if !ok {
+			continue
+		}
+		if p.Above > 0 && v > p.Above && p.Adjust > out {
+			out = p.Adjust
+		}
+		if p.Below > 0 {
+			if v < p.Below {
+				if p.Adjust > in {
+					in = p.Adjust
+				}
+			} else {
+				hold = true
+			}
+		}
+	}
+	if out > 0 {
+		return out
+	}
+	if hold {
+		return 0
+	}
+	return -in
+}
+
+// percentile of some sorted values
+func percentile(sorted []float64, q float64) float64 {
+	i := int(math.Ceil(q*float64(len(sorted))/100)) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// instances of a service in service across all its groups
+func instances(service string) int {
+	n := 0
+	for _, g := range groups {
+		if names.Service(g.name) == service {
+			n += len(g.live)
+		}
+	}
+	if n == 0 {
+		n = 1
+	}
+	return n
+}
+
+// queue depth averaged over the instances in service that have a capacity model
+func (g *group) queue() (float64, bool) {
+	total, n := 0.0, 0
+	for _, i := range g.live {
+		if q, ok := collect.Value(i + "_queue"); ok {
+			total += q
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return total / float64(n), true
+}
+
+// measure the size of the group
+func (g *group) measure() {
+	collect.Gauge(g.inservice, len(g.live))
+	collect.Gauge(g.target, g.desired)
+}
+
+// resize the group to the desired count, booting instances are cancelled before any in service are terminated
+func (g *group) resize(s archaius.Scaling) {
+	have := len(g.live) + len(g.pending)
+	for ; have < g.desired; have++ {
+		g.add(s)
+	}
+	for ; have > g.desired && len(g.pending) > 0; have-- {
+		l := g.pending[len(g.pending)-1]
+		g.pending = g.pending[:len(g.pending)-1]
+		log.Printf("asgard: cancelled launch of %v\n", l.name)
+	}
+	for ; have > g.desired && len(g.live) > 0; have-- {
+		g.remove()
+	}
+}
+
+// count the instances in each zone, including any that are booting
+func (g *group) spread() map[string]int {
+	n := make(map[string]int)
+	for _, i := range g.live {
+		n[names.Zone(i)]++
+	}
+	for _, l := range g.pending {
+		n[names.Zone(l.name)]++
+	}
+	return n
+}
+
+// add an instance in the zone that has fewest, it starts once the launch delay has passed
+func (g *group) add(s archaius.Scaling) {
+	n := g.spread()
+	zone := g.zones[0]
+	for _, z := range g.zones {
+		if n[z] < n[zone] {
+			zone = z
+		}
+	}
+	d, _ := time.ParseDuration(s.LaunchDelay)
+	g.pending = append(g.pending, launch{g.newName(zone), clock.Now().Add(d), "", time.Time{}})
+}
+
+// replace an instance that died with a new one in the same zone, it starts once the launch delay has passed
+func (g *group) replace(dead string, died time.Time) {
+	s, _ := scaling(g.name, g.count)
+	d, _ := time.ParseDuration(s.LaunchDelay)
+	name := g.newName(names.Zone(dead))
+	g.pending = append(g.pending, launch{name, clock.Now().Add(d), dead, died})
+	log.Printf("asgard: replacing %v with %v\n", dead, name)
+}
+
+// newName for the next instance of the group's service in a zone
+func (g *group) newName(zone string) string {
+	service := names.Service(g.name)
+	name := names.Make(archaius.Conf.Arch, names.Region(g.name), zone, service, names.Package(g.name), next[service])
+	next[service]++
+	return name
+}
+
+// boot the instances whose launch delay has passed, they register with eureka as they start
+func (g *group) boot(now time.Time) {
+	var booting []launch
+	for _, l := range g.pending {
+		if l.at.After(now) {
+			booting = append(booting, l)
+			continue
+		}
+		StartNode(l.name, g.dependencies...)
+		chaosmonkey.Add(l.name, noodles[l.name])
+		rlock.Lock()
+		running = append(running, noodles[l.name])
+		rlock.Unlock()
+		g.live = append(g.live, l.name)
+		service := names.Service(g.name)
+		if l.replaces == "" {
+			if ring, ok := rings[service]; ok {
+				rings[service] = priamCassandra.Bootstrap(cluster(service), ring, l.name)
+				log.Printf("asgard: %v joined the %v ring\n", l.name, service)
+			} else {
+				log.Printf("asgard: launched %v\n", l.name)
+			}
+			continue
+		}
+		if ring := rings[service]; ring != "" {
+			rings[service] = priamCassandra.Replace(cluster(service), ring, l.replaces, l.name)
+		}
+		relock.Lock()
+		recovering[l.name] = l // it has recovered once callers can find it
+		relock.Unlock()
+		log.Printf("asgard: %v replacing %v has booted\n", l.name, l.replaces)
+	}
+	g.pending = booting
+	g.measure()
+}
+
+// remove the newest instance from the zone that has most, it deregisters from eureka as it goes
+func (g *group) remove() {
+	n := g.spread()
+	zone := names.Zone(g.live[len(g.live)-1])
+	for _, z := range g.zones {
+		if n[z] > n[zone] {
+			zone = z
+		}
+	}
+	i := len(g.live) - 1
+	for names.Zone(g.live[i]) != zone {
+		i--
+	}
+	name := g.live[i]
+	g.live = append(g.live[:i], g.live[i+1:]...)
+	retire(name)
+	collect.Died(name, clock.Now())
+	if ring, ok := rings[names.Service(name)]; ok {
+		// a ring member streams its ranges to the nodes that take them over before it's told Goodbye
+		cass := cluster(names.Service(name))
+		cass[name] = noodles[name]
+		rings[names.Service(name)] = priamCassandra.Decommission(cass, ring, name)
+		log.Printf("asgard: %v left the %v ring\n", name, names.Service(name))
+	}
+	gotocol.Message{gotocol.Goodbye, nil, clock.Now(), handlers.DebugContext(gotocol.NilContext), "asgard"}.GoSend(noodles[name])
+	log.Printf("asgard: terminated %v\n", name)
+}
+
+// cluster of the live instances of a service, across the groups in every region
+func cluster(service string) map[string]chan gotocol.Message {
+	cass := make(map[string]chan gotocol.Message)
+	for _, g := range groups {
+		if names.Service(g.name) == service {
+			for _, n := range g.live {
+				cass[n] = noodles[n]
+			}
+		}
+	}
+	return cass
+}
+
+// retire an instance so it's not told about property changes or picked by chaosmonkey
+func retire(name string) {
+	chaosmonkey.Remove(name)
+	c := noodles[name]
+	rlock.Lock()
+	for j, r := range running {
+		if r == c {
+			running = append(running[:j], running[j+1:]...)
+			break
+		}
+	}
+	rlock.Unlock()
+}
+
+// departed instances say Goodbye to asgard as they exit, any that weren't terminated by their group are replaced
+func departed(msg gotocol.Message) {
+	name := msg.Intention
+	if msg.Imposition != gotocol.Goodbye || noodles[name] == nil {
+		return
+	}
+	retire(name)
+	collect.Died(name, msg.Sent)
+	delete(noodles, name) // so shutdown doesn't wait for it
+	for _, g := range groups {
+		for i, n := range g.live {
+			if n == name {
+				g.live = append(g.live[:i], g.live[i+1:]...)
+				g.replace(name, msg.Sent)
+				g.measure()
+				return
+			}
+		}
+	}
+}
+
+// recovered is told by eureka when an instance registers, if it's a replacement the time since the instance it replaces died is recorded
+func recovered(name string, at time.Time) {
+	relock.Lock()
+	defer relock.Unlock()
+	l, ok := recovering[name]
+	if !ok {
+		return
+	}
+	delete(recovering, name)
+	service := names.Service(name)
+	if recovery[service] == nil {
+		recovery[service] = collect.NewHist(service + "_recovery")
+		replaced[service] = collect.NewCounter(service + "_replaced")
+	}
+	collect.Elapsed(recovery[service], at.Sub(l.died))
+	collect.Count(replaced[service])
+	log.Printf("asgard: %v replaced %v after %v\n", name, l.replaces, at.Sub(l.died))
+}
+
+// saveRecovery times for each service to csv_metrics
+func saveRecovery() {
+	relock.Lock()
+	defer relock.Unlock()
+	services := make([]string, 0, len(recovery))
+	for service := range recovery {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	for _, service := range services {
+		if h := recovery[service]; h != nil {
+			collect.SaveHist(h, names.MakeContainer(archaius.Conf.Arch, "*", "*", "", service, "", "", service, ""), "_recovery")
+		}
+	}
+}
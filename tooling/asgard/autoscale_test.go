@@ -0,0 +1,38 @@
+package asgard
+
+import (
+	"github.com/adrianco/spigo/tooling/archaius"
+	"testing"
+)
+
+func TestDecide(t *testing.T) {
+	queue := archaius.Policy{Metric: Queue, Above: 4, Below: 1, Adjust: 2}
+	rate := archaius.Policy{Metric: Rate, Above: 100, Below: 20, Adjust: 1}
+	for _, c := range []struct {
+		queue, rate float64
+		want        int
+	}{
+		{5, 10, 2},    // either can scale out
+		{2, 150, 1},   // by its own step
+		{0.5, 10, -2}, // both agree to scale in
+		{0.5, 50, 0},  // rate holds it
+		{2, 50, 0},
+	} {
+		got := decide([]archaius.Policy{queue, rate}, func(p archaius.Policy) (float64, bool) {
+			if p.Metric == Queue {
+				return c.queue, true
+			}
+			return c.rate, true
+		})
+		if got != c.want {
+			t.Errorf("queue %v rate %v: got %v want %v", c.queue, c.rate, got, c.want)
+		}
+	}
+	if decide([]archaius.Policy{queue}, func(archaius.Policy) (float64, bool) { return 0, false }) != 0 {
+		t.Error("scaled without a metric")
+	}
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if percentile(sorted, 50) != 5 || percentile(sorted, 99) != 10 || percentile(sorted, 1) != 1 {
+		t.Error("percentile")
+	}
+}
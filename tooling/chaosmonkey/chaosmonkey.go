@@ -1,22 +1,363 @@
-// Package chaosmonkey deletes nodes
+// Package chaosmonkey deletes nodes and degrades the network, following a timeline of actions read from a chaos experiment file
 package chaosmonkey
 
 import (
+	"encoding/json"
+	"github.com/adrianco/spigo/actors/edda"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/flow"
 	"github.com/adrianco/spigo/tooling/gotocol"
+	"github.com/adrianco/spigo/tooling/latency"
 	"github.com/adrianco/spigo/tooling/names"
+	"github.com/adrianco/spigo/tooling/random"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
 	"time"
 )
 
-// Delete a single node from the given service
-func Delete(noodles *map[string]chan gotocol.Message, service string) {
-	if service != "" {
-		for node, ch := range *noodles {
-			if names.Service(node) == service {
-				gotocol.Message{gotocol.Goodbye, nil, time.Now(), gotocol.NewTrace(), "chaosmonkey"}.GoSend(ch)
-				log.Println("chaosmonkey delete: " + node)
-				return
+// Chaos actions
+const (
+	Kill      = "kill"      // kill a count or percentage of the instances of a service
+	Gorilla   = "gorilla"   // kill every instance in a zone
+	Kong      = "kong"      // kill every instance in a region
+	Pause     = "pause"     // stop a count or percentage of the instances of a service handling messages for the duration
+	Resume    = "resume"    // logged when a pause is over
+	Latency   = "latency"   // Latency Monkey adds delay to messages to and from a service or location
+	Drop      = "drop"      // drop a percentage of the messages to and from a service or location
+	Partition = "partition" // drop every message between two locations, such as zones or regions
+	Heal      = "heal"      // logged when a network fault is over
+)
+
+// Experiment is a timeline of chaos actions, read from json_arch/<name>_chaos.json
+type Experiment struct {
+	Name        string   `json:"experiment"`
+	Description string   `json:"description,omitempty"`
+	Actions     []Action `json:"actions"`
+}
+
+// Action on some nodes, starting a time after the simulation starts running
+type Action struct {
+	Action   string   `json:"action"`             // kill, gorilla, kong or pause
+	At       string   `json:"at"`                 // when to start
+	Duration string   `json:"duration,omitempty"` // kills are spread out over the duration, pauses last for it
+	Service  string   `json:"service,omitempty"`  // only nodes of this service, any service for gorilla and kong
+	Count    int      `json:"count,omitempty"`    // how many nodes to kill or pause, defaults to one
+	Percent  float64  `json:"percent,omitempty"`  // or a percentage of the nodes that match, or of the messages to drop
+	Zone     string   `json:"zone,omitempty"`     // only nodes in this zone, required for gorilla
+	Region   string   `json:"region,omitempty"`   // only nodes in this region, required for kong, defaults to the first region for a zone
+	Delay    string   `json:"delay,omitempty"`    // added to each message by latency
+	Between  []string `json:"between,omitempty"`  // the two sides of a partition, region or region.zone names
+	at       time.Duration
+	duration time.Duration
+	delay    time.Duration
+}
+
+var (
+	lock    sync.Mutex                      // actions can fire on the wall clock while asgard is running
+	monkey  *rand.Rand                      // chaosmonkey's own random stream, made once the seed is set
+	targets map[string]chan gotocol.Message // the nodes that were running when the experiment started
+	dead    = make(map[string]bool)         // nodes that have been killed
+	stopped bool                            // the simulation is shutting down
+)
+
+// Default experiment kills one instance of the victim service at a time
+func Default(victim string, at time.Duration) *Experiment {
+	e := &Experiment{Name: "chaosmonkey"}
+	if victim != "" {
+		e.Actions = []Action{{Action: Kill, Service: victim, at: at}}
+	}
+	return e
+}
+
+// Read an experiment from json_arch/<name>_chaos.json
+func Read(name string) *Experiment {
+	fn := "json_arch/" + name + "_chaos.json"
+	log.Println("Loading chaos experiment from " + fn)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	e := new(Experiment)
+	if err := json.Unmarshal(data, e); err != nil {
+		log.Fatalf("chaosmonkey: %v: %v\n", fn, err)
+	}
+	for i := range e.Actions {
+		e.Actions[i].check(fn)
+	}
+	return e
+}
+
+// check an action can be done, and parse its times
+func (a *Action) check(fn string) {
+	var err error
+	switch a.Action {
+	case Kill, Pause:
+		if a.Service == "" {
+			log.Fatalf("chaosmonkey: %v needs a service in %v\n", a.Action, fn)
+		}
+	case Gorilla:
+		if a.Zone == "" {
+			log.Fatalf("chaosmonkey: gorilla needs a zone in %v\n", fn)
+		}
+		if a.Region == "" {
+			a.Region = archaius.Conf.RegionNames[0]
+		}
+	case Kong:
+		if a.Region == "" {
+			log.Fatalf("chaosmonkey: kong needs a region in %v\n", fn)
+		}
+	case Latency, Drop:
+		if a.Zone != "" && a.Region == "" {
+			a.Region = archaius.Conf.RegionNames[0]
+		}
+		if a.target() == "" {
+			log.Fatalf("chaosmonkey: %v needs a service, zone or region in %v\n", a.Action, fn)
+		}
+		if a.Action == Latency {
+			if a.delay, err = time.ParseDuration(a.Delay); err != nil || a.delay <= 0 {
+				log.Fatalf("chaosmonkey: latency needs a delay in %v\n", fn)
 			}
 		}
+		if a.Action == Drop && (a.Percent <= 0 || a.Percent > 100) {
+			log.Fatalf("chaosmonkey: drop needs a percent in %v\n", fn)
+		}
+	case Partition:
+		if len(a.Between) != 2 {
+			log.Fatalf("chaosmonkey: partition needs two sides in %v\n", fn)
+		}
+		for i, b := range a.Between {
+			var ok bool
+			if a.Between[i], ok = side(b); !ok {
+				log.Fatalf("chaosmonkey: partition side %v isn't a region or region.zone in %v\n", b, fn)
+			}
+		}
+	default:
+		log.Fatalf("chaosmonkey: unknown action %v in %v\n", a.Action, fn)
+	}
+	if a.at, err = time.ParseDuration(a.At); err != nil {
+		log.Fatalf("chaosmonkey: bad time for %v in %v: %v\n", a.Action, fn, err)
+	}
+	if a.Duration != "" {
+		if a.duration, err = time.ParseDuration(a.Duration); err != nil {
+			log.Fatalf("chaosmonkey: bad duration for %v in %v: %v\n", a.Action, fn, err)
+		}
+	}
+	switch a.Action {
+	case Pause, Latency, Drop, Partition:
+		if a.duration <= 0 {
+			log.Fatalf("chaosmonkey: %v needs a duration in %v\n", a.Action, fn)
+		}
+	}
+}
+
+// target of a network fault, a service, region.zone or region
+func (a *Action) target() string {
+	switch {
+	case a.Service != "":
+		return a.Service
+	case a.Region != "" && a.Zone != "":
+		return a.Region + "." + a.Zone
+	}
+	return a.Region
+}
+
+// side of a partition as a region or region.zone, a zone on its own is in the first region as for a gorilla.
+// ok is false if the region or zone isn't known, as the partition would match nothing
+func side(b string) (string, bool) {
+	where := strings.Split(b, ".")
+	if len(where) == 1 && contains(archaius.Conf.ZoneNames, b) {
+		where = []string{archaius.Conf.RegionNames[0], b}
+	}
+	if len(where) > 2 || !contains(archaius.Conf.RegionNames, where[0]) || len(where) == 2 && !contains(archaius.Conf.ZoneNames, where[1]) {
+		return b, false
+	}
+	return strings.Join(where, "."), true
+}
+
+// contains is true if a name is in a list
+func contains(ns []string, n string) bool {
+	for _, m := range ns {
+		if m == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Start an experiment on the nodes that are running now, each action happens once its time has passed
+func Start(noodles map[string]chan gotocol.Message, e *Experiment) {
+	lock.Lock()
+	targets = make(map[string]chan gotocol.Message, len(noodles))
+	for n, c := range noodles {
+		targets[n] = c
+	}
+	if monkey == nil {
+		monkey = random.New("chaosmonkey")
+	}
+	lock.Unlock()
+	if len(e.Actions) > 0 {
+		log.Printf("chaosmonkey: starting %v experiment with %v actions\n", e.Name, len(e.Actions))
+	}
+	for _, a := range e.Actions {
+		a := a
+		clock.After(a.at, func() { a.do() })
+	}
+}
+
+// Add a node that was launched after the experiment started, so it can be a victim too
+func Add(name string, c chan gotocol.Message) {
+	lock.Lock()
+	if targets != nil {
+		targets[name] = c
+	}
+	lock.Unlock()
+}
+
+// Remove a node that was terminated by its scaling group
+func Remove(name string) {
+	lock.Lock()
+	delete(targets, name)
+	lock.Unlock()
+}
+
+// Stop the experiment, any actions still to come are dropped
+func Stop() {
+	lock.Lock()
+	stopped = true
+	lock.Unlock()
+}
+
+// do an action, picking its victims from the nodes that are still alive
+func (a Action) do() {
+	switch a.Action {
+	case Latency, Drop, Partition:
+		a.degrade()
+		return
+	}
+	victims := a.pick()
+	if len(victims) == 0 {
+		log.Printf("chaosmonkey %v: nothing left to act on\n", a.Action)
+		return
+	}
+	if a.Action == Pause {
+		for _, v := range victims {
+			pause(v, a.duration)
+		}
+		return
+	}
+	for i, v := range victims {
+		v := v
+		clock.After(a.duration*time.Duration(i)/time.Duration(len(victims)), func() { kill(v, a.Action) })
+	}
+}
+
+// pick the victims of an action at random, in a repeatable order
+func (a Action) pick() []string {
+	lock.Lock()
+	defer lock.Unlock()
+	if stopped {
+		return nil
+	}
+	var matches []string
+	for _, n := range gotocol.Names(targets) {
+		if dead[n] || (a.Service != "" && names.Service(n) != a.Service) ||
+			(a.Zone != "" && names.Zone(n) != a.Zone) || (a.Region != "" && names.Region(n) != a.Region) {
+			continue
+		}
+		matches = append(matches, n)
+	}
+	if a.Action == Gorilla || a.Action == Kong {
+		return matches
+	}
+	count := a.Count
+	if a.Percent > 0 {
+		count = int(math.Ceil(a.Percent * float64(len(matches)) / 100))
+	}
+	if count < 1 {
+		count = 1
+	}
+	var victims []string
+	for len(victims) < count && len(matches) > 0 {
+		i := monkey.Intn(len(matches))
+		victims = append(victims, matches[i])
+		matches = append(matches[:i], matches[i+1:]...)
+	}
+	return victims
+}
+
+// kill a node, traced as a flow from chaosmonkey and logged by edda
+func kill(node, action string) {
+	lock.Lock()
+	if dead[node] || stopped {
+		lock.Unlock()
+		return
+	}
+	dead[node] = true
+	c := targets[node]
+	lock.Unlock()
+	ctx := gotocol.NewTrace()
+	record(gotocol.Message{gotocol.Chaos, nil, clock.Now(), ctx, action + " " + node})
+	gotocol.Message{gotocol.Goodbye, nil, clock.Now(), ctx, "chaosmonkey"}.GoSend(c)
+	log.Printf("chaosmonkey %v: %v\n", action, node)
+}
+
+// pause a node for a while, the end of the pause is logged as a resume
+func pause(node string, d time.Duration) {
+	lock.Lock()
+	c := targets[node]
+	lock.Unlock()
+	gotocol.Pause(c, d)
+	record(gotocol.Message{gotocol.Chaos, nil, clock.Now(), gotocol.NewTrace(), Pause + " " + node})
+	log.Printf("chaosmonkey pause: %v for %v\n", node, d)
+	clock.After(d, func() {
+		lock.Lock()
+		over := stopped
+		lock.Unlock()
+		if over {
+			return
+		}
+		record(gotocol.Message{gotocol.Chaos, nil, clock.Now(), gotocol.NewTrace(), Resume + " " + node})
+	})
+}
+
+// degrade the network for the duration, the fault heals itself
+func (a Action) degrade() {
+	lock.Lock()
+	over := stopped
+	lock.Unlock()
+	if over {
+		return
+	}
+	f := latency.Fault{Target: a.target(), Delay: a.delay, Loss: a.Percent / 100, Until: clock.Now().Add(a.duration)}
+	if a.Action == Partition {
+		f = latency.Fault{Target: a.Between[0], Other: a.Between[1], Partition: true, Until: f.Until}
+	}
+	where := f.Target
+	if f.Partition {
+		where += "|" + f.Other
+	}
+	latency.Inject(f)
+	record(gotocol.Message{gotocol.Chaos, nil, clock.Now(), gotocol.NewTrace(), a.Action + " " + where})
+	log.Printf("chaosmonkey %v: %v for %v\n", a.Action, where, a.duration)
+	clock.After(a.duration, func() {
+		lock.Lock()
+		over := stopped
+		lock.Unlock()
+		if !over {
+			record(gotocol.Message{gotocol.Chaos, nil, clock.Now(), gotocol.NewTrace(), Heal + " " + where})
+		}
+	})
+}
+
+// record an action in the flows and the graph
+func record(msg gotocol.Message) {
+	flow.AnnotateSend(msg, "chaosmonkey")
+	if edda.Logchan != nil {
+		edda.Logchan <- msg
 	}
 }
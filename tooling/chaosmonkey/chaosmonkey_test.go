@@ -0,0 +1,47 @@
+package chaosmonkey
+
+import (
+	"github.com/adrianco/spigo/tooling/archaius"
+	"testing"
+)
+
+// Test a network fault in a zone defaults to the first region, as a gorilla does
+func TestTarget(t *testing.T) {
+	for _, a := range []Action{
+		{Action: Latency, At: "1s", Duration: "1s", Delay: "10ms", Zone: "zoneB"},
+		{Action: Drop, At: "1s", Duration: "1s", Percent: 50, Zone: "zoneB"},
+		{Action: Gorilla, At: "1s", Zone: "zoneB"},
+	} {
+		a.check("test")
+		if a.Region != archaius.Conf.RegionNames[0] {
+			t.Errorf("%v in a zone got region %v", a.Action, a.Region)
+		}
+	}
+	a := Action{Action: Latency, At: "1s", Duration: "1s", Delay: "10ms", Zone: "zoneB"}
+	a.check("test")
+	if a.target() != archaius.Conf.RegionNames[0]+".zoneB" {
+		t.Errorf("latency in a zone targets %v", a.target())
+	}
+	a = Action{Action: Drop, At: "1s", Duration: "1s", Percent: 50, Region: "eu-west-1", Zone: "zoneA"}
+	a.check("test")
+	if a.target() != "eu-west-1.zoneA" {
+		t.Errorf("drop in a region and zone targets %v", a.target())
+	}
+}
+
+// Test the sides of a partition default a zone on its own to the first region, and unknown locations are refused
+func TestSides(t *testing.T) {
+	a := Action{Action: Partition, At: "1s", Duration: "1s", Between: []string{"zoneA", "eu-west-1.zoneB"}}
+	a.check("test")
+	if a.Between[0] != archaius.Conf.RegionNames[0]+".zoneA" || a.Between[1] != "eu-west-1.zoneB" {
+		t.Errorf("partition between %v", a.Between)
+	}
+	if b, ok := side("us-west-2"); !ok || b != "us-west-2" {
+		t.Errorf("region side %v", b)
+	}
+	for _, b := range []string{"zoneD", "us-east", "us-east-1.zoneD", "us-east-1.zoneA.extra"} {
+		if _, ok := side(b); ok {
+			t.Errorf("partition side %v matches nothing", b)
+		}
+	}
+}
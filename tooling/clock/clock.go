@@ -0,0 +1,126 @@
+// Package clock provides simulation time, either the wall clock or a deterministic virtual clock
+// In virtual time a discrete event scheduler runs every event in time order, so a run finishes as fast
+// as the CPU allows and repeats exactly given the same architecture and configuration
+package clock
+
+import (
+	"container/heap"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"sync"
+	"time"
+)
+
+// Epoch is the start of virtual time, fixed so that timestamps repeat from run to run
+var Epoch = time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// an event to fire at a point in virtual time, seq keeps events at the same time in the order they were scheduled
+type event struct {
+	at   time.Time
+	seq  uint64
+	fire func()
+}
+
+// eventQueue is a heap of events ordered by time then sequence
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q eventQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+var (
+	lock  sync.Mutex // protects the virtual clock state below
+	now   = Epoch    // current virtual time
+	seq   uint64     // sequence number for the next event
+	queue eventQueue // pending events
+)
+
+// Virtual reports whether the simulation is running in virtual time
+func Virtual() bool {
+	return archaius.Conf.VirtualTime
+}
+
+// Now returns the current simulation time
+func Now() time.Time {
+	if !Virtual() {
+		return time.Now()
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return now
+}
+
+// Since returns the simulation time elapsed since t
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
+
+// After schedules an event to fire once d has elapsed, events fire on a single goroutine in virtual time
+func After(d time.Duration, fire func()) {
+	if !Virtual() {
+		if d <= 0 {
+			go fire()
+		} else {
+			time.AfterFunc(d, fire)
+		}
+		return
+	}
+	if d < 0 {
+		d = 0
+	}
+	lock.Lock()
+	seq++
+	heap.Push(&queue, &event{now.Add(d), seq, fire})
+	lock.Unlock()
+}
+
+// Step fires the next event in virtual time, advancing the clock to it, returns false if nothing is pending
+func Step() bool {
+	lock.Lock()
+	if len(queue) == 0 {
+		lock.Unlock()
+		return false
+	}
+	e := heap.Pop(&queue).(*event)
+	if e.at.After(now) {
+		now = e.at
+	}
+	lock.Unlock()
+	e.fire()
+	return true
+}
+
+// Sleep lets simulation time pass, in virtual time it runs all the events due in the next d then returns
+func Sleep(d time.Duration) {
+	if !Virtual() {
+		time.Sleep(d)
+		return
+	}
+	lock.Lock()
+	until := now.Add(d)
+	lock.Unlock()
+	for {
+		lock.Lock()
+		due := len(queue) > 0 && !queue[0].at.After(until)
+		lock.Unlock()
+		if !due || !Step() {
+			break
+		}
+	}
+	lock.Lock()
+	if until.After(now) {
+		now = until
+	}
+	lock.Unlock()
+}
@@ -0,0 +1,36 @@
+package clock
+
+import (
+	"github.com/adrianco/spigo/tooling/archaius"
+	"testing"
+	"time"
+)
+
+// Test that virtual time fires events in time order and sleeps without waiting
+func TestVirtual(t *testing.T) {
+	archaius.Conf.VirtualTime = true
+	defer func() { archaius.Conf.VirtualTime = false }()
+	start := Now()
+	var fired []int
+	After(2*time.Second, func() { fired = append(fired, 2) })
+	After(time.Second, func() { fired = append(fired, 1) })
+	After(time.Second, func() { fired = append(fired, 11) })
+	After(time.Minute, func() { fired = append(fired, 60) })
+	wall := time.Now()
+	Sleep(10 * time.Second)
+	if time.Since(wall) > time.Second {
+		t.Fail()
+	}
+	if len(fired) != 3 || fired[0] != 1 || fired[1] != 11 || fired[2] != 2 {
+		t.Errorf("events fired out of order: %v", fired)
+	}
+	if Since(start) != 10*time.Second {
+		t.Errorf("clock advanced %v", Since(start))
+	}
+	if !Step() || len(fired) != 4 || Since(start) != time.Minute {
+		t.Errorf("step fired %v at %v", fired, Since(start))
+	}
+	if Step() {
+		t.Fail()
+	}
+}
@@ -2,9 +2,11 @@
 package collect
 
 import (
+	"expvar"
 	"fmt"
 	. "github.com/adrianco/goguesstimate/guesstimate"
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/names"
 	//"github.com/go-kit/kit/metrics"
 	//"github.com/go-kit/kit/metrics/expvar"
@@ -13,7 +15,9 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"io/ioutil"
 	"strings"
@@ -21,8 +25,8 @@ import (
 )
 
 const (
-	maxHistObservable = 1000000 // one millisecond
-	sampleCount       = 1000    // data points will be sampled 5000 times to build a distribution by guesstimate
+	maxHistObservable = 1000000000 // one second, room for cross region network latency
+	sampleCount       = 1000       // data points will be sampled 5000 times to build a distribution by guesstimate
 )
 
 type ArchObject struct {
@@ -40,6 +44,14 @@ type ArchObject struct {
 		GuesstimateValue string `json:"guesstimateValue,omitempty"`
 	} `json:"services"`
 }
+
+// byName sorts histograms
+type byName []*generic.Histogram
+
+func (a byName) Len() int           { return len(a) }
+func (a byName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
 //save a sample of the actual data for use by guesstimate
 var sampleMap map[*generic.Histogram][]int64
 var sampleLock sync.Mutex
@@ -68,13 +80,300 @@ func Measure(h *generic.Histogram, d time.Duration) {
 		} else {
 			h.Observe(float64(d))
 		}
-		sampleLock.Lock()
-		s := sampleMap[h]
-		if s != nil && len(s) < sampleCount {
-			sampleMap[h] = append(s, int64(d))
-			sampleLock.Unlock()
+		sample(h, d)
+	}
+}
+
+// Elapsed adds a measurement of something slower than a request, such as recovering from a failure, it isn't limited to a second
+func Elapsed(h *generic.Histogram, d time.Duration) {
+	if h != nil && archaius.Conf.Collect {
+		h.Observe(float64(d))
+		sample(h, d)
+	}
+}
+
+// sample a measurement for guesstimate and for anyone watching recent measurements
+func sample(h *generic.Histogram, d time.Duration) {
+	sampleLock.Lock()
+	s := sampleMap[h]
+	if s != nil && len(s) < sampleCount {
+		sampleMap[h] = append(s, int64(d))
+	}
+	for _, w := range watched {
+		if strings.HasSuffix(h.Name, w) && len(recent[w]) < recentCount {
+			recent[w] = append(recent[w], float64(d))
+		}
+	}
+	sampleLock.Unlock()
+}
+
+// measurements kept since they were last looked at, for histograms with watched name suffixes
+const recentCount = 100000
+
+var (
+	watched []string
+	recent  = make(map[string][]float64)
+)
+
+// Recent measurements of the histograms with names ending in suffix, since the last time they were asked for
+// nothing is kept until the first time they are asked for
+func Recent(suffix string) []float64 {
+	sampleLock.Lock()
+	defer sampleLock.Unlock()
+	r, ok := recent[suffix]
+	if !ok {
+		watched = append(watched, suffix)
+	}
+	recent[suffix] = make([]float64, 0, len(r))
+	return r
+}
+
+// Value of a counter or gauge by name, ok is false if it hasn't been made
+func Value(name string) (float64, bool) {
+	sampleLock.Lock()
+	defer sampleLock.Unlock()
+	if c, ok := counters[name]; ok {
+		return c.Value(), true
+	}
+	if g, ok := gauges[name]; ok {
+		return g.Value(), true
+	}
+	return 0, false
+}
+
+// when instances died, and histograms shared by all the instances of a service, such as how long callers kept routing to them afterwards
+var (
+	died   = make(map[string]time.Time)
+	shared = make(map[string]*generic.Histogram)
+)
+
+// Died records when an instance died or was terminated, so callers can measure how long they kept routing to it
+func Died(name string, t time.Time) {
+	if !archaius.Conf.Collect {
+		return
+	}
+	sampleLock.Lock()
+	died[name] = t
+	sampleLock.Unlock()
+}
+
+// Stale measures how long a caller kept routing to an instance after it died, when the caller forgets it,
+// the measurements for each service are in <service>_stale
+func Stale(name string, t time.Time) {
+	if !archaius.Conf.Collect {
+		return
+	}
+	sampleLock.Lock()
+	d, ok := died[name]
+	sampleLock.Unlock()
+	if ok {
+		Elapsed(ServiceHist(name, "_stale"), t.Sub(d))
+	}
+}
+
+// ServiceHist is the histogram <service><suffix> shared by all the instances of the service of a named instance, made the first time it's used
+func ServiceHist(name, suffix string) *generic.Histogram {
+	if !archaius.Conf.Collect {
+		return nil
+	}
+	n := names.Service(name) + suffix
+	sampleLock.Lock()
+	defer sampleLock.Unlock()
+	h := shared[n]
+	if h == nil {
+		h = generic.NewHistogram(n, 100)
+		shared[n] = h
+		if sampleMap == nil {
+			sampleMap = make(map[*generic.Histogram][]int64)
+		}
+		sampleMap[h] = make([]int64, 0, sampleCount)
+	}
+	return h
+}
+
+// ServiceCount adds one to the counter <service><suffix> shared by all the instances of the service of a named instance
+func ServiceCount(name, suffix string) {
+	if !archaius.Conf.Collect {
+		return
+	}
+	Count(counter(names.Service(name) + suffix))
+}
+
+// SaveServiceHists saves the histograms shared by the instances of each service to csv_metrics/<arch>_<service><suffix>.csv
+func SaveServiceHists() {
+	sampleLock.Lock()
+	ss := make([]string, 0, len(shared))
+	for s := range shared {
+		ss = append(ss, s)
+	}
+	sampleLock.Unlock()
+	sort.Strings(ss)
+	for _, s := range ss {
+		SaveHist(shared[s], names.MakeContainer(archaius.Conf.Arch, "*", "*", "", s, "", "", s, ""), "")
+	}
+}
+
+// service wide gauges are the sum of a share from each instance, and are kept as a series of the times the sum changed
+var (
+	shares = make(map[string]map[string]int)
+	series = make(map[string][]point)
+	began  time.Time
+)
+
+// point in a series, the time since the run began and the value from then on
+type point struct {
+	at time.Duration
+	v  int
+}
+
+// Begin the run, series are timed from here
+func Begin() {
+	sampleLock.Lock()
+	began = clock.Now()
+	sampleLock.Unlock()
+}
+
+// ServiceGauge sets the share of a named instance in the gauge <service><suffix>, the sum of the shares of every
+// instance of the service, which is saved over time to csv_metrics/<arch>_<service><suffix>.csv
+func ServiceGauge(name, suffix string, v int) {
+	if !archaius.Conf.Collect || atomic.LoadInt32(&frozen) != 0 {
+		return
+	}
+	n := names.Service(name) + suffix
+	sampleLock.Lock()
+	if shares[n] == nil {
+		shares[n] = make(map[string]int)
+	}
+	shares[n][name] = v
+	total := 0
+	for _, s := range shares[n] {
+		total += s
+	}
+	at := clock.Now().Sub(began)
+	s := series[n]
+	switch {
+	case len(s) > 0 && s[len(s)-1].at == at:
+		s[len(s)-1].v = total
+	case len(s) == 0 || s[len(s)-1].v != total:
+		series[n] = append(s, point{at, total})
+	}
+	g := gauges[n]
+	if g == nil {
+		g = generic.NewGauge(n)
+		gauges[n] = g
+		if expvar.Get(n) == nil {
+			expvar.Publish(n, expvar.Func(func() interface{} { return g.Value() }))
+		}
+	}
+	sampleLock.Unlock()
+	g.Set(float64(total))
+}
+
+// SaveSeries saves each service wide gauge over time to csv_metrics/<arch>_<service><suffix>.csv
+func SaveSeries() {
+	sampleLock.Lock()
+	defer sampleLock.Unlock()
+	ns := make([]string, 0, len(series))
+	for n := range series {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	for _, n := range ns {
+		file, err := os.Create("csv_metrics/" + archaius.Conf.Arch + "_" + n + ".csv")
+		if err != nil {
+			log.Fatalf("Save series %v: %v\n", n, err)
+		}
+		file.WriteString("seconds,value\n")
+		for _, p := range series[n] {
+			file.WriteString(fmt.Sprintf("%.3f,%v\n", p.at.Seconds(), p.v))
+		}
+		file.Close()
+	}
+}
+
+// counters and gauges by name, saved at the end of the run and published to expvar
+var counters = make(map[string]*generic.Counter)
+var gauges = make(map[string]*generic.Gauge)
+
+// NewCounter creates a new counter
+func NewCounter(name string) *generic.Counter {
+	if name == "" || !archaius.Conf.Collect {
+		return nil
+	}
+	c := generic.NewCounter(name)
+	sampleLock.Lock()
+	counters[name] = c
+	sampleLock.Unlock()
+	if expvar.Get(name) == nil {
+		expvar.Publish(name, expvar.Func(func() interface{} { return c.Value() }))
+	}
+	return c
+}
+
+// NewGauge creates a new gauge
+func NewGauge(name string) *generic.Gauge {
+	if name == "" || !archaius.Conf.Collect {
+		return nil
+	}
+	g := generic.NewGauge(name)
+	sampleLock.Lock()
+	gauges[name] = g
+	sampleLock.Unlock()
+	if expvar.Get(name) == nil {
+		expvar.Publish(name, expvar.Func(func() interface{} { return g.Value() }))
+	}
+	return g
+}
+
+// Count adds one to a counter
+func Count(c *generic.Counter) {
+	if c != nil {
+		c.Add(1)
+	}
+}
+
+// frozen is set once the run is over, so gauges keep their values while everything shuts down
+var frozen int32
+
+// Freeze the gauges at the end of the run
+func Freeze() {
+	atomic.StoreInt32(&frozen, 1)
+}
+
+// Gauge sets the current value of a gauge
+func Gauge(g *generic.Gauge, v int) {
+	if g != nil && atomic.LoadInt32(&frozen) == 0 {
+		g.Set(float64(v))
+	}
+}
+
+// Response counts a response sent by an instance against its service, with an error status if it failed
+// so that error rates can be worked out from <service>_errors over <service>_responses
+func Response(name, status string) {
+	if !archaius.Conf.Collect {
+		return
+	}
+	s := names.Service(name)
+	Count(counter(s + "_responses"))
+	if status != "" {
+		Count(counter(s + "_errors"))
+		Count(counter(s + "_errors_" + status))
+	}
+}
+
+// counter shared by all the instances of a service, made the first time it's used
+func counter(name string) *generic.Counter {
+	sampleLock.Lock()
+	defer sampleLock.Unlock()
+	c := counters[name]
+	if c == nil {
+		c = generic.NewCounter(name)
+		counters[name] = c
+		if expvar.Get(name) == nil {
+			expvar.Publish(name, expvar.Func(func() interface{} { return c.Value() }))
 		}
 	}
+	return c
 }
 
 // SaveHist passes in name because metrics.Histogram blocks expvar.Histogram.Name()
@@ -82,7 +381,7 @@ func SaveHist(h *generic.Histogram, name, suffix string) {
 	if archaius.Conf.Collect {
 		file, err := os.Create("csv_metrics/" + names.Arch(name) + "_" + names.Instance(name) + suffix + ".csv")
 		if err != nil {
-			log.Fatal("Save histogram %v: %v\n", name, err)
+			log.Fatalf("Save histogram %v: %v\n", name, err)
 		}
 		//metrics.PrintDistribution(file, h)
 		h.Print(file)
@@ -124,7 +423,13 @@ func SaveAllGuesses(name string) {
 	row := 1
 	col := 1
 	seq := []string{"", "A", "B", "C", "D", "E", "F", "G", "H", "I", "J", "K", "L", "M", "N", "O", "P", "Q", "R", "S", "T", "U", "V", "W", "X", "Y", "Z"}
-	for h, data := range sampleMap {
+	hists := make([]*generic.Histogram, 0, len(sampleMap))
+	for h := range sampleMap {
+		hists = append(hists, h)
+	}
+	sort.Sort(byName(hists)) // save in a repeatable order
+	for _, h := range hists {
+		data := sampleMap[h]
 
 		UseCustomGuesstimate := false
 		GuesstimateType := "DATA"
@@ -169,16 +474,34 @@ func SaveAllGuesses(name string) {
 	SaveGuess(g, "json_metrics/"+names.Arch(name))
 }
 
-// Save currently does nothing
+// Save the counters and gauges to csv_metrics/<arch>_metrics.csv
 func Save() {
-	//	if archaius.Conf.Collect {
-	//		file, _ := os.Create("csv_metrics/" + archaius.Conf.Arch + "_metrics.csv")
-	//		counters, gauges := metrics.Snapshot()
-	//		cj, _ := json.Marshal(counters)
-	//		gj, _ := json.Marshal(gauges)
-	//		file.WriteString(fmt.Sprintf("{\n\"counters\":%v\n\"gauges\":%v\n}\n", string(cj), string(gj)))
-	//		file.Close()
-	//	}
+	if !archaius.Conf.Collect || len(counters)+len(gauges) == 0 {
+		return
+	}
+	file, err := os.Create("csv_metrics/" + archaius.Conf.Arch + "_metrics.csv")
+	if err != nil {
+		log.Fatalf("Save metrics: %v\n", err)
+	}
+	sampleLock.Lock()
+	values := make(map[string]float64, len(counters)+len(gauges))
+	for n, c := range counters {
+		values[n] = c.Value()
+	}
+	for n, g := range gauges {
+		values[n] = g.Value()
+	}
+	sampleLock.Unlock()
+	ns := make([]string, 0, len(values))
+	for n := range values {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	file.WriteString("name,value\n")
+	for _, n := range ns {
+		file.WriteString(fmt.Sprintf("%v,%v\n", n, values[n]))
+	}
+	file.Close()
 }
 
 // Serve on a port
@@ -187,8 +510,23 @@ func Serve(port int) {
 	if err != nil {
 		log.Fatal(err)
 	}
+	http.HandleFunc("/config", config)
 	go func() {
-		log.Printf("HTTP metrics now available at localhost:%v/debug/vars", port)
+		log.Printf("HTTP metrics now available at localhost:%v/debug/vars, properties can be changed at /config?key=chat&value=5ms", port)
 		http.Serve(sock, nil)
 	}()
 }
+
+// config sets a property if there's a key and value, then returns all the properties as json
+// a value that isn't valid for its key is a bad request, and the old value is kept
+func config(w http.ResponseWriter, r *http.Request) {
+	if key := r.FormValue("key"); key != "" {
+		if err := archaius.Set(key, r.FormValue("value")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	data, _ := json.MarshalIndent(archaius.Properties(), "", "    ")
+	w.Write(data)
+}
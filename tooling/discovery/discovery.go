@@ -0,0 +1,156 @@
+// Package discovery is named after the NetflixOSS eureka client, an instance keeps a local cache of the registry
+// entries for the services it depends on, and refreshes it from one registry in each region, starting with a full
+// fetch then fetching the changes since the version it has. Until the next refresh it routes to what its cache says.
+package discovery
+
+import (
+	"fmt"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"github.com/adrianco/spigo/tooling/names"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Cache of the registries
+type Cache struct {
+	chans    map[string]chan gotocol.Message // how to talk to the instances the registries told us about
+	members  map[string]map[string]bool      // online instances of the dependencies in each registry
+	versions map[string]int                  // version each registry was fetched up to, zero fetches everything
+	ticks    int                             // eureka polls since the last refresh
+}
+
+// MakeCache makes an empty cache
+func MakeCache() *Cache {
+	var c Cache
+	c.chans = make(map[string]chan gotocol.Message)
+	c.members = make(map[string]map[string]bool)
+	c.versions = make(map[string]int)
+	return &c
+}
+
+// Remember how to talk to an instance
+func (c *Cache) Remember(name string, ch chan gotocol.Message) {
+	c.chans[name] = ch
+}
+
+// Chan of an instance, nil if it isn't known
+func (c *Cache) Chan(name string) chan gotocol.Message {
+	return c.chans[name]
+}
+
+// Full fetch of everything from every registry next time, after a new dependency is added
+func (c *Cache) Full() {
+	for r := range c.versions {
+		c.versions[r] = 0
+	}
+}
+
+// Due counts a eureka poll, it's time to refresh every eureka.refresh, which defaults to every poll
+func (c *Cache) Due(name string) bool {
+	ep, _ := time.ParseDuration(archaius.Conf.EurekaPoll)
+	n := 1
+	if ep > 0 {
+		n = int(archaius.Duration(name, "eureka.refresh", ep) / ep)
+	}
+	c.ticks++
+	if c.ticks < n {
+		return false
+	}
+	c.ticks = 0
+	return true
+}
+
+// Fetch the changes to the services since the version the cache has, from one registry in each region,
+// preferring the registry in the same zone
+func (c *Cache) Fetch(services []string, name string, listener chan gotocol.Message, eureka map[string]chan gotocol.Message) {
+	if len(services) == 0 {
+		return
+	}
+	for _, r := range registries(name, eureka) {
+		gotocol.Send(eureka[r], gotocol.Message{gotocol.Fetch, listener, clock.Now(), gotocol.NilContext, fmt.Sprintf("%v %v", c.versions[r], strings.Join(services, " "))})
+	}
+}
+
+// registries to fetch from, one for each region
+func registries(name string, eureka map[string]chan gotocol.Message) []string {
+	regions := make(map[string]string)
+	for _, r := range gotocol.Names(eureka) { // in order, so the first in a region is chosen if none are in my zone
+		region := names.Region(r)
+		if regions[region] == "" || names.Zone(r) == names.Zone(name) {
+			regions[region] = r
+		}
+	}
+	rs := make([]string, 0, len(regions))
+	for _, r := range regions {
+		rs = append(rs, r)
+	}
+	sort.Strings(rs)
+	return rs
+}
+
+// Update the cache from a registry's reply to a fetch, returning the instances that came online, and the ones that went
+// offline in every registry. If the count of online instances doesn't match what the registry has, like the hash
+// of the registry that eureka checks, some changes were missed and the next fetch gets everything.
+func (c *Cache) Update(msg gotocol.Message) (online, offline []string) {
+	fields := strings.Fields(msg.Intention)
+	if len(fields) < 4 {
+		return nil, nil
+	}
+	r := fields[0]
+	var version, count int
+	fmt.Sscanf(fields[1], "%d", &version)
+	fmt.Sscanf(fields[3], "%d", &count)
+	old := c.members[r]
+	members := make(map[string]bool, count)
+	if fields[2] != "full" {
+		for n := range old {
+			members[n] = true
+		}
+	}
+	for _, f := range fields[4:] {
+		if strings.HasPrefix(f, "+") {
+			members[f[1:]] = true
+		} else {
+			delete(members, f[1:])
+		}
+	}
+	c.members[r] = members
+	c.versions[r] = version
+	if len(members) != count {
+		c.versions[r] = 0
+	}
+	for _, n := range sortedKeys(members) {
+		if !old[n] {
+			online = append(online, n)
+		}
+	}
+	for _, n := range sortedKeys(old) {
+		if !c.Member(n) {
+			offline = append(offline, n)
+		}
+	}
+	return online, offline
+}
+
+// Member is true if any registry has the instance online
+func (c *Cache) Member(name string) bool {
+	for _, m := range c.members {
+		if m[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedKeys of a set, so updates are repeatable
+func sortedKeys(m map[string]bool) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
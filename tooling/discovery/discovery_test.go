@@ -0,0 +1,58 @@
+package discovery
+
+import (
+	"fmt"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"testing"
+	"time"
+)
+
+func reply(intention string) gotocol.Message {
+	return gotocol.Message{gotocol.Fetch, nil, time.Now(), gotocol.NilContext, intention}
+}
+
+// Test applying full and delta fetches from two registries
+func TestUpdate(t *testing.T) {
+	c := MakeCache()
+	on, off := c.Update(reply("east 3 full 2 +a +b"))
+	if fmt.Sprint(on, off) != "[a b] []" || c.versions["east"] != 3 {
+		t.Errorf("full fetch: %v %v version %v", on, off, c.versions["east"])
+	}
+	c.Update(reply("west 1 full 1 +b"))
+	on, off = c.Update(reply("east 5 delta 1 -a -b +c"))
+	if fmt.Sprint(on, off) != "[c] [a]" { // b is still in the west registry
+		t.Errorf("delta fetch: %v %v", on, off)
+	}
+	if !c.Member("b") || c.Member("a") || c.versions["east"] != 5 {
+		t.Error("membership")
+	}
+	c.Update(reply("east 6 delta 3"))
+	if c.versions["east"] != 0 {
+		t.Error("a count that doesn't match should make the next fetch full")
+	}
+	on, off = c.Update(reply("east 6 full 1 +d"))
+	if fmt.Sprint(on, off) != "[d] [c]" {
+		t.Errorf("full fetch after a mismatch: %v %v", on, off)
+	}
+	c.Full()
+	if c.versions["west"] != 0 {
+		t.Error("full")
+	}
+}
+
+// Test that one registry in each region is chosen, preferring the same zone
+func TestRegistries(t *testing.T) {
+	eureka := make(map[string]chan gotocol.Message)
+	for _, n := range []string{
+		"arch.us-east-1.zoneA..eureka00...eureka.eureka",
+		"arch.us-east-1.zoneB..eureka01...eureka.eureka",
+		"arch.eu-west-1.zoneA..eureka02...eureka.eureka",
+		"arch.eu-west-1.zoneC..eureka03...eureka.eureka",
+	} {
+		eureka[n] = nil
+	}
+	rs := registries("arch.us-east-1.zoneB..homepage00...homepage.karyon", eureka)
+	if fmt.Sprint(rs) != "[arch.eu-west-1.zoneA..eureka02...eureka.eureka arch.us-east-1.zoneB..eureka01...eureka.eureka]" {
+		t.Errorf("registries %v", rs)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/collect"
 	"github.com/adrianco/spigo/tooling/dhcp"
 	"github.com/adrianco/spigo/tooling/gotocol"
@@ -28,6 +29,8 @@ const (
 	SR                    // server receive
 	SS                    // server send
 	CR                    // client receive
+	TO                    // timeout, gave up waiting for a response
+	RT                    // retry, sent the request again
 	Unknown               // something went wrong
 )
 
@@ -42,6 +45,10 @@ func (v Values) String() string {
 		return "ss"
 	case CR:
 		return "cr"
+	case TO:
+		return "timeout"
+	case RT:
+		return "retry"
 	default:
 		return "unknown"
 	}
@@ -96,7 +103,9 @@ func annotate(msg gotocol.Message, name string, t time.Time, resp, others Values
 	annotation.Imp = msg.Imposition.String()
 	annotation.Intent = msg.Intention
 	annotation.Timestamp = t.UnixNano()
-	if msg.Imposition == gotocol.GetResponse {
+	if msg.Imposition == gotocol.Timeout {
+		annotation.Value = TO.String()
+	} else if msg.Imposition == gotocol.GetResponse || msg.Imposition == gotocol.Error {
 		annotation.Value = resp.String()
 	} else {
 		annotation.Value = others.String()
@@ -129,9 +138,27 @@ func AnnotateSend(msg gotocol.Message, name string) {
 	flowlock.Lock()
 	flowmap[msg.Ctx.Trace] = append(flowmap[msg.Ctx.Trace], annotate(msg, name, msg.Sent, SS, CS))
 	flowlock.Unlock()
+	switch msg.Imposition {
+	case gotocol.GetResponse:
+		collect.Response(name, "")
+	case gotocol.Error:
+		collect.Response(name, msg.Intention)
+	case gotocol.Timeout:
+		collect.Response(name, TO.String())
+	}
 	return
 }
 
+// Annotate a flow with an event such as a retry
+func Annotate(msg gotocol.Message, name string, v Values) {
+	if !archaius.Conf.Collect {
+		return
+	}
+	flowlock.Lock()
+	flowmap[msg.Ctx.Trace] = append(flowmap[msg.Ctx.Trace], annotate(msg, name, clock.Now(), v, v))
+	flowlock.Unlock()
+}
+
 // End a flow, flushing output and freeing the request id to keep the map smaller
 func End(msg gotocol.Message, resphist, servhist, rthist *generic.Histogram) {
 	if !archaius.Conf.Collect {
@@ -192,14 +219,20 @@ func Shutdown() {
 	}
 	log.Printf("Flushing flows to %v\n", file.Name())
 	file.WriteString("[\n")
+	traces := make([]int, 0, len(flowmap))
+	for t := range flowmap {
+		traces = append(traces, int(t))
+	}
+	sort.Ints(traces) // write traces in a repeatable order
 	comma := false
-	for c, f := range flowmap {
+	for _, t := range traces {
 		if comma {
 			file.WriteString(",\n")
 		} else {
 			comma = true
 		}
-		Flush(c, f)
+		c := gotocol.TraceContextType(t)
+		Flush(c, flowmap[c])
 	}
 	file.WriteString("\n]\n")
 	file.Close()
@@ -262,13 +295,21 @@ type zipkinannotation struct {
 	Value     string         `json:"value"`
 }
 
+// binary annotation for zipkin, used for the error tag
+type zipkinbinaryannotation struct {
+	Key      string         `json:"key"`
+	Value    string         `json:"value"`
+	Endpoint zipkinendpoint `json:"endpoint"`
+}
+
 // trace for zipkin
 type zipkinspan struct {
-	Traceid     string             `json:"traceId"`
-	Name        string             `json:"name"`
-	Id          string             `json:"id"`
-	ParentId    string             `json:"parentId,omitempty"`
-	Annotations []zipkinannotation `json:"annotations"`
+	Traceid           string                   `json:"traceId"`
+	Name              string                   `json:"name"`
+	Id                string                   `json:"id"`
+	ParentId          string                   `json:"parentId,omitempty"`
+	Annotations       []zipkinannotation       `json:"annotations"`
+	BinaryAnnotations []zipkinbinaryannotation `json:"binaryAnnotations,omitempty"`
 }
 
 // WriteZip stores zipkin as json
@@ -288,7 +329,7 @@ func Flush(t gotocol.TraceContextType, trace []*spannotype) {
 	var zip zipkinspan
 	var ctx string
 	n := -1
-	sort.Sort(ByCtx(trace))
+	sort.Stable(ByCtx(trace)) // annotations can share a timestamp in virtual time, so keep them in the order they happened
 	for _, a := range trace {
 		//fmt.Println(*a)
 		if ctx != a.Ctx { // new span
@@ -296,6 +337,7 @@ func Flush(t gotocol.TraceContextType, trace []*spannotype) {
 				WriteZip(zip)
 				file.WriteString(",\n")
 				zip.Annotations = nil
+				zip.BinaryAnnotations = nil
 			}
 			n++
 			zip.Traceid = fmt.Sprintf("%016d", t) // pad id's to 16 characters to keep zipkin happy
@@ -315,14 +357,30 @@ func Flush(t gotocol.TraceContextType, trace []*spannotype) {
 		ann.Timestamp = a.Timestamp / 1000 // convert from UnixNano to Microseconds
 		ann.Value = a.Value
 		zip.Annotations = append(zip.Annotations, ann)
+		if a.Imp == gotocol.Chaos.String() { // tag the span with what chaosmonkey did
+			zip.BinaryAnnotations = append(zip.BinaryAnnotations, zipkinbinaryannotation{"chaos", a.Intent, ann.Endpoint})
+		} else if a.Imp == gotocol.Stream.String() && a.Value == CS.String() { // tag the span with the progress of the stream
+			zip.BinaryAnnotations = append(zip.BinaryAnnotations, zipkinbinaryannotation{"stream", a.Intent, ann.Endpoint})
+		} else if zip.BinaryAnnotations == nil { // tag the span with the first error in it
+			if a.Imp == gotocol.Error.String() {
+				zip.BinaryAnnotations = []zipkinbinaryannotation{{"error", a.Intent, ann.Endpoint}}
+			} else if a.Value == TO.String() {
+				zip.BinaryAnnotations = []zipkinbinaryannotation{{"error", TO.String(), ann.Endpoint}}
+			}
+		}
 	}
 	WriteZip(zip)
 }
 
 // Instrument common code for requests
 func Instrument(msg gotocol.Message, name string, hist *generic.Histogram) {
-	received := time.Now()
-	collect.Measure(hist, received.Sub(msg.Sent))
+	if msg.Imposition == gotocol.Barrier {
+		return // only used to pace virtual time
+	}
+	received := clock.Now()
+	if msg.Imposition != gotocol.Timeout || msg.ResponseChan != nil { // a timer set by the actor itself didn't cross the network
+		collect.Measure(hist, received.Sub(msg.Sent))
+	}
 	if archaius.Conf.Msglog {
 		log.Printf("%v: %v\n", name, msg)
 	}
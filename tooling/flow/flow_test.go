@@ -2,9 +2,13 @@
 package flow
 
 import (
+	"expvar"
 	"fmt"
 	"github.com/adrianco/spigo/tooling/archaius"
 	"github.com/adrianco/spigo/tooling/gotocol"
+	"github.com/adrianco/spigo/tooling/names"
+	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 )
@@ -49,3 +53,30 @@ func TestFlow(t *testing.T) {
 	fmt.Println("\nWrite all remaining flows in order to file")
 	Shutdown()
 }
+
+// Test that error responses are tagged in zipkin and counted against the service that sent them
+func TestError(t *testing.T) {
+	archaius.Conf.Collect = true
+	archaius.Conf.Arch = "test"
+	caller := names.Make("test", "us", "a", "homepage", "karyon", 0)
+	callee := names.Make("test", "us", "a", "subscriber", "staash", 0)
+	m1 := gotocol.Message{gotocol.GetRequest, nil, time.Now(), gotocol.NewTrace(), "customer1"}
+	AnnotateSend(m1, caller)
+	AnnotateReceive(m1, callee, time.Now())
+	m2 := gotocol.Message{gotocol.Error, nil, time.Now(), m1.Ctx, gotocol.Throttled}
+	AnnotateSend(m2, callee)
+	AnnotateReceive(m2, caller, time.Now())
+	for n, want := range map[string]string{"subscriber_responses": "1", "subscriber_errors": "1", "subscriber_errors_429": "1"} {
+		if v := expvar.Get(n); v == nil || v.String() != want {
+			t.Errorf("%v: %v", n, v)
+		}
+	}
+	Shutdown()
+	b, err := ioutil.ReadFile("json_metrics/test_flow.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"binaryAnnotations":[{"key":"error","value":"429"`) {
+		t.Errorf("error tag missing from zipkin flows")
+	}
+}
@@ -8,12 +8,13 @@ import (
 	"github.com/adrianco/spigo/actors/edda"
 	"github.com/adrianco/spigo/actors/pirate"
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/collect"
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/graphjson"
 	"github.com/adrianco/spigo/tooling/names"
+	"github.com/adrianco/spigo/tooling/random"
 	"log"
-	"math/rand"
 	"time"
 )
 
@@ -25,6 +26,7 @@ var listener chan gotocol.Message
 // Reload the network from a file
 func Reload(arch string) {
 	listener = make(chan gotocol.Message) // listener for fsm
+	gotocol.Inbox(listener)               // fsm isn't an actor, it waits for replies during shutdown
 	log.Println("fsm reloading from " + arch + ".json")
 	g := graphjson.ReadArch(arch)
 	pop := 0
@@ -46,10 +48,10 @@ func Reload(arch string) {
 			switch element.Service {
 			case "pirate":
 				go pirate.Start(noodles[name])
-				noodles[name] <- gotocol.Message{gotocol.Hello, listener, time.Now(), gotocol.NilContext, name}
+				gotocol.Send(noodles[name], gotocol.Message{gotocol.Hello, listener, clock.Now(), gotocol.NilContext, name})
 				if edda.Logchan != nil {
 					// tell the pirate to report itself and new edges to the logger
-					noodles[name] <- gotocol.Message{gotocol.Inform, edda.Logchan, time.Now(), gotocol.NilContext, ""}
+					gotocol.Send(noodles[name], gotocol.Message{gotocol.Inform, edda.Logchan, clock.Now(), gotocol.NilContext, ""})
 				}
 			default:
 				log.Println("fsm: unknown service: " + element.Service)
@@ -59,19 +61,21 @@ func Reload(arch string) {
 	// Make all the connections
 	for _, element := range g.Graph {
 		if element.Edge != "" && element.Source != "" && element.Target != "" {
-			noodles[element.Source] <- gotocol.Message{gotocol.NameDrop, noodles[element.Target], time.Now(), gotocol.NewTrace(), element.Target}
+			gotocol.Send(noodles[element.Source], gotocol.Message{gotocol.NameDrop, noodles[element.Target], clock.Now(), gotocol.NewTrace(), element.Target})
 			log.Println("Link " + element.Source + " > " + element.Target)
 		}
 	}
 	// send money and start the pirates chatting
-	for _, noodle := range noodles {
+	r := random.New("fsm") // fsm's own random stream
+	for _, n := range gotocol.Names(noodles) {
+		noodle := noodles[n]
 		// same as below for now, but will save and read back from file later
 		// anonymously send this pirate a random amount of GoldCoin up to 100
-		gold := fmt.Sprintf("%d", rand.Intn(100))
-		noodle <- gotocol.Message{gotocol.GoldCoin, nil, time.Now(), gotocol.NewTrace(), gold}
+		gold := fmt.Sprintf("%d", r.Intn(100))
+		gotocol.Send(noodle, gotocol.Message{gotocol.GoldCoin, nil, clock.Now(), gotocol.NewTrace(), gold})
 		// tell this pirate to start chatting with friends every 0.1 to 10 secs
-		delay := fmt.Sprintf("%dms", 100+rand.Intn(9900))
-		noodle <- gotocol.Message{gotocol.Chat, nil, time.Now(), gotocol.NilContext, delay}
+		delay := fmt.Sprintf("%dms", 100+r.Intn(9900))
+		gotocol.Send(noodle, gotocol.Message{gotocol.Chat, nil, clock.Now(), gotocol.NilContext, delay})
 	}
 	shutdown()
 }
@@ -79,6 +83,7 @@ func Reload(arch string) {
 // Start fsm and create new pirates
 func Start() {
 	listener = make(chan gotocol.Message) // listener for fsm
+	gotocol.Inbox(listener)               // fsm isn't an actor, it waits for replies during shutdown
 	if archaius.Conf.Population < 2 {
 		log.Fatal("fsm: can't create less than 2 pirates")
 	}
@@ -94,35 +99,36 @@ func Start() {
 	i := 0
 	msgcount := 1
 	start := time.Now()
-	for name, noodle := range noodles {
+	for _, name := range gotocol.Names(noodles) {
+		noodle := noodles[name]
 		pnames[i] = name
 		i++
 		// tell the pirate it's name and how to talk back to it's fsm
 		// this must be the first message the pirate sees
-		noodle <- gotocol.Message{gotocol.Hello, listener, time.Now(), gotocol.NilContext, name}
+		gotocol.Send(noodle, gotocol.Message{gotocol.Hello, listener, clock.Now(), gotocol.NilContext, name})
 		if edda.Logchan != nil {
 			// tell the pirate to report itself and new edges to the logger
-			noodle <- gotocol.Message{gotocol.Inform, edda.Logchan, time.Now(), gotocol.NilContext, ""}
+			gotocol.Send(noodle, gotocol.Message{gotocol.Inform, edda.Logchan, clock.Now(), gotocol.NilContext, ""})
 			msgcount = 2
 		}
 	}
 	log.Println("fsm: Talk amongst yourselves for", archaius.Conf.RunDuration)
-	rand.Seed(int64(len(noodles)))
+	r := random.New("fsm") // fsm's own random stream
 	for _, name := range pnames {
 		// for each pirate tell them about two other random pirates
 		noodle := noodles[name] // lookup the channel
 		// pick a first random pirate to tell this one about
-		talkto := pnames[rand.Intn(len(pnames))]
-		noodle <- gotocol.Message{gotocol.NameDrop, noodles[talkto], time.Now(), gotocol.NewTrace(), talkto}
+		talkto := pnames[r.Intn(len(pnames))]
+		gotocol.Send(noodle, gotocol.Message{gotocol.NameDrop, noodles[talkto], clock.Now(), gotocol.NewTrace(), talkto})
 		// pick a second random pirate to tell this one about
-		talkto = pnames[rand.Intn(len(pnames))]
-		noodle <- gotocol.Message{gotocol.NameDrop, noodles[talkto], time.Now(), gotocol.NewTrace(), talkto}
+		talkto = pnames[r.Intn(len(pnames))]
+		gotocol.Send(noodle, gotocol.Message{gotocol.NameDrop, noodles[talkto], clock.Now(), gotocol.NewTrace(), talkto})
 		// anonymously send this pirate a random amount of GoldCoin up to 100
-		gold := fmt.Sprintf("%d", rand.Intn(100))
-		noodle <- gotocol.Message{gotocol.GoldCoin, nil, time.Now(), gotocol.NewTrace(), gold}
+		gold := fmt.Sprintf("%d", r.Intn(100))
+		gotocol.Send(noodle, gotocol.Message{gotocol.GoldCoin, nil, clock.Now(), gotocol.NewTrace(), gold})
 		// tell this pirate to start chatting with friends every 0.1 to 10 secs
-		delay := fmt.Sprintf("%dms", 100+rand.Intn(9900))
-		noodle <- gotocol.Message{gotocol.Chat, nil, time.Now(), gotocol.NewTrace(), delay}
+		delay := fmt.Sprintf("%dms", 100+r.Intn(9900))
+		gotocol.Send(noodle, gotocol.Message{gotocol.Chat, nil, clock.Now(), gotocol.NewTrace(), delay})
 	}
 	msgcount += 4
 	d := time.Since(start)
@@ -136,15 +142,15 @@ func shutdown() {
 	hist := collect.NewHist("fsm")
 	// wait until the delay has finished
 	if archaius.Conf.RunDuration >= time.Millisecond {
-		time.Sleep(archaius.Conf.RunDuration)
+		clock.Sleep(archaius.Conf.RunDuration)
 	}
 	log.Println("fsm: Shutdown")
-	for _, noodle := range noodles {
-		gotocol.Message{gotocol.Goodbye, nil, time.Now(), gotocol.NilContext, "beer volcano"}.GoSend(noodle)
+	for _, n := range gotocol.Names(noodles) {
+		gotocol.Message{gotocol.Goodbye, nil, clock.Now(), gotocol.NilContext, "beer volcano"}.GoSend(noodles[n])
 	}
 	for len(noodles) > 0 {
-		msg = <-listener
-		collect.Measure(hist, time.Since(msg.Sent))
+		msg = gotocol.Receive(listener)
+		collect.Measure(hist, clock.Since(msg.Sent))
 		if archaius.Conf.Msglog {
 			log.Printf("fsm: %v\n", msg)
 		}
@@ -4,6 +4,10 @@ package gotocol
 
 import (
 	"fmt"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/latency"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -35,11 +39,44 @@ const (
 	Forget
 	// Delete - key Remove key and value
 	Delete
+	// Timeout - FromChan service, gave up waiting for a response on this span, sent to itself when a timer fires or to the caller
+	Timeout
+	// Error FromChan status Simulate http error response, status is one of the codes below
+	Error
+	// Circuit - "caller route state" a circuit breaker changed state, logged by edda
+	Circuit
+	// Config - "key value" a property was changed while running, actors that keep settings look them up again
+	Config
+	// Chaos - "action victim" chaosmonkey acted on a node, logged by edda and traced as a flow
+	Chaos
+	// Renew FromChan name a registered instance is still alive, sent to eureka every poll to renew its lease
+	Renew
+	// Lease - "event registry instance" eureka evicted an instance or changed self preservation mode, logged by edda
+	Lease
+	// Fetch FromChan "version service..." a eureka client asks for the changes to the registry since the version it has,
+	// the registry sends a NameDrop for each instance that's online then replies "registry version full|delta count +instance -instance..."
+	Fetch
+	// Read FromChan key a cassandra coordinator asks a replica for its copy of a key, it replies with a GetResponse
+	Read
+	// Stream FromChan key value progress a cassandra node sends its copy of a key to a node that has taken over its range
+	Stream
+	// Repair FromChan "tree hashes"|"keys leaves key value..." anti-entropy between cassandra replicas, a node sends the hash tree
+	// of the keys it shares with another, which replies with its keys in the leaves that differ
+	Repair
+	// Barrier - nothing, sent by the virtual time scheduler to find out when an actor is idle, ignored by actors
+	Barrier
 	// Goodbye - name // tell FSM and exit
 	Goodbye // test assumes this is the last and exits
 	numOfImpositions
 )
 
+// Status codes carried by an Error response, following http
+const (
+	Failed      = "500" // the service failed while serving the request
+	Unavailable = "503" // every circuit to the service it depends on is open
+	Throttled   = "429" // turned away by load shedding
+)
+
 // String handler to make imposition types printable
 func (imps Impositions) String() string {
 	switch imps {
@@ -65,6 +102,30 @@ func (imps Impositions) String() string {
 		return "Forget"
 	case Delete:
 		return "Delete"
+	case Timeout:
+		return "Timeout"
+	case Error:
+		return "Error"
+	case Circuit:
+		return "Circuit"
+	case Config:
+		return "Config"
+	case Chaos:
+		return "Chaos"
+	case Renew:
+		return "Renew"
+	case Lease:
+		return "Lease"
+	case Fetch:
+		return "Fetch"
+	case Read:
+		return "Read"
+	case Stream:
+		return "Stream"
+	case Repair:
+		return "Repair"
+	case Barrier:
+		return "Barrier"
 	case Goodbye:
 		return "Goodbye"
 	}
@@ -132,14 +193,18 @@ type Message struct {
 }
 
 func (msg Message) String() string {
-	return fmt.Sprintf("gotocol: %v %v %v %v", time.Since(msg.Sent), msg.Ctx, msg.Imposition, msg.Intention)
+	return fmt.Sprintf("gotocol: %v %v %v %v", clock.Since(msg.Sent), msg.Ctx, msg.Imposition, msg.Intention)
 }
 
 // Routetype information from a message
 type Routetype struct {
 	Ctx          Context
 	ResponseChan chan Message
-	State        int // state machine for managing responses
+	State        int       // state machine for managing responses
+	Dest         string    // service the request was passed on to
+	Intention    string    // request body, kept so it can be retried
+	Attempts     int       // retries so far
+	Sent         time.Time // when it was passed on, to time the response
 }
 
 // Route extracts routing information from a message
@@ -155,18 +220,394 @@ func PickRoute(rmap map[string]Routetype, msg Message) Routetype {
 	return rmap[msg.Ctx.Route()]
 }
 
-// Send a synchronous message
+// Send a synchronous message, in virtual time it is scheduled for delivery instead
+// it isn't delayed by the network, but can be dropped by a fault such as a partition, or held while the receiver is paused
 func Send(to chan<- Message, msg Message) {
-	if to != nil {
-		to <- msg
+	remember(to, msg)
+	if msg.ResponseChan != nil && to != nil {
+		nlock.Lock()
+		from, dest := named[msg.ResponseChan], named[to]
+		nlock.Unlock()
+		if _, lost := latency.Faults(from, dest); lost {
+			return
+		}
 	}
+	if clock.Virtual() {
+		schedule(to, msg, 0)
+		return
+	}
+	post(to, msg)
 }
 
-// GoSend asynchronous message send, parks it on a new goroutine until it completes
+// GoSend asynchronous message send, parks it on a new goroutine until it completes, in virtual time it is scheduled
+// it takes as long as the latency model says to get across the network, and may get lost on the way
 func (msg Message) GoSend(to chan Message) {
-	go func(c chan Message, m Message) {
-		if c != nil {
-			c <- m
+	msg.GoSendFrom(msg.ResponseChan, to)
+}
+
+// GoSendFrom sends on behalf of an actor that isn't the ResponseChan, such as eureka replicating a registration
+func (msg Message) GoSendFrom(from, to chan Message) {
+	remember(to, msg)
+	d, lost := network(from, to)
+	if lost {
+		return
+	}
+	if clock.Virtual() {
+		schedule(to, msg, d)
+		return
+	}
+	clock.After(d, func() { post(to, msg) })
+}
+
+// Redeliver a message to an actor's own listener, asynchronously and without crossing the network again
+func (msg Message) Redeliver(to chan Message) {
+	if clock.Virtual() {
+		schedule(to, msg, 0)
+		return
+	}
+	go post(to, msg)
+}
+
+// post a message on the wall clock, once the receiver isn't paused
+func post(to chan<- Message, msg Message) {
+	if to == nil {
+		return
+	}
+	if d := held(to); d > 0 {
+		clock.After(d, func() { post(to, msg) })
+		return
+	}
+	if stalled(to, func() { post(to, msg) }) {
+		return
+	}
+	to <- msg
+}
+
+// actors that chaosmonkey has paused, messages to them are held until the time given,
+// and actors that are held until they're let go, with what to do with their messages once they are
+var (
+	plock  sync.Mutex
+	paused = make(map[chan<- Message]time.Time)
+	holds  = make(map[chan<- Message]int)
+	parked = make(map[chan<- Message][]func())
+)
+
+// Pause an actor for a while, it gets no messages until the pause is over, then gets the ones that were held
+func Pause(to chan<- Message, d time.Duration) {
+	plock.Lock()
+	paused[to] = clock.Now().Add(d)
+	plock.Unlock()
+}
+
+// Hold an actor until it's let go, as a sender blocked on a full queue is. It gets no messages or ticks meanwhile,
+// each Hold needs an Unhold
+func Hold(to chan<- Message) {
+	if to == nil {
+		return
+	}
+	plock.Lock()
+	holds[to]++
+	plock.Unlock()
+}
+
+// Unhold lets go of an actor, once every Hold on it is let go it gets the messages that were held, in order
+func Unhold(to chan<- Message) {
+	plock.Lock()
+	if holds[to] == 0 {
+		plock.Unlock()
+		return
+	}
+	holds[to]--
+	if holds[to] > 0 {
+		plock.Unlock()
+		return
+	}
+	delete(holds, to)
+	fs := parked[to]
+	delete(parked, to)
+	plock.Unlock()
+	if clock.Virtual() {
+		for _, f := range fs {
+			clock.After(0, f)
 		}
-	}(to, msg)
+		return
+	}
+	go func() {
+		for _, f := range fs {
+			f()
+		}
+	}()
+}
+
+// stalled is true if an actor is held, then f is done once it's let go
+func stalled(to chan<- Message, f func()) bool {
+	plock.Lock()
+	defer plock.Unlock()
+	if holds[to] == 0 {
+		return false
+	}
+	parked[to] = append(parked[to], f)
+	return true
+}
+
+// holding is true while an actor is held
+func holding(to chan<- Message) bool {
+	plock.Lock()
+	defer plock.Unlock()
+	return holds[to] > 0
+}
+
+// held is how much longer an actor is paused for
+func held(to chan<- Message) time.Duration {
+	plock.Lock()
+	defer plock.Unlock()
+	until, ok := paused[to]
+	if !ok {
+		return 0
+	}
+	if d := until.Sub(clock.Now()); d > 0 {
+		return d
+	}
+	delete(paused, to)
+	return 0
+}
+
+// names of actors, learned from the Hello messages that name them, so the network knows where messages go
+var (
+	nlock sync.Mutex
+	named = make(map[chan<- Message]string)
+)
+
+// remember the name of an actor when it is told it
+func remember(to chan<- Message, msg Message) {
+	if msg.Imposition == Hello && to != nil {
+		nlock.Lock()
+		named[to] = msg.Intention
+		nlock.Unlock()
+	}
+}
+
+// Known tells the network the name of an actor that isn't sent a Hello, such as eureka
+func Known(to chan<- Message, name string) {
+	nlock.Lock()
+	named[to] = name
+	nlock.Unlock()
+}
+
+// network delay from the sender to the receiver
+func network(from, to chan<- Message) (time.Duration, bool) {
+	if from == nil || to == nil {
+		return 0, false
+	}
+	nlock.Lock()
+	sender, dest := named[from], named[to]
+	nlock.Unlock()
+	return latency.Delay(sender, dest)
+}
+
+// Names of the entries in a map of channels in sorted order, so that iterating over them repeats exactly
+func Names(m map[string]chan Message) []string {
+	ns := make([]string, 0, len(m))
+	for n := range m {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+// virtual time delivery state, the scheduler delivers to one actor at a time and waits for it to go idle
+var (
+	vlock   sync.Mutex                           // protects the maps below
+	inboxes = make(map[chan<- Message][]Message) // queued messages for listeners that aren't actors
+	gone    = make(map[chan<- Message]bool)      // actors that have said Goodbye and exited
+	exiting chan struct{}                        // closed when an actor being told Goodbye replies with its own
+)
+
+// schedule a message for delivery in virtual time after delay d
+func schedule(to chan<- Message, msg Message, d time.Duration) {
+	if msg.Imposition == Goodbye {
+		// an actor passes Goodbye on to its parent as the last thing it does before it exits
+		vlock.Lock()
+		if exiting != nil {
+			close(exiting)
+			exiting = nil
+		}
+		vlock.Unlock()
+	}
+	clock.After(d, func() { deliver(to, msg) })
+}
+
+// deliver a message in virtual time and wait until the receiver has finished handling it
+func deliver(to chan<- Message, msg Message) {
+	if to == nil {
+		return
+	}
+	if d := held(to); d > 0 {
+		clock.After(d, func() { deliver(to, msg) }) // delivered in order once the pause is over
+		return
+	}
+	if stalled(to, func() { deliver(to, msg) }) {
+		return
+	}
+	var bye chan struct{}
+	vlock.Lock()
+	if q, ok := inboxes[to]; ok {
+		inboxes[to] = append(q, msg)
+		vlock.Unlock()
+		return
+	}
+	if gone[to] {
+		vlock.Unlock()
+		return
+	}
+	if msg.Imposition == Goodbye {
+		bye = make(chan struct{})
+		exiting = bye
+	}
+	vlock.Unlock()
+	to <- msg
+	if cap(to) > 0 {
+		return // a buffered channel can't tell when its receiver is idle, only used for logging sinks
+	}
+	// the barrier can only be received once the actor is back waiting for its next message
+	select {
+	case to <- Message{Barrier, nil, msg.Sent, NilContext, ""}:
+	case <-bye:
+		vlock.Lock()
+		gone[to] = true
+		vlock.Unlock()
+	}
+	vlock.Lock()
+	exiting = nil
+	vlock.Unlock()
+}
+
+// Inbox sets up a listener that isn't an actor, such as the one used by asgard to wait for shutdown
+func Inbox(listener chan Message) {
+	vlock.Lock()
+	inboxes[listener] = make([]Message, 0, 1)
+	vlock.Unlock()
+}
+
+// Receive the next message for an Inbox listener, in virtual time the scheduler runs until one arrives
+func Receive(listener chan Message) Message {
+	for clock.Virtual() {
+		vlock.Lock()
+		q := inboxes[listener]
+		if len(q) > 0 {
+			inboxes[listener] = q[1:]
+			vlock.Unlock()
+			return q[0]
+		}
+		vlock.Unlock()
+		if !clock.Step() {
+			break // nothing left to happen
+		}
+	}
+	return <-listener
+}
+
+// Poll for a message to an Inbox listener without waiting, ok is false if there isn't one yet
+func Poll(listener chan Message) (Message, bool) {
+	if clock.Virtual() {
+		vlock.Lock()
+		defer vlock.Unlock()
+		q := inboxes[listener]
+		if len(q) == 0 {
+			return Message{}, false
+		}
+		inboxes[listener] = q[1:]
+		return q[0], true
+	}
+	select {
+	case msg := <-listener:
+		return msg, true
+	default:
+		return Message{}, false
+	}
+}
+
+// Ticker sends ticks to an actor, in virtual time each tick is a scheduled event.
+// An actor that chaosmonkey has paused is hung, so it misses the ticks until the pause is over
+type Ticker struct {
+	C        <-chan time.Time // the channel on which ticks are delivered
+	ticker   *time.Ticker     // wall clock ticker
+	c        chan time.Time   // tick channel
+	done     chan struct{}    // closed to stop passing on wall clock ticks
+	listener chan<- Message   // the actor that is ticked
+	interval time.Duration
+	stopped  int32
+}
+
+// NewTicker for the actor listening on listener, ticking every d
+func NewTicker(listener chan<- Message, d time.Duration) *Ticker {
+	t := new(Ticker)
+	if !clock.Virtual() {
+		t.ticker = time.NewTicker(d)
+		t.c = make(chan time.Time, 1) // like a time.Ticker, ticks are dropped if the actor is slow
+		t.C = t.c
+		t.listener = listener
+		t.done = make(chan struct{})
+		go t.pass()
+		return t
+	}
+	if d <= 0 {
+		panic("non-positive interval for gotocol.NewTicker")
+	}
+	t.c = make(chan time.Time)
+	t.C = t.c
+	t.listener = listener
+	t.interval = d
+	clock.After(d, t.tick)
+	return t
+}
+
+// Stop the ticker, no more ticks will be sent
+func (t *Ticker) Stop() {
+	if !atomic.CompareAndSwapInt32(&t.stopped, 0, 1) {
+		return
+	}
+	if t.ticker != nil {
+		t.ticker.Stop()
+		close(t.done)
+	}
+}
+
+// pass on wall clock ticks unless the actor is paused
+func (t *Ticker) pass() {
+	for {
+		select {
+		case now := <-t.ticker.C:
+			if held(t.listener) > 0 || holding(t.listener) {
+				break
+			}
+			select {
+			case t.c <- now:
+			default:
+			}
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// tick in virtual time, then wait for the actor to finish handling it
+func (t *Ticker) tick() {
+	vlock.Lock()
+	stop := gone[t.listener]
+	vlock.Unlock()
+	if stop || atomic.LoadInt32(&t.stopped) != 0 {
+		return
+	}
+	if d := held(t.listener); d > 0 {
+		clock.After(d, t.tick) // starts ticking again when the pause is over
+		return
+	}
+	if stalled(t.listener, t.tick) {
+		return
+	}
+	now := clock.Now()
+	t.c <- now
+	t.listener <- Message{Barrier, nil, now, NilContext, ""}
+	clock.After(t.interval, t.tick)
 }
@@ -37,6 +37,17 @@ func pirateListen(listener chan Message) {
 		case Put:
 		case Forget:
 		case Delete:
+		case Timeout:
+		case Error:
+		case Circuit:
+		case Config:
+		case Chaos:
+		case Renew:
+		case Lease:
+		case Fetch:
+		case Read:
+		case Stream:
+		case Repair:
 		case Goodbye:
 			return
 		}
@@ -69,3 +80,20 @@ func TestImpose(t *testing.T) {
 	fmt.Println("closed len(p2p): ", len(p2p))
 
 }
+
+// Test a synchronous send to a paused actor is held until the pause is over
+func TestPause(t *testing.T) {
+	to := make(chan Message, 1)
+	Pause(to, 50*time.Millisecond)
+	Send(to, Message{Renew, nil, time.Now(), NilContext, "test"})
+	select {
+	case <-to:
+		t.Fatal("delivered while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	select {
+	case <-to:
+	case <-time.After(time.Second):
+		t.Fatal("not delivered after the pause")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/dhcp"
 	"io/ioutil"
 	"log"
@@ -50,6 +51,30 @@ type DoneV0r4 struct {
 	Tstamp string `json:"timestamp"`
 }
 
+// CircuitV0r4 records a change in the state of the circuit breaker on an edge, open, half-open or closed
+type CircuitV0r4 struct {
+	Circuit string `json:"circuit"`
+	Source  string `json:"source"`
+	Target  string `json:"target"`
+	State   string `json:"state"`
+	Tstamp  string `json:"timestamp"`
+}
+
+// ChaosV0r4 records what chaosmonkey did to a node, kill, gorilla, kong, pause or resume
+type ChaosV0r4 struct {
+	Chaos  string `json:"chaos"`
+	Victim string `json:"victim"`
+	Tstamp string `json:"timestamp"`
+}
+
+// LeaseV0r4 records a eureka lease event, an instance evicted or registered again, or a registry entering or leaving self preservation
+type LeaseV0r4 struct {
+	Lease    string `json:"lease"`
+	Registry string `json:"registry"`
+	Instance string `json:"instance,omitempty"`
+	Tstamp   string `json:"timestamp"`
+}
+
 // ElementV0r4 defines a way to read either a node, edge or done in the graph for version 0.3 or 0.4
 type ElementV0r4 struct {
 	Node     string `json:"node,omitempty"`
@@ -61,6 +86,13 @@ type ElementV0r4 struct {
 	Forget   string `json:"forget"`
 	Done     string `json:"target,omitempty"`
 	Exit     string `json:"exit,omitempty"`
+	Circuit  string `json:"circuit,omitempty"`
+	State    string `json:"state,omitempty"`
+	Chaos    string `json:"chaos,omitempty"`
+	Victim   string `json:"victim,omitempty"`
+	Lease    string `json:"lease,omitempty"`
+	Registry string `json:"registry,omitempty"`
+	Instance string `json:"instance,omitempty"`
 	Metadata string `json:"metadata,omitempty"` // added to 0.4
 	Tstamp   string `json:"timestamp,omitempty"`
 }
@@ -90,7 +122,11 @@ func Setup(arch string) {
 		ss = fmt.Sprintf("%v", archaius.Conf.StopStep)
 	}
 	file, _ = os.Create("json/" + arch + ss + ".json")
-	Write(fmt.Sprintf("{\n  %q:%q,\n  %q:%q,\n  %q:\"%v\",\n  %q:%q,\n  %q:[", "arch", arch, "version", "spigo-0.4", "args", os.Args, "date", time.Now().Format(time.RFC3339Nano), "graph"))
+	date := clock.Now()
+	if clock.Virtual() {
+		date = clock.Epoch // edda sets up while virtual time is already being stepped, so the header repeats from run to run
+	}
+	Write(fmt.Sprintf("{\n  %q:%q,\n  %q:%q,\n  %q:\"%v\",\n  %q:%q,\n  %q:[", "arch", arch, "version", "spigo-0.4", "args", os.Args, "date", date.Format(time.RFC3339Nano), "graph"))
 	comma = false
 	edgemap = make(map[string]string, archaius.Conf.Population)
 }
@@ -164,6 +200,47 @@ func WriteForget(fromTo string, t time.Time) {
 	Write(fmt.Sprintf("%v    %v", commaNewline(), string(forgetJSON)))
 }
 
+// WriteCircuit writes the state of the circuit breaker on an edge given space separated from and to node names
+func WriteCircuit(fromTo, state string, t time.Time) {
+	if Enabled == false {
+		return
+	}
+	var circuit CircuitV0r4
+	fmt.Sscanf(fromTo, "%s%s", &circuit.Source, &circuit.Target) // two space delimited names
+	circuit.Circuit = edgemap[fromTo]
+	circuit.State = state
+	circuit.Tstamp = t.Format(time.RFC3339Nano)
+	circuitJSON, _ := json.Marshal(circuit)
+	Write(fmt.Sprintf("%v    %v", commaNewline(), string(circuitJSON)))
+}
+
+// WriteChaos writes a chaos action on a node
+func WriteChaos(node, action string, t time.Time) {
+	if Enabled == false {
+		return
+	}
+	var chaos ChaosV0r4
+	chaos.Chaos = action
+	chaos.Victim = node
+	chaos.Tstamp = t.Format(time.RFC3339Nano)
+	chaosJSON, _ := json.Marshal(chaos)
+	Write(fmt.Sprintf("%v    %v", commaNewline(), string(chaosJSON)))
+}
+
+// WriteLease writes a lease event from a registry, instance is empty for self preservation events
+func WriteLease(registry, instance, event string, t time.Time) {
+	if Enabled == false {
+		return
+	}
+	var lease LeaseV0r4
+	lease.Lease = event
+	lease.Registry = registry
+	lease.Instance = instance
+	lease.Tstamp = t.Format(time.RFC3339Nano)
+	leaseJSON, _ := json.Marshal(lease)
+	Write(fmt.Sprintf("%v    %v", commaNewline(), string(leaseJSON)))
+}
+
 // Close completes the json file format and closes the file
 func Close() {
 	if Enabled == false {
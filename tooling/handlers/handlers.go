@@ -3,11 +3,16 @@ package handlers
 
 import (
 	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/discovery"
 	"github.com/adrianco/spigo/tooling/flow"
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/names"
 	"github.com/adrianco/spigo/tooling/ribbon"
+	"github.com/adrianco/spigo/tooling/usl"
 	"log"
+	"sort"
 	"time"
 )
 
@@ -31,30 +36,33 @@ func Inform(msg gotocol.Message, name string, listener chan gotocol.Message) cha
 		log.Fatal(name + "Inform message received before Hello message")
 	}
 	// service registry channel is buffered so don't use GoSend to tell Eureka we exist
-	msg.ResponseChan <- gotocol.Message{gotocol.Put, listener, time.Now(), DebugContext(msg.Ctx), name}
+	gotocol.Send(msg.ResponseChan, gotocol.Message{gotocol.Put, listener, clock.Now(), DebugContext(msg.Ctx), name})
 	return msg.ResponseChan
 }
 
 // NameDrop updates local buddy list
-func NameDrop(dependencies *map[string]time.Time, router *ribbon.Router, msg gotocol.Message, name string, listener chan gotocol.Message, eureka map[string]chan gotocol.Message, crosszone ...bool) {
+func NameDrop(dependencies *map[string]time.Time, cache *discovery.Cache, router *ribbon.Router, msg gotocol.Message, name string, listener chan gotocol.Message, eureka map[string]chan gotocol.Message, crosszone ...bool) {
 	if msg.ResponseChan == nil { // dependency by service name, needs to be looked up in eureka
 		(*dependencies)[msg.Intention] = msg.Sent // remember it for later
-		for _, ch := range eureka {
-			//log.Println(name + " looking up " + msg.Intention)
-			gotocol.Send(ch, gotocol.Message{gotocol.GetRequest, listener, time.Now(), DebugContext(msg.Ctx), msg.Intention})
-		}
+		cache.Full()                              // the changes since the last fetch don't include the new service
+		cache.Fetch(services(*dependencies), name, listener, eureka)
 	} else { // update dependency with full name and listener channel
-		microservice := msg.Intention // message body is buddy name
-		if len(crosszone) > 0 || names.Zone(name) == names.Zone(microservice) {
-			if microservice != name && router.Named(microservice) == nil { // don't talk to myself or record duplicates
-				// remember how to talk to this buddy
-				router.Add(microservice, msg.ResponseChan, msg.Sent) // message channel is buddy's listener
-				(*dependencies)[names.Service(microservice)] = msg.Sent
-				for _, ch := range eureka {
-					// tell just one of the service registries I have a new buddy to talk to so it doesn't get logged more than once
-					gotocol.Send(ch, gotocol.Message{gotocol.Inform, listener, time.Now(), DebugContext(msg.Ctx), name + " " + microservice})
-					return
-				}
+		cache.Remember(msg.Intention, msg.ResponseChan)
+		route(dependencies, router, msg.Intention, msg.ResponseChan, msg, name, listener, eureka, len(crosszone) > 0)
+	}
+}
+
+// route to a buddy that a message told us about
+func route(dependencies *map[string]time.Time, router *ribbon.Router, microservice string, ch chan gotocol.Message, msg gotocol.Message, name string, listener chan gotocol.Message, eureka map[string]chan gotocol.Message, crosszone bool) {
+	if crosszone || names.Zone(name) == names.Zone(microservice) {
+		if microservice != name && router.Named(microservice) == nil { // don't talk to myself or record duplicates
+			// remember how to talk to this buddy
+			router.Add(microservice, ch, msg.Sent) // message channel is buddy's listener
+			(*dependencies)[names.Service(microservice)] = msg.Sent
+			for _, n := range gotocol.Names(eureka) {
+				// tell just one of the service registries I have a new buddy to talk to so it doesn't get logged more than once
+				gotocol.Send(eureka[n], gotocol.Message{gotocol.Inform, listener, clock.Now(), DebugContext(msg.Ctx), name + " " + microservice})
+				return
 			}
 		}
 	}
@@ -67,6 +75,20 @@ func Forget(dependencies *map[string]time.Time, router *ribbon.Router, msg gotoc
 		// forget how to talk to this buddy
 		(*dependencies)[names.Service(microservice)] = msg.Sent // remember when we were told to forget this service
 		router.Remove(microservice)
+		collect.Stale(microservice, clock.Now())
+	}
+}
+
+// Fetch updates the buddy list from a service registry's reply to a fetch
+func Fetch(dependencies *map[string]time.Time, cache *discovery.Cache, router *ribbon.Router, msg gotocol.Message, name string, listener chan gotocol.Message, eureka map[string]chan gotocol.Message, crosszone ...bool) {
+	online, offline := cache.Update(msg)
+	for _, n := range online {
+		if ch := cache.Chan(n); ch != nil { // if the NameDrop was overtaken by the reply, it's routed when it arrives
+			route(dependencies, router, n, ch, msg, name, listener, eureka, len(crosszone) > 0)
+		}
+	}
+	for _, n := range offline {
+		Forget(dependencies, router, gotocol.Message{gotocol.Forget, nil, msg.Sent, gotocol.NilContext, n})
 	}
 }
 
@@ -77,32 +99,231 @@ func Put(msg gotocol.Message, name string, listener chan gotocol.Message, reques
 	if c == nil {
 		return
 	}
-	outmsg := gotocol.Message{gotocol.Put, listener, time.Now(), msg.Ctx.NewParent(), msg.Intention}
+	outmsg := gotocol.Message{gotocol.Put, listener, clock.Now(), msg.Ctx.NewParent(), msg.Intention}
 	flow.AnnotateSend(outmsg, name)
 	outmsg.GoSend(c)
 }
 
-// GetRequest sends a GetRequest message to a service
-func GetRequest(msg gotocol.Message, name string, listener chan gotocol.Message, requestor *map[string]gotocol.Routetype, router *ribbon.Router) {
+// GetRequest sends a GetRequest message to a service, if every circuit to it is open the request is answered straight away
+func GetRequest(msg gotocol.Message, name string, listener chan gotocol.Message, requestor *map[string]gotocol.Routetype, router *ribbon.Router, service *usl.Service) {
+	r := msg.Route()
+	r.Intention = msg.Intention
+	Lookup(r, name, listener, requestor, router, service)
+}
+
+// Lookup passes on a request that came in on a route, such as one that missed in a cache, to a service picked by the load balancing rule
+// the route's state is kept, so the response can be handled by how far the lookup has got
+func Lookup(r gotocol.Routetype, name string, listener chan gotocol.Message, requestor *map[string]gotocol.Routetype, router *ribbon.Router, service *usl.Service) {
 	// pass on request to a random service - client send
-	c := router.Random()
+	dest, c := router.RandomRoute()
+	pass(r, dest, c, name, listener, requestor, router, service)
+}
+
+// LookupKey passes on a request to the instance of a service its key belongs on, as a memcached client does
+func LookupKey(r gotocol.Routetype, name string, listener chan gotocol.Message, requestor *map[string]gotocol.Routetype, router *ribbon.Router, service *usl.Service) {
+	dest, c := router.KeyRoute(r.Intention)
+	pass(r, dest, c, name, listener, requestor, router, service)
+}
+
+// pass on a request to the route that was picked, a service with nowhere to pass it on to answers it with nothing
+// so the worker that holds it is freed, as a leaf service or one that hasn't discovered its dependencies yet
+func pass(r gotocol.Routetype, dest string, c chan gotocol.Message, name string, listener chan gotocol.Message, requestor *map[string]gotocol.Routetype, router *ribbon.Router, service *usl.Service) {
 	if c == nil {
+		if dest == "" {
+			Respond(gotocol.Message{gotocol.GetResponse, listener, clock.Now(), r.Ctx, ""}, name, r.ResponseChan, service, len(*requestor))
+			return
+		}
+		giveUp(r, dest, gotocol.Unavailable, name, listener, router, service, len(*requestor))
 		return
 	}
-	outmsg := gotocol.Message{gotocol.GetRequest, listener, time.Now(), msg.Ctx.NewParent(), msg.Intention}
+	outmsg := gotocol.Message{gotocol.GetRequest, listener, clock.Now(), r.Ctx.NewParent(), r.Intention}
 	flow.AnnotateSend(outmsg, name)
-	(*requestor)[outmsg.Ctx.Route()] = msg.Route() // remember where to respond to when this span comes back
+	r.Dest = dest
+	r.Attempts = 0
+	r.Sent = outmsg.Sent
+	(*requestor)[outmsg.Ctx.Route()] = r // remember where to respond to when this span comes back
+	router.Sent(dest)
 	outmsg.GoSend(c)
+	timer(outmsg.Ctx, dest, listener)
+}
+
+// Timeout handles a request that timed out, either a timer went off or the service it was passed on to gave up
+// it is retried on another instance of the same service after a backoff, or a timeout is sent back to the caller
+func Timeout(msg gotocol.Message, name string, listener chan gotocol.Message, requestor *map[string]gotocol.Routetype, router *ribbon.Router, service *usl.Service) {
+	ctr := msg.Ctx.Route()
+	r, ok := (*requestor)[ctr]
+	if !ok {
+		return // the response already came back
+	}
+	delete(*requestor, ctr)
+	router.Done(r.Dest, clock.Since(r.Sent))
+	if msg.ResponseChan == nil {
+		router.Timeout(r.Dest) // my timer went off
+	} else {
+		router.Failure(r.Dest) // it gave up on its own dependencies
+	}
+	if !retry(r, name, listener, requestor, router) {
+		giveUp(r, r.Dest, "", name, listener, router, service, len(*requestor))
+	}
+}
+
+// Error handles an error response from a service, it is retried like a timeout then the fallback value or the error is passed back to the caller
+func Error(msg gotocol.Message, name string, listener chan gotocol.Message, requestor *map[string]gotocol.Routetype, router *ribbon.Router, service *usl.Service) {
+	ctr := msg.Ctx.Route()
+	r, ok := (*requestor)[ctr]
+	if !ok {
+		return // the request already timed out
+	}
+	delete(*requestor, ctr)
+	router.Done(r.Dest, clock.Since(r.Sent))
+	router.Failure(r.Dest)
+	if !retry(r, name, listener, requestor, router) {
+		giveUp(r, r.Dest, msg.Intention, name, listener, router, service, len(*requestor))
+	}
+}
+
+// retry a request on another instance of the same service after a backoff, returns false once the retries have run out
+func retry(r gotocol.Routetype, name string, listener chan gotocol.Message, requestor *map[string]gotocol.Routetype, router *ribbon.Router) bool {
+	_, backoff, retries := client(r.Dest)
+	if r.Attempts >= retries {
+		return false
+	}
+	dest, c := router.Service(names.Service(r.Dest)).RandomRoute()
+	if c == nil {
+		return false
+	}
+	r.Dest = dest
+	r.Attempts++
+	wait := backoff << uint(r.Attempts-1)
+	r.Sent = clock.Now().Add(wait)
+	outmsg := gotocol.Message{gotocol.GetRequest, listener, clock.Now(), r.Ctx.NewParent(), r.Intention}
+	(*requestor)[outmsg.Ctx.Route()] = r
+	router.Sent(dest)
+	clock.After(wait, func() {
+		outmsg.Sent = clock.Now()
+		flow.Annotate(outmsg, name, flow.RT)
+		flow.AnnotateSend(outmsg, name)
+		outmsg.GoSend(c)
+		timer(outmsg.Ctx, dest, listener)
+	})
+	return true
+}
+
+// giveUp on a request and tell the caller, with the fallback value if the service has one
+// otherwise with an error status, or a timeout if the status is empty
+func giveUp(r gotocol.Routetype, dest, status, name string, listener chan gotocol.Message, router *ribbon.Router, service *usl.Service, others int) {
+	if v, ok := router.Fallback(dest); ok {
+		Respond(gotocol.Message{gotocol.GetResponse, listener, clock.Now(), r.Ctx, v}, name, r.ResponseChan, service, others)
+		return
+	}
+	service.Release()
+	outmsg := gotocol.Message{gotocol.Timeout, listener, clock.Now(), r.Ctx, dest}
+	if status != "" {
+		outmsg = gotocol.Message{gotocol.Error, listener, clock.Now(), r.Ctx, status}
+	}
+	flow.AnnotateSend(outmsg, name)
+	outmsg.GoSend(r.ResponseChan)
+}
+
+// Success records a response on the circuit breaker and the load of the route it came back from, unless the request already timed out
+func Success(msg gotocol.Message, requestor *map[string]gotocol.Routetype, router *ribbon.Router) {
+	if r, ok := (*requestor)[msg.Ctx.Route()]; ok {
+		router.Done(r.Dest, clock.Since(r.Sent))
+		router.Success(r.Dest)
+	}
 }
 
-// GetResponse provides generic response handling
-func GetResponse(msg gotocol.Message, name string, listener chan gotocol.Message, requestor *map[string]gotocol.Routetype) {
+// timer starts the timeout for a request passed on to a service, if one is configured
+func timer(ctx gotocol.Context, dest string, listener chan gotocol.Message) {
+	timeout, _, _ := client(dest)
+	if timeout > 0 {
+		clock.After(timeout, func() {
+			gotocol.Message{gotocol.Timeout, nil, clock.Now(), ctx, dest}.Redeliver(listener)
+		})
+	}
+}
+
+// client looks up how to call a service by its service then package name
+func client(dest string) (timeout, backoff time.Duration, retries int) {
+	c, ok := archaius.ClientFor(dest)
+	if !ok {
+		return 0, 0, 0
+	}
+	var err error
+	if c.Timeout != "" {
+		if timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			log.Fatalf("%v: bad timeout: %v\n", dest, err)
+		}
+	}
+	if c.Backoff != "" {
+		if backoff, err = time.ParseDuration(c.Backoff); err != nil {
+			log.Fatalf("%v: bad backoff: %v\n", dest, err)
+		}
+	}
+	return timeout, backoff, c.Retries
+}
+
+// GetResponse provides generic response handling, an Error response is passed back up as an Error
+func GetResponse(msg gotocol.Message, name string, listener chan gotocol.Message, requestor *map[string]gotocol.Routetype, service *usl.Service) {
 	ctr := msg.Ctx.Route()
 	r := (*requestor)[ctr]
 	if r.ResponseChan != nil {
-		outmsg := gotocol.Message{gotocol.GetResponse, listener, time.Now(), r.Ctx, msg.Intention}
-		flow.AnnotateSend(outmsg, name)
-		outmsg.GoSend(r.ResponseChan)
 		delete(*requestor, ctr)
+		Respond(gotocol.Message{msg.Imposition, listener, clock.Now(), r.Ctx, msg.Intention}, name, r.ResponseChan, service, len(*requestor))
+	}
+}
+
+// Respond sends a response once the service has spent its service time on it, others are still waiting on dependencies
+// the worker that held the request is then free for the next one
+func Respond(outmsg gotocol.Message, name string, to chan gotocol.Message, service *usl.Service, others int) {
+	d := service.Start(others)
+	if d == 0 {
+		service.Done()
+		service.Release()
+		flow.AnnotateSend(outmsg, name)
+		outmsg.GoSend(to)
+		return
+	}
+	clock.After(d, func() {
+		service.Done()
+		service.Release()
+		outmsg.Sent = clock.Now() // server send happens after the service time
+		flow.AnnotateSend(outmsg, name)
+		outmsg.GoSend(to)
+	})
+}
+
+// Poll the service registries for any changes to the dependencies, when it's time to refresh the cache
+func Poll(dependencies map[string]time.Time, cache *discovery.Cache, name string, listener chan gotocol.Message, eureka map[string]chan gotocol.Message) {
+	if cache.Due(name) {
+		cache.Fetch(services(dependencies), name, listener, eureka)
+	}
+}
+
+// services that are dependencies
+func services(dependencies map[string]time.Time) []string {
+	deps := make([]string, 0, len(dependencies))
+	for dep := range dependencies {
+		deps = append(deps, dep)
+	}
+	sort.Strings(deps) // keep the order of requests repeatable
+	return deps
+}
+
+// Renew the lease on this service with the service registries, so they know it's still alive
+func Renew(name string, listener chan gotocol.Message, eureka map[string]chan gotocol.Message) {
+	for _, n := range gotocol.Names(eureka) {
+		gotocol.Send(eureka[n], gotocol.Message{gotocol.Renew, listener, clock.Now(), gotocol.NilContext, name})
+	}
+}
+
+// Delete tells the service registries that this service is going away when it's told Goodbye,
+// a service killed by chaosmonkey crashes without telling them, and is evicted when its lease expires
+func Delete(msg gotocol.Message, name string, eureka map[string]chan gotocol.Message) {
+	if msg.Intention == "chaosmonkey" {
+		return
+	}
+	for _, n := range gotocol.Names(eureka) {
+		gotocol.Send(eureka[n], gotocol.Message{gotocol.Delete, nil, clock.Now(), gotocol.NilContext, name})
 	}
 }
@@ -0,0 +1,211 @@
+// Package latency models the network between services, based on where they are in the topology
+// Each tier, same zone, cross zone, cross region and the global * region, gets its own delay distribution
+// Faults injected for a while add delay, drop messages, or partition the network on top of the model
+package latency
+
+import (
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/names"
+	"github.com/adrianco/spigo/tooling/random"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tiers of the network topology
+const (
+	Zone        = "zone"        // both services in the same zone
+	CrossZone   = "crosszone"   // different zones in the same region
+	CrossRegion = "crossregion" // different regions
+	Global      = "global"      // either service is in the global * region
+)
+
+// Default network model used by the -l flag, unless the config file sets one
+var Default = map[string]archaius.Link{
+	Zone:        {"fixed", "200us", "100us", 0},
+	CrossZone:   {"fixed", "1ms", "500us", 0},
+	CrossRegion: {"fixed", "70ms", "10ms", 0},
+	Global:      {"exponential", "50ms", "10ms", 0},
+}
+
+// tier is a parsed Link
+type tier struct {
+	dist   string
+	mean   time.Duration
+	jitter time.Duration
+	loss   float64
+}
+
+// Fault degrades the network until a time, for messages to or from a target, or across a partition
+// a target is a service name, or a region or region.zone prefix of the instance names
+type Fault struct {
+	Target    string        // affected service or location, for a partition one side of it
+	Other     string        // the other side of a partition, empty for delay and loss
+	Delay     time.Duration // added to each message
+	Loss      float64       // probability that a message is dropped
+	Partition bool          // drop every message between the two sides
+	Until     time.Time     // when the fault heals
+}
+
+var (
+	faults  []Fault                       // injected faults that haven't healed yet
+	lock    sync.Mutex                    // protects the model, faults and streams
+	model   map[string]tier               // parsed from archaius.Conf.Latency and latency properties
+	version int                           // of the properties when the model was parsed
+	streams = make(map[string]*rand.Rand) // random stream for each sender
+)
+
+// Tier of the network between two named services
+func Tier(from, to string) string {
+	fr, tr := names.Region(from), names.Region(to)
+	switch {
+	case fr == "*" || tr == "*":
+		return Global
+	case fr != tr:
+		return CrossRegion
+	case names.Zone(from) != names.Zone(to) || names.Zone(from) == "*":
+		return CrossZone
+	}
+	return Zone
+}
+
+// Delay for a message from one named service to another, lost is true if it should be dropped
+func Delay(from, to string) (d time.Duration, lost bool) {
+	if from == "" || to == "" {
+		return 0, false
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if v := archaius.Version(); model == nil || v != version {
+		model = parse(links()) // properties changed while running
+		version = v
+	}
+	d, lost = faulty(from, to)
+	if lost || len(model) == 0 {
+		return d, lost
+	}
+	t, ok := model[Tier(from, to)]
+	if !ok {
+		return d, false
+	}
+	r := stream(from)
+	if t.loss > 0 && r.Float64() < t.loss {
+		return 0, true
+	}
+	d += random.Sample(r, t.dist, t.mean)
+	if t.jitter > 0 {
+		d += time.Duration(r.Int63n(int64(t.jitter)))
+	}
+	return d, false
+}
+
+// stream of random numbers for a sender
+func stream(from string) *rand.Rand {
+	r := streams[from]
+	if r == nil {
+		r = random.New(from + ".net") // each sender has its own stream so one service doesn't perturb the rest
+		streams[from] = r
+	}
+	return r
+}
+
+// Inject a fault into the network until it heals
+func Inject(f Fault) {
+	lock.Lock()
+	faults = append(faults, f)
+	lock.Unlock()
+}
+
+// Faults on a message from one named service to another, the extra delay and whether it's dropped
+func Faults(from, to string) (time.Duration, bool) {
+	if from == "" || to == "" {
+		return 0, false
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return faulty(from, to)
+}
+
+// faulty applies the faults that haven't healed yet, called with the lock held
+func faulty(from, to string) (d time.Duration, lost bool) {
+	if len(faults) == 0 {
+		return 0, false
+	}
+	now := clock.Now()
+	live := faults[:0]
+	for _, f := range faults {
+		if !now.Before(f.Until) {
+			continue // healed
+		}
+		live = append(live, f)
+		switch {
+		case f.Partition:
+			if (Match(from, f.Target) && Match(to, f.Other)) || (Match(from, f.Other) && Match(to, f.Target)) {
+				lost = true
+			}
+		case Match(from, f.Target) || Match(to, f.Target):
+			if f.Loss > 0 && stream(from).Float64() < f.Loss {
+				lost = true
+			}
+			d += f.Delay
+		}
+	}
+	faults = live
+	return d, lost
+}
+
+// Match a named service against a target, its service name, or a region or region.zone prefix
+func Match(name, target string) bool {
+	if names.Service(name) == target {
+		return true
+	}
+	where := strings.SplitN(name, ".", 2) // drop the architecture
+	return len(where) == 2 && (where[1] == target || strings.HasPrefix(where[1], target+"."))
+}
+
+// Reset discards the parsed model so that changes to archaius.Conf.Latency take effect
+func Reset() {
+	lock.Lock()
+	model = nil
+	lock.Unlock()
+}
+
+// links for each tier that is configured or set by a property
+func links() map[string]archaius.Link {
+	m := make(map[string]archaius.Link)
+	for _, t := range []string{Zone, CrossZone, CrossRegion, Global} {
+		if l, ok := archaius.LinkFor(t); ok {
+			m[t] = l
+		}
+	}
+	return m
+}
+
+// parse the configured links
+func parse(links map[string]archaius.Link) map[string]tier {
+	m := make(map[string]tier, len(links))
+	for name, l := range links {
+		var t tier
+		var err error
+		t.dist = l.Distribution
+		if !random.Valid(t.dist) {
+			log.Fatalf("latency: unknown distribution %v for %v\n", t.dist, name)
+		}
+		if l.Mean != "" {
+			if t.mean, err = time.ParseDuration(l.Mean); err != nil {
+				log.Fatalf("latency: bad mean for %v: %v\n", name, err)
+			}
+		}
+		if l.Jitter != "" {
+			if t.jitter, err = time.ParseDuration(l.Jitter); err != nil {
+				log.Fatalf("latency: bad jitter for %v: %v\n", name, err)
+			}
+		}
+		t.loss = l.Loss
+		m[name] = t
+	}
+	return m
+}
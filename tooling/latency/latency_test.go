@@ -0,0 +1,67 @@
+package latency
+
+import (
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/names"
+	"testing"
+	"time"
+)
+
+// Test the tiers and delays between services in different parts of the topology
+func TestDelay(t *testing.T) {
+	a := names.Make("test", "us-east-1", "zoneA", "a", "karyon", 0)
+	b := names.Make("test", "us-east-1", "zoneA", "b", "karyon", 0)
+	c := names.Make("test", "us-east-1", "zoneB", "c", "karyon", 0)
+	d := names.Make("test", "eu-west-1", "zoneA", "d", "karyon", 0)
+	g := names.Make("test", "*", "*", "g", "denominator", 0)
+	for _, x := range []struct{ from, to, tier string }{{a, b, Zone}, {a, c, CrossZone}, {a, d, CrossRegion}, {g, a, Global}} {
+		if Tier(x.from, x.to) != x.tier {
+			t.Errorf("%v to %v should be %v not %v", x.from, x.to, x.tier, Tier(x.from, x.to))
+		}
+	}
+	if dl, lost := Delay(a, d); dl != 0 || lost {
+		t.Errorf("no latency model should mean instant delivery")
+	}
+	archaius.Conf.Latency = map[string]archaius.Link{
+		Zone:        {"fixed", "1ms", "", 0},
+		CrossRegion: {"fixed", "70ms", "10ms", 0},
+		CrossZone:   {"fixed", "1ms", "", 1},
+	}
+	Reset()
+	defer func() { archaius.Conf.Latency = nil; Reset() }()
+	if dl, _ := Delay(a, b); dl != time.Millisecond {
+		t.Errorf("zone delay %v", dl)
+	}
+	for i := 0; i < 10; i++ {
+		if dl, _ := Delay(a, d); dl < 70*time.Millisecond || dl >= 80*time.Millisecond {
+			t.Errorf("cross region delay %v", dl)
+		}
+	}
+	if _, lost := Delay(a, c); !lost {
+		t.Errorf("cross zone messages should all be lost")
+	}
+	if dl, lost := Delay(g, a); dl != 0 || lost {
+		t.Errorf("unconfigured tier should be instant")
+	}
+	Inject(Fault{Target: "eu-west-1", Delay: 3 * time.Millisecond, Until: clock.Now().Add(time.Second)})
+	Inject(Fault{Target: "us-east-1.zoneA", Other: "us-east-1.zoneB", Partition: true, Until: clock.Now().Add(time.Second)})
+	if dl, _ := Delay(a, d); dl < 73*time.Millisecond || dl >= 83*time.Millisecond {
+		t.Errorf("cross region delay %v with latency added", dl)
+	}
+	if _, lost := Faults(c, a); !lost {
+		t.Errorf("messages across a partition should be lost")
+	}
+	if dl, lost := Faults(a, b); dl != 0 || lost {
+		t.Errorf("messages in a zone shouldn't be affected by faults")
+	}
+	if !Match(a, "a") || !Match(a, "us-east-1") || !Match(a, "us-east-1.zoneA") || Match(a, "us-east") {
+		t.Errorf("match %v", a)
+	}
+	faults = nil
+	archaius.Set("latency.zone.mean", "5ms")
+	defer archaius.Set("latency.zone.mean", "1ms")
+	if dl, _ := Delay(a, b); dl != 5*time.Millisecond {
+		t.Errorf("zone delay %v after it was changed", dl)
+	}
+}
@@ -0,0 +1,38 @@
+// Package random provides a repeatable random number stream for each actor
+// Each stream is derived from the seed and the actor's name, so adding or removing one service
+// doesn't change the random choices made by every other service
+package random
+
+import (
+	"github.com/adrianco/spigo/tooling/archaius"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// New returns the random stream for name, each actor owns its stream so no locking is needed
+func New(name string) *rand.Rand {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return rand.New(rand.NewSource(archaius.Conf.Seed ^ int64(h.Sum64())))
+}
+
+// Valid reports whether dist names a distribution that Sample knows about
+func Valid(dist string) bool {
+	switch dist {
+	case "", "fixed", "uniform", "exponential":
+		return true
+	}
+	return false
+}
+
+// Sample a duration with the given mean from a fixed, uniform (zero to twice the mean) or exponential distribution
+func Sample(r *rand.Rand, dist string, mean time.Duration) time.Duration {
+	switch dist {
+	case "uniform":
+		return time.Duration(r.Int63n(int64(2*mean) + 1))
+	case "exponential":
+		return time.Duration(r.ExpFloat64() * float64(mean))
+	}
+	return mean
+}
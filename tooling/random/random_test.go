@@ -0,0 +1,30 @@
+package random
+
+import (
+	"github.com/adrianco/spigo/tooling/archaius"
+	"testing"
+)
+
+// Test that streams repeat for the same seed and name, and differ otherwise
+func TestNew(t *testing.T) {
+	archaius.Conf.Seed = 1
+	a, b, c := New("pirate1"), New("pirate1"), New("pirate2")
+	same, differ := true, false
+	for i := 0; i < 10; i++ {
+		x := a.Int63()
+		if x != b.Int63() {
+			same = false
+		}
+		if x != c.Int63() {
+			differ = true
+		}
+	}
+	if !same || !differ {
+		t.Errorf("streams for the same name should repeat and other names should differ")
+	}
+	first := New("pirate1").Int63()
+	archaius.Conf.Seed = 2
+	if New("pirate1").Int63() == first {
+		t.Errorf("changing the seed should change the stream")
+	}
+}
@@ -0,0 +1,205 @@
+package ribbon
+
+import (
+	"github.com/adrianco/spigo/actors/edda"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"log"
+	"time"
+)
+
+// Circuit breaker states for a route
+const (
+	Closed   = "closed"    // requests flow normally
+	Open     = "open"      // requests are refused until the sleep window has passed
+	HalfOpen = "half-open" // a trial request decides whether to close again or stay open
+)
+
+// default sleep window, as used by Hystrix
+const sleepWindow = 5 * time.Second
+
+// circuit counts the outcome of requests on one route
+type circuit struct {
+	state   string
+	success int
+	failure int
+	timeout int
+	since   time.Time // when the counts were reset or the state last changed
+}
+
+// breaker settings from the client config of a route's service
+type breaker struct {
+	threshold float64
+	volume    int
+	window    time.Duration
+	fallback  string
+}
+
+// settings looks up the breaker for a route by service then package name, ok is false if it has none
+func settings(route string) (b breaker, ok bool) {
+	c, ok := archaius.ClientFor(route)
+	if !ok || c.Threshold <= 0 {
+		return b, false
+	}
+	b.threshold = c.Threshold
+	b.volume = c.Volume
+	b.fallback = c.Fallback
+	b.window = sleepWindow
+	if c.SleepWindow != "" {
+		var err error
+		if b.window, err = time.ParseDuration(c.SleepWindow); err != nil {
+			log.Fatalf("%v: bad sleep window: %v\n", route, err)
+		}
+	}
+	return b, true
+}
+
+// UseBreakers turns on circuit breakers for the routes of the named owner, state changes are logged by edda
+func (r *Router) UseBreakers(owner string) {
+	r.owner = owner
+	r.load.version = 0 // look up the rule for the new owner
+	r.circuits = make(map[string]*circuit)
+	r.tripped = make(map[string]bool)
+	r.each(r.share)
+}
+
+// State of the circuit on a route
+func (r *Router) State(route string) string {
+	if c := r.circuits[route]; c != nil {
+		return c.state
+	}
+	return Closed
+}
+
+// circuit for a route, nil if breakers are off or its service doesn't have one
+func (r *Router) circuit(route string) (*circuit, breaker) {
+	if r.circuits == nil {
+		return nil, breaker{}
+	}
+	b, ok := settings(route)
+	if !ok {
+		return nil, b
+	}
+	c := r.circuits[route]
+	if c == nil {
+		c = &circuit{state: Closed, since: clock.Now()}
+		r.circuits[route] = c
+	}
+	return c, b
+}
+
+// Allow a request on a route, once the sleep window has passed an open circuit lets a trial request through
+func (r *Router) Allow(route string) bool {
+	c, b := r.circuit(route)
+	if c == nil {
+		return true
+	}
+	switch c.state {
+	case Open:
+		if clock.Since(c.since) < b.window {
+			return false
+		}
+		r.change(route, c, HalfOpen)
+		return true
+	case HalfOpen:
+		if clock.Since(c.since) < b.window {
+			return false // trial in progress
+		}
+		c.since = clock.Now() // the trial never came back, try another
+		return true
+	}
+	return true
+}
+
+// allowed is true if Allow would let a request through on a route, without starting a trial
+func (r *Router) allowed(route string) bool {
+	c, b := r.circuit(route)
+	if c == nil || c.state == Closed {
+		return true
+	}
+	return clock.Since(c.since) >= b.window
+}
+
+// Success of a request on a route, closes a half open circuit
+func (r *Router) Success(route string) {
+	c, b := r.circuit(route)
+	if c == nil {
+		return
+	}
+	switch c.state {
+	case HalfOpen:
+		r.change(route, c, Closed)
+	case Closed:
+		r.roll(c, b)
+		c.success++
+	}
+}
+
+// Failure of a request on a route
+func (r *Router) Failure(route string) {
+	c, b := r.circuit(route)
+	if c == nil {
+		return
+	}
+	r.roll(c, b)
+	c.failure++
+	r.trip(route, c, b)
+}
+
+// Timeout of a request on a route
+func (r *Router) Timeout(route string) {
+	c, b := r.circuit(route)
+	if c == nil {
+		return
+	}
+	r.roll(c, b)
+	c.timeout++
+	r.trip(route, c, b)
+}
+
+// Fallback value to serve for a route with an open circuit, ok is false if there isn't one
+func (r *Router) Fallback(route string) (string, bool) {
+	c, b := r.circuit(route)
+	if c == nil || b.fallback == "" {
+		return "", false
+	}
+	return b.fallback, true
+}
+
+// roll over to a new window of counts for a closed circuit
+func (r *Router) roll(c *circuit, b breaker) {
+	if c.state == Closed && clock.Since(c.since) >= b.window {
+		c.success, c.failure, c.timeout = 0, 0, 0
+		c.since = clock.Now()
+	}
+}
+
+// trip the circuit open if a trial failed or there are too many failures and timeouts
+func (r *Router) trip(route string, c *circuit, b breaker) {
+	switch c.state {
+	case HalfOpen:
+		r.change(route, c, Open)
+	case Closed:
+		bad := c.failure + c.timeout
+		total := c.success + bad
+		if total >= b.volume && total > 0 && 100*float64(bad)/float64(total) >= b.threshold {
+			r.change(route, c, Open)
+		}
+	}
+}
+
+// change the state of a circuit and start counting again
+func (r *Router) change(route string, c *circuit, state string) {
+	c.state = state
+	if state == Closed {
+		delete(r.tripped, route)
+	} else {
+		r.tripped[route] = true
+	}
+	c.success, c.failure, c.timeout = 0, 0, 0
+	c.since = clock.Now()
+	if edda.Logchan != nil {
+		edda.Logchan <- gotocol.Message{gotocol.Circuit, nil, clock.Now(), gotocol.NilContext, r.owner + " " + route + " " + state}
+	}
+}
@@ -4,14 +4,27 @@ package ribbon
 import (
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/names"
+	"github.com/adrianco/spigo/tooling/random"
+	"hash/crc32"
 	"math/rand"
+	"sort"
 	"time"
 )
 
-// Router tracks times and channels
+// Router tracks times and channels, indexed so that picking a route doesn't depend on how many there are
 type Router struct {
-	routes  map[string]chan gotocol.Message
-	updated map[string]time.Time // dependent services and time last updated
+	routes   map[string]chan gotocol.Message
+	names    []string                        // routes in sorted order, so picks can repeat
+	chans    map[chan gotocol.Message]string // route of each channel
+	zones    map[string]int                  // routes in each region and zone, for zone affinity
+	updated  map[string]time.Time            // dependent services and time last updated
+	packages map[string]*Router              // subsets by package, kept up to date as routes change
+	services map[string]*Router              // subsets by service name, kept up to date as routes change
+	rand     *rand.Rand                      // random stream owned by the actor using the router
+	owner    string                          // name of the actor using the router
+	circuits map[string]*circuit             // circuit breakers by route, nil when they are off
+	tripped  map[string]bool                 // routes with a circuit that isn't closed
+	load     *load                           // requests in flight and response times by route, for the load balancing rules
 }
 
 // MakeRouter with maps initialized
@@ -19,56 +32,213 @@ func MakeRouter() *Router {
 	var r *Router
 	r = new(Router)
 	r.routes = make(map[string]chan gotocol.Message)
+	r.chans = make(map[chan gotocol.Message]string)
+	r.zones = make(map[string]int)
 	r.updated = make(map[string]time.Time)
+	r.packages = make(map[string]*Router)
+	r.services = make(map[string]*Router)
+	r.rand = random.New("")
+	r.load = makeLoad()
 	return r
 }
 
+// SetRand gives the router the random stream of the actor that owns it
+func (r *Router) SetRand(rnd *rand.Rand) {
+	r.rand = rnd
+	r.each(r.share)
+}
+
+// SetOwner names the actor using the router, it picks routes with the load balancing rule configured for its service
+func (r *Router) SetOwner(owner string) {
+	r.owner = owner
+	r.load.version = 0 // look up the rule for the new owner
+	r.each(r.share)
+}
+
 // Len of routing table
 func (r *Router) Len() int {
-	return len(r.routes)
+	return len(r.names)
 }
 
 // Add an entry to the routing table
 func (r *Router) Add(name string, c chan gotocol.Message, t time.Time) {
 	var nilt time.Time
+	if _, ok := r.routes[name]; !ok {
+		i := sort.SearchStrings(r.names, name)
+		r.names = append(r.names, "")
+		copy(r.names[i+1:], r.names[i:])
+		r.names[i] = name
+		r.zones[names.RegionZone(name)]++
+	} else if r.chans[r.routes[name]] == name {
+		delete(r.chans, r.routes[name])
+	}
 	r.routes[name] = c
+	if c != nil {
+		r.chans[c] = name
+	}
 	if t != nilt {
 		r.updated[name] = t
 	}
+	if s := r.packages[names.Package(name)]; s != nil {
+		s.Add(name, c, nilt)
+	}
+	if s := r.services[names.Service(name)]; s != nil {
+		s.Add(name, c, nilt)
+	}
 }
 
 // Remove an entry from the routing table
 func (r *Router) Remove(name string) {
+	c, ok := r.routes[name]
+	if !ok {
+		return
+	}
+	i := sort.SearchStrings(r.names, name)
+	r.names = append(r.names[:i], r.names[i+1:]...)
+	r.zones[names.RegionZone(name)]--
+	if r.chans[c] == name {
+		delete(r.chans, c)
+	}
 	delete(r.routes, name)
 	delete(r.updated, name)
+	if s := r.packages[names.Package(name)]; s != nil {
+		s.Remove(name)
+	}
+	if s := r.services[names.Service(name)]; s != nil {
+		s.Remove(name)
+	}
 }
 
 // Random channel from the routing table
 func (r *Router) Random() chan gotocol.Message {
-	lr := len(r.routes)
+	_, c := r.RandomRoute()
+	return c
+}
+
+// RandomRoute name and channel from the routing table, picked by the owner's load balancing rule from the routes
+// that don't have an open circuit. If every circuit is open the channel is nil and the name is a random route
+func (r *Router) RandomRoute() (string, chan gotocol.Message) {
+	lr := len(r.names)
 	if lr == 0 {
+		return "", nil
+	}
+	allowed := r.permitted()
+	if allowed == nil {
+		return r.names[r.rand.Intn(lr)], nil
+	}
+	return r.take(r.rule()(r, allowed))
+}
+
+// KeyRoute name and channel for a key, the allowed route with the highest hash of the key and its name, as memcached
+// clients shard keys over servers, so a key stays on the same route while it's there. If every circuit is open the
+// channel is nil and the name is the route the key belongs on
+func (r *Router) KeyRoute(key string) (string, chan gotocol.Message) {
+	if len(r.names) == 0 {
+		return "", nil
+	}
+	allowed := r.permitted()
+	if allowed == nil {
+		return highest(key, r.names), nil
+	}
+	return r.take(highest(key, allowed))
+}
+
+// highest hash of a key and each route, rendezvous hashing
+func highest(key string, routes []string) string {
+	best, bh := "", uint32(0)
+	for _, n := range routes {
+		if h := crc32.ChecksumIEEE([]byte(key + " " + n)); best == "" || h > bh {
+			best, bh = n, h
+		}
+	}
+	return best
+}
+
+// permitted routes, the sorted routes without an open circuit, nil if every circuit is open
+func (r *Router) permitted() []string {
+	var refused map[string]bool
+	for n := range r.tripped { // only routes with a circuit that isn't closed need to be checked
+		if _, ok := r.routes[n]; ok && !r.allowed(n) {
+			if refused == nil {
+				refused = make(map[string]bool)
+			}
+			refused[n] = true
+		}
+	}
+	if len(refused) == len(r.names) {
 		return nil
 	}
-	n := rand.Intn(lr)
-	for _, c := range r.routes {
-		if n == 0 {
-			return c
+	if refused == nil {
+		return r.names
+	}
+	allowed := make([]string, 0, len(r.names)-len(refused))
+	for _, n := range r.names {
+		if !refused[n] {
+			allowed = append(allowed, n)
 		}
-		n--
 	}
-	return nil // the table was empty
+	return allowed
+}
+
+// take a route that has been picked
+func (r *Router) take(n string) (string, chan gotocol.Message) {
+	if r.tripped[n] {
+		r.Allow(n) // starts a trial
+	}
+	return n, r.routes[n]
 }
 
-// All routes that match a package
+// All routes that match a package, the subset is kept up to date as routes are added and removed
 func (r *Router) All(p string) *Router {
-	packroutes := MakeRouter()
+	s := r.packages[p]
+	if s == nil {
+		s = r.subset(func(n string) bool { return names.Package(n) == p })
+		r.packages[p] = s
+	}
+	return s
+}
+
+// Service routes that match a service name, the subset is kept up to date as routes are added and removed
+func (r *Router) Service(sn string) *Router {
+	s := r.services[sn]
+	if s == nil {
+		s = r.subset(func(n string) bool { return names.Service(n) == sn })
+		r.services[sn] = s
+	}
+	return s
+}
+
+// subset of the routes that match, sharing the random stream, owner, breakers and load with the parent router
+func (r *Router) subset(match func(string) bool) *Router {
+	s := MakeRouter()
+	r.share(s)
 	var t time.Time
-	for n, c := range r.routes {
-		if names.Package(n) == p {
-			packroutes.Add(n, c, t)
+	for _, n := range r.names {
+		if match(n) {
+			s.Add(n, r.routes[n], t)
 		}
 	}
-	return packroutes
+	return s
+}
+
+// share the state that is common to a router and its subsets, and theirs
+func (r *Router) share(s *Router) {
+	s.rand = r.rand
+	s.owner = r.owner
+	s.circuits = r.circuits
+	s.tripped = r.tripped
+	s.load = r.load
+	s.each(s.share)
+}
+
+// each subset of the router
+func (r *Router) each(f func(*Router)) {
+	for _, s := range r.packages {
+		f(s)
+	}
+	for _, s := range r.services {
+		f(s)
+	}
 }
 
 // Pick a random matching package and return that channel from the routing table
@@ -83,26 +253,19 @@ func (r *Router) Named(n string) chan gotocol.Message {
 
 // NameChan find the name corresponding to a channel
 func (r *Router) NameChan(ch chan gotocol.Message) string {
-	for n, c := range r.routes {
-		if ch == c {
-			return n
-		}
-	}
-	return ""
+	return r.chans[ch]
 }
 
-// Names return all
+// Names return all in sorted order
 func (r *Router) Names() (ns []string) {
-	ns = make([]string, 0, 10)
-	for n := range r.routes {
-		ns = append(ns, n)
-	}
+	ns = make([]string, len(r.names))
+	copy(ns, r.names)
 	return ns
 }
 
 // Return just the names in the routing table as a string
 func (r Router) String() (s string) {
-	for _, n := range r.Names() {
+	for _, n := range r.names {
 		s += (n + " ")
 	}
 	return s
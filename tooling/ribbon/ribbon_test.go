@@ -2,8 +2,11 @@ package ribbon
 
 import (
 	"fmt"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
 	"github.com/adrianco/spigo/tooling/gotocol"
 	"github.com/adrianco/spigo/tooling/names"
+	"sort"
 	"testing"
 	"time"
 )
@@ -52,3 +55,256 @@ func TestRouter(t *testing.T) {
 		fmt.Printf("Random found staash: %v\n", c == r.Random())
 	}
 }
+
+// Test the circuit breaker opens, half opens after the sleep window and closes again
+func TestBreaker(t *testing.T) {
+	archaius.Conf.VirtualTime = true
+	archaius.Conf.Clients = map[string]archaius.Client{"staash": {Threshold: 50, Volume: 4, SleepWindow: "1s", Fallback: "cached"}}
+	defer func() {
+		archaius.Conf.VirtualTime = false
+		archaius.Conf.Clients = nil
+	}()
+	r := MakeRouter()
+	r.UseBreakers("test")
+	c := make(chan gotocol.Message)
+	s0 := names.Make("test", "us", "a", "s", "staash", 0)
+	s1 := names.Make("test", "us", "a", "s", "staash", 1)
+	j := names.Make("test", "us", "a", "j", "junk", 0)
+	r.Add(s0, c, time.Now())
+	r.Add(s1, c, time.Now())
+	r.Add(j, c, time.Now())
+	r.Success(s0)
+	r.Timeout(s0)
+	r.Failure(s0)
+	if r.State(s0) != Closed {
+		t.Errorf("circuit opened before reaching the volume")
+	}
+	r.Timeout(s0)
+	if r.State(s0) != Open || r.Allow(s0) {
+		t.Errorf("circuit didn't open: %v", r.State(s0))
+	}
+	for i := 0; i < 10; i++ {
+		if n, _ := r.Service("s").RandomRoute(); n != s1 {
+			t.Errorf("routed to %v with an open circuit", n)
+		}
+	}
+	if v, ok := r.Fallback(s0); !ok || v != "cached" {
+		t.Errorf("fallback %v %v", v, ok)
+	}
+	if _, ok := r.Fallback(j); ok {
+		t.Errorf("junk has no breaker so no fallback")
+	}
+	clock.Sleep(time.Second)
+	if !r.Allow(s0) || r.State(s0) != HalfOpen || r.Allow(s0) {
+		t.Errorf("circuit should let a single trial through: %v", r.State(s0))
+	}
+	r.Failure(s0)
+	if r.State(s0) != Open {
+		t.Errorf("failed trial should open the circuit: %v", r.State(s0))
+	}
+	clock.Sleep(time.Second)
+	r.Allow(s0)
+	r.Success(s0)
+	if r.State(s0) != Closed {
+		t.Errorf("successful trial should close the circuit: %v", r.State(s0))
+	}
+	for i := 0; i < 10; i++ {
+		r.Failure(j)
+	}
+	if r.State(j) != Closed || !r.Allow(j) {
+		t.Errorf("junk has no breaker")
+	}
+}
+
+// Test each load balancing rule picks the routes it should
+func TestRules(t *testing.T) {
+	c := make(chan gotocol.Message)
+	r := MakeRouter()
+	r.UseBreakers(names.Make("test", "us", "a", "z", "zuul", 0))
+	for i := 0; i < 4; i++ {
+		r.Add(names.Make("test", "us", []string{"a", "b"}[i/2], "s", "staash", i), c, time.Now())
+	}
+	ns := r.Names() // two routes in zone a then two in zone b
+	pick := func(rule string, routes []string) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < 400; i++ {
+			counts[Rules[rule](r, routes)]++
+		}
+		return counts
+	}
+	if counts := pick("roundrobin", ns); len(counts) != 4 || counts[ns[0]] != 100 {
+		t.Errorf("round robin %v", counts)
+	}
+	for _, n := range ns[1:] {
+		r.Sent(n)
+	}
+	if counts := pick("leastoutstanding", ns); counts[ns[0]] != 400 {
+		t.Errorf("least outstanding %v", counts)
+	}
+	if counts := pick("p2c", ns); counts[ns[0]] < 150 || counts[ns[0]] > 250 { // it's one of the two half the time
+		t.Errorf("power of two choices %v", counts)
+	}
+	for _, n := range ns[1:] {
+		r.Done(n, 90*time.Millisecond)
+	}
+	r.Done(ns[0], 10*time.Millisecond)
+	if r.Outstanding(ns[1]) != 0 || r.ResponseTime(ns[1]) != 90*time.Millisecond {
+		t.Errorf("load %v %v", r.Outstanding(ns[1]), r.ResponseTime(ns[1]))
+	}
+	if counts := pick("responsetime", ns); counts[ns[0]] < 250 { // weighted 9 to 1 against each of the others
+		t.Errorf("response time %v", counts)
+	}
+	if counts := pick("zoneaffinity", ns); len(counts) != 2 || counts[ns[0]]+counts[ns[1]] != 400 {
+		t.Errorf("zone affinity %v", counts)
+	}
+	if counts := pick("zoneaffinity", ns[1:]); len(counts) != 1 { // half of zone a has an open circuit
+		t.Errorf("zone affinity below the blackout %v", counts)
+	}
+	eu := names.Make("test", "eu", "a", "s", "staash", 4) // the same zone name in another region isn't local
+	r.Add(eu, c, time.Now())
+	if counts := pick("zoneaffinity", append(ns[1:], eu)); len(counts) != 1 {
+		t.Errorf("zone affinity in another region %v", counts)
+	}
+	r.Remove(eu)
+	archaius.Set("ribbon.blackout", "0.5")
+	archaius.Set("zuul.ribbon.rule", "leastoutstanding")
+	defer func() {
+		archaius.Set("ribbon.blackout", "0.8")
+		archaius.Set("zuul.ribbon.rule", "random")
+	}()
+	if counts := pick("zoneaffinity", ns[1:]); len(counts) != 3 {
+		t.Errorf("zone affinity should fail over at the blackout %v", counts)
+	}
+	for _, n := range []string{ns[0], ns[2], ns[3]} {
+		r.Sent(n)
+	}
+	if n, _ := r.Service("s").RandomRoute(); n != ns[1] {
+		t.Errorf("router didn't use the configured rule, picked %v", n)
+	}
+}
+
+// Test the sorted names, reverse channel lookup and subsets stay in step as routes come and go
+func TestIndex(t *testing.T) {
+	r := MakeRouter()
+	s := r.All("staash") // made before any routes, and before the router is set up
+	r.UseBreakers(names.Make("test", "us", "a", "z", "zuul", 0))
+	chans := make(map[string]chan gotocol.Message)
+	for _, i := range []int{3, 1, 4, 0, 2} {
+		n := names.Make("test", "us", "a", "s", []string{"staash", "store"}[i%2], i)
+		chans[n] = make(chan gotocol.Message)
+		r.Add(n, chans[n], time.Now())
+	}
+	ns := r.Names()
+	if !sort.StringsAreSorted(ns) || r.Len() != 5 || s.Len() != 3 || r.All("store").Len() != 2 || r.Service("s").Len() != 5 {
+		t.Fatalf("index %v, %v staash", ns, s.Len())
+	}
+	for n, c := range chans {
+		if r.NameChan(c) != n || r.Named(n) != c {
+			t.Errorf("lookup of %v", n)
+		}
+	}
+	r.Remove(ns[2])
+	r.Remove(ns[2]) // again does nothing
+	if r.Len() != 4 || r.NameChan(chans[ns[2]]) != "" || r.Service("s").Len() != 4 || s.Len()+r.All("store").Len() != 4 {
+		t.Errorf("remove %v left %v", ns[2], r)
+	}
+	c := make(chan gotocol.Message)
+	r.Add(ns[0], c, time.Now()) // a new channel for the same route
+	if r.Len() != 4 || r.NameChan(c) != ns[0] || r.NameChan(chans[ns[0]]) != "" || r.All(names.Package(ns[0])).Named(ns[0]) != c {
+		t.Errorf("replacing the channel of %v", ns[0])
+	}
+	if s.owner != r.owner || s.circuits == nil || s.load != r.load {
+		t.Errorf("subset made before the breakers doesn't share them")
+	}
+}
+
+// Test keys stay on their route, and only the keys of a route that goes away move
+func TestKeyRoute(t *testing.T) {
+	r := MakeRouter()
+	if n, c := r.KeyRoute("key"); n != "" || c != nil {
+		t.Fatal("empty router")
+	}
+	for i := 0; i < 4; i++ {
+		r.Add(names.Make("test", "us", "a", "c", "cache", i), make(chan gotocol.Message), time.Now())
+	}
+	on := make(map[string]string)
+	count := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		k := fmt.Sprint("key", i)
+		n, c := r.KeyRoute(k)
+		if n2, _ := r.KeyRoute(k); n2 != n || r.Named(n) != c {
+			t.Fatalf("%v moved from %v to %v", k, n, n2)
+		}
+		on[k] = n
+		count[n]++
+	}
+	if len(count) != 4 {
+		t.Errorf("keys spread over %v", count)
+	}
+	gone := r.Names()[0]
+	r.Remove(gone)
+	for k, n := range on {
+		if m, _ := r.KeyRoute(k); n != gone && m != n || m == gone {
+			t.Errorf("%v moved from %v to %v", k, n, m)
+		}
+	}
+}
+
+const benchRoutes = 10000
+
+// benchRouter with routes spread over three zones and ten services in five packages, and their channels
+func benchRouter(n int) (*Router, []chan gotocol.Message) {
+	r := MakeRouter()
+	r.UseBreakers(names.Make("bench", "us", "a", "zuul", "zuul", 0))
+	chans := make([]chan gotocol.Message, n)
+	for i := range chans {
+		chans[i] = make(chan gotocol.Message)
+		r.Add(names.Make("bench", "us", fmt.Sprint("zone", i%3), fmt.Sprint("service", i%10), fmt.Sprint("package", i%5), i), chans[i], time.Now())
+	}
+	return r, chans
+}
+
+func BenchmarkAddRemove(b *testing.B) {
+	r, _ := benchRouter(benchRoutes)
+	r.All("package1")
+	r.Service("service1")
+	c := make(chan gotocol.Message)
+	n := names.Make("bench", "us", "zone1", "service1", "package1", benchRoutes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Add(n, c, time.Now())
+		r.Remove(n)
+	}
+}
+
+func BenchmarkRandom(b *testing.B) {
+	r, _ := benchRouter(benchRoutes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Random()
+	}
+}
+
+func BenchmarkAll(b *testing.B) {
+	r, _ := benchRouter(benchRoutes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.All("package1").Random()
+	}
+}
+
+func BenchmarkService(b *testing.B) {
+	r, _ := benchRouter(benchRoutes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Service("service1").Random()
+	}
+}
+
+func BenchmarkNameChan(b *testing.B) {
+	r, chans := benchRouter(benchRoutes)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.NameChan(chans[i%len(chans)])
+	}
+}
@@ -0,0 +1,193 @@
+package ribbon
+
+import (
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/names"
+	"log"
+	"sort"
+	"time"
+)
+
+// Rule picks the route for a request, from the sorted routes that their circuit breakers allow, there is always at least one
+type Rule func(r *Router, routes []string) string
+
+// Rules by the name an architecture or the ribbon.rule property chooses them with, add to it before the simulation starts to try another
+var Rules = map[string]Rule{
+	"random":           anywhere,
+	"roundrobin":       roundRobin,
+	"leastoutstanding": leastOutstanding,
+	"responsetime":     responseTime,
+	"zoneaffinity":     zoneAffinity,
+	"p2c":              powerOfTwo,
+}
+
+// weight of the latest response in the moving average of the response time of a route
+const decay = 0.2
+
+// load the owner has put on each route, shared by the routers made from its router
+type load struct {
+	outstanding map[string]int           // requests sent that haven't come back
+	rt          map[string]time.Duration // moving average of the response time
+	last        string                   // route picked last, for round robin
+	rule        Rule                     // rule the owner is configured with
+	version     int                      // of the properties when the rule was looked up
+}
+
+func makeLoad() *load {
+	var l load
+	l.outstanding = make(map[string]int)
+	l.rt = make(map[string]time.Duration)
+	return &l
+}
+
+// Sent a request on a route
+func (r *Router) Sent(route string) {
+	r.load.outstanding[route]++
+}
+
+// Done with a request on a route, however it ended, rt is how long it took
+func (r *Router) Done(route string, rt time.Duration) {
+	if r.load.outstanding[route] > 0 {
+		r.load.outstanding[route]--
+	}
+	if old, ok := r.load.rt[route]; ok {
+		rt = time.Duration(decay*float64(rt) + (1-decay)*float64(old))
+	}
+	r.load.rt[route] = rt
+}
+
+// Outstanding requests on a route
+func (r *Router) Outstanding(route string) int {
+	return r.load.outstanding[route]
+}
+
+// ResponseTime of a route, a moving average, zero until a request has come back
+func (r *Router) ResponseTime(route string) time.Duration {
+	return r.load.rt[route]
+}
+
+// rule the owner is configured with, random if it hasn't got one, looked up again when a property changes
+func (r *Router) rule() Rule {
+	if r.owner == "" {
+		return anywhere
+	}
+	if v := archaius.Version(); v != r.load.version {
+		r.load.rule, r.load.version = anywhere, v
+		if n := archaius.RuleFor(r.owner); n != "" {
+			rule, ok := Rules[n]
+			if !ok {
+				log.Fatalf("%v: unknown load balancing rule %v\n", r.owner, n)
+			}
+			r.load.rule = rule
+		}
+	}
+	return r.load.rule
+}
+
+// anywhere picks a route at random, the default
+func anywhere(r *Router, routes []string) string {
+	return routes[r.rand.Intn(len(routes))]
+}
+
+// roundRobin takes the next route in order after the last one picked, starting at a random route so callers don't all start together
+func roundRobin(r *Router, routes []string) string {
+	if r.load.last == "" {
+		r.load.last = anywhere(r, routes)
+		return r.load.last
+	}
+	i := sort.SearchStrings(routes, r.load.last)
+	if i < len(routes) && routes[i] == r.load.last {
+		i++
+	}
+	r.load.last = routes[i%len(routes)]
+	return r.load.last
+}
+
+// leastOutstanding picks the route with the fewest requests in flight, ties go to the first after a random start
+func leastOutstanding(r *Router, routes []string) string {
+	i := r.rand.Intn(len(routes))
+	best := routes[i]
+	for j := 1; j < len(routes); j++ {
+		if n := routes[(i+j)%len(routes)]; r.Outstanding(n) < r.Outstanding(best) {
+			best = n
+		}
+	}
+	return best
+}
+
+// responseTime picks a route at random, weighted by the inverse of its response time
+// routes that haven't responded yet get the mean of the ones that have, so new instances get traffic
+func responseTime(r *Router, routes []string) string {
+	var sum time.Duration
+	var known int
+	for _, n := range routes {
+		if rt, ok := r.load.rt[n]; ok {
+			sum += rt
+			known++
+		}
+	}
+	if known == 0 {
+		return anywhere(r, routes)
+	}
+	weights := make([]float64, len(routes))
+	var total float64
+	for i, n := range routes {
+		rt, ok := r.load.rt[n]
+		if !ok {
+			rt = sum / time.Duration(known)
+		}
+		if rt < time.Microsecond {
+			rt = time.Microsecond // instant responses are as good as each other
+		}
+		weights[i] = 1 / rt.Seconds()
+		total += weights[i]
+	}
+	x := r.rand.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return routes[i]
+		}
+		x -= w
+	}
+	return routes[len(routes)-1]
+}
+
+// zoneAffinity picks at random from the routes in the owner's zone, failing over to every zone when it has none
+// or when the fraction of its routes with open circuits reaches ribbon.blackout, which defaults to 0.8 as in ribbon
+func zoneAffinity(r *Router, routes []string) string {
+	zone := names.RegionZone(r.owner) // zone names repeat in each region
+	var local []string
+	for _, n := range routes {
+		if names.RegionZone(n) == zone {
+			local = append(local, n)
+		}
+	}
+	if len(local) == 0 {
+		return anywhere(r, routes)
+	}
+	all := r.zones[zone]
+	if float64(all-len(local))/float64(all) >= archaius.Float(r.owner, "ribbon.blackout", 0.8) {
+		return anywhere(r, routes)
+	}
+	return anywhere(r, local)
+}
+
+// powerOfTwo picks two routes at random and takes the one with fewer requests in flight, then the faster one
+func powerOfTwo(r *Router, routes []string) string {
+	if len(routes) == 1 {
+		return routes[0]
+	}
+	i := r.rand.Intn(len(routes))
+	j := r.rand.Intn(len(routes) - 1)
+	if j >= i {
+		j++ // a different route
+	}
+	a, b := routes[i], routes[j]
+	switch {
+	case r.Outstanding(b) < r.Outstanding(a):
+		return b
+	case r.Outstanding(b) == r.Outstanding(a) && r.ResponseTime(b) < r.ResponseTime(a):
+		return b
+	}
+	return a
+}
@@ -0,0 +1,211 @@
+package usl
+
+import (
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/flow"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"github.com/adrianco/spigo/tooling/random"
+	"github.com/go-kit/kit/metrics/generic"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Load shedding policies for when the request queue is full
+const (
+	Reject     = "reject"      // turn away the new request
+	DropOldest = "drop-oldest" // make room by dropping the request that has waited longest
+	Block      = "block"       // hold the sender until there's room
+)
+
+// Service models the capacity of a service instance, service time grows with concurrency following the Universal Scalability Law
+// and a pool of workers takes requests from a bounded queue
+type Service struct {
+	lock     sync.Mutex // responses can complete on other goroutines
+	name     string
+	rand     *rand.Rand
+	dist     string
+	mean     time.Duration
+	sigma    float64
+	kappa    float64
+	active   int                      // requests being served right now
+	listener chan gotocol.Message     // where queued requests are redelivered when a worker is free
+	workers  int                      // size of the worker pool, 0 is unlimited
+	size     int                      // size of the queue
+	policy   string                   // what to do when the queue is full
+	busy     int                      // workers holding a request
+	queue    []gotocol.Message        // requests waiting for a worker
+	blocked  []gotocol.Message        // requests from senders waiting for room in the queue
+	ready    map[gotocol.Context]bool // requests that were given a worker while queued
+	depth    *generic.Gauge           // queue depth
+	waiting  *generic.Gauge           // blocked senders
+	rejected *generic.Counter         // requests turned away
+	dropped  *generic.Counter         // requests dropped from the queue
+}
+
+// NewService looks up the capacity model for a named service instance by service then package, nil if there isn't one
+func NewService(name string, r *rand.Rand, listener chan gotocol.Message) *Service {
+	c, ok := archaius.CapacityFor(name)
+	if !ok || (c.ServiceTime == "" && c.Workers == 0) {
+		return nil
+	}
+	var mean time.Duration
+	var err error
+	if c.ServiceTime != "" {
+		mean, err = time.ParseDuration(c.ServiceTime)
+		if err != nil {
+			log.Fatalf("usl: bad service time for %v: %v\n", name, err)
+		}
+	}
+	if !random.Valid(c.Distribution) {
+		log.Fatalf("usl: unknown distribution %v for %v\n", c.Distribution, name)
+	}
+	switch c.Policy {
+	case "", Reject, DropOldest, Block:
+	default:
+		log.Fatalf("usl: unknown queue policy %v for %v\n", c.Policy, name)
+	}
+	s := &Service{name: name, rand: r, dist: c.Distribution, mean: mean, sigma: c.Sigma, kappa: c.Kappa}
+	s.listener = listener
+	s.workers = c.Workers
+	s.size = c.Queue
+	s.policy = c.Policy
+	s.ready = make(map[gotocol.Context]bool)
+	if s.workers > 0 {
+		s.depth = collect.NewGauge(name + "_queue")
+		s.waiting = collect.NewGauge(name + "_blocked")
+		s.rejected = collect.NewCounter(name + "_rejected")
+		s.dropped = collect.NewCounter(name + "_dropped")
+	}
+	return s
+}
+
+// Admit a request to a worker, returns false if it has to wait in the queue or was turned away
+// queued requests are redelivered to the listener once a worker is free, a nil service admits everything
+func (s *Service) Admit(msg gotocol.Message) bool {
+	if s == nil {
+		return true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.ready[msg.Ctx] {
+		delete(s.ready, msg.Ctx) // a worker was kept for it when it left the queue
+		return true
+	}
+	if s.workers == 0 || s.busy < s.workers {
+		s.busy++
+		return true
+	}
+	if len(s.queue) < s.size {
+		s.queue = append(s.queue, msg)
+	} else {
+		switch s.policy {
+		case DropOldest:
+			if len(s.queue) > 0 {
+				s.shed(s.queue[0])
+				s.queue = append(s.queue[1:], msg)
+				collect.Count(s.dropped)
+			} else {
+				s.shed(msg) // no queue to make room in
+				collect.Count(s.rejected)
+			}
+		case Block:
+			s.blocked = append(s.blocked, msg)
+			gotocol.Hold(msg.ResponseChan) // the sender gets nothing done until its request is let in
+		default:
+			s.shed(msg)
+			collect.Count(s.rejected)
+		}
+	}
+	s.gauges()
+	return false
+}
+
+// Release the worker held by a request, handing it to the next request waiting
+func (s *Service) Release() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.busy--
+	var next gotocol.Message
+	switch {
+	case len(s.queue) > 0:
+		next = s.queue[0]
+		s.queue = s.queue[1:]
+	case len(s.blocked) > 0:
+		next = s.blocked[0]
+		s.blocked = s.blocked[1:]
+		gotocol.Unhold(next.ResponseChan)
+	default:
+		s.lock.Unlock()
+		return
+	}
+	for len(s.blocked) > 0 && len(s.queue) < s.size {
+		s.queue = append(s.queue, s.blocked[0]) // let a blocked sender in
+		gotocol.Unhold(s.blocked[0].ResponseChan)
+		s.blocked = s.blocked[1:]
+	}
+	s.busy++
+	s.ready[next.Ctx] = true
+	s.gauges()
+	s.lock.Unlock()
+	next.Redeliver(s.listener)
+}
+
+// Stop the service when its instance goes away, letting go of the senders it has blocked
+func (s *Service) Stop() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	for _, msg := range s.blocked {
+		gotocol.Unhold(msg.ResponseChan)
+	}
+	s.blocked = nil
+	s.gauges()
+	s.lock.Unlock()
+}
+
+// shed a request, telling the sender it was throttled
+func (s *Service) shed(msg gotocol.Message) {
+	if msg.ResponseChan == nil {
+		return
+	}
+	outmsg := gotocol.Message{gotocol.Error, s.listener, clock.Now(), msg.Ctx, gotocol.Throttled}
+	flow.AnnotateSend(outmsg, s.name)
+	outmsg.GoSend(msg.ResponseChan)
+}
+
+// update the queue gauges, called with the lock held
+func (s *Service) gauges() {
+	collect.Gauge(s.depth, len(s.queue))
+	collect.Gauge(s.waiting, len(s.blocked))
+}
+
+// Start serving a request while others are waiting on dependencies, returns the service time, call Done once it's served
+// a nil service has no capacity model and responds instantly
+func (s *Service) Start(others int) time.Duration {
+	if s == nil {
+		return 0
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.active++
+	n := float64(s.active + others)
+	// with unit throughput ResponseRN is the factor the service time grows by at concurrency n
+	return time.Duration(float64(random.Sample(s.rand, s.dist, s.mean)) * ResponseRN(n, 1.0, s.sigma, s.kappa))
+}
+
+// Done serving a request
+func (s *Service) Done() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	s.active--
+	s.lock.Unlock()
+}
@@ -3,7 +3,11 @@ package usl
 
 import (
 	"fmt"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/gotocol"
+	"math/rand"
 	"testing"
+	"time"
 )
 
 func TestUSL(t *testing.T) {
@@ -24,3 +28,110 @@ func TestUSL(t *testing.T) {
 		}
 	}
 }
+
+func TestService(t *testing.T) {
+	if NewService("test.us-east-1.zoneA..karyon00...karyon.karyon", nil, nil) != nil {
+		t.Errorf("service without a capacity model should be nil")
+	}
+	var none *Service
+	if none.Start(10) != 0 {
+		t.Errorf("nil service should respond instantly")
+	}
+	none.Done()
+	archaius.Conf.Capacity = map[string]archaius.Capacity{"karyon": {Distribution: "fixed", ServiceTime: "1ms", Sigma: 0.1, Kappa: 0.01}}
+	defer func() { archaius.Conf.Capacity = nil }()
+	s := NewService("test.us-east-1.zoneA..homepage00...homepage.karyon", rand.New(rand.NewSource(1)), nil)
+	if d := s.Start(0); d != time.Millisecond {
+		t.Errorf("service time for one request %v", d)
+	}
+	last := time.Millisecond
+	for i := 0; i < 5; i++ {
+		d := s.Start(i)
+		fmt.Printf("concurrency %v service time %v\n", s.active+i, d)
+		if d <= last {
+			t.Errorf("service time should grow with concurrency")
+		}
+		last = d
+	}
+	for i := 0; i < 6; i++ {
+		s.Done()
+	}
+	if d := s.Start(0); d != time.Millisecond {
+		t.Errorf("service time after draining %v", d)
+	}
+}
+
+func TestPool(t *testing.T) {
+	for _, policy := range []string{Reject, DropOldest, Block} {
+		archaius.Conf.Capacity = map[string]archaius.Capacity{"store": {Workers: 2, Queue: 1, Policy: policy}}
+		listener := make(chan gotocol.Message, 10)
+		s := NewService("test.us-east-1.zoneA..store00...store.store", rand.New(rand.NewSource(1)), listener)
+		admitted := 0
+		for i := 0; i < 5; i++ {
+			if s.Admit(gotocol.Message{gotocol.GetRequest, nil, time.Now(), gotocol.NewTrace(), "why?"}) {
+				admitted++
+			}
+		}
+		if admitted != 2 || len(s.queue) != 1 {
+			t.Errorf("%v: admitted %v queued %v", policy, admitted, len(s.queue))
+		}
+		redelivered := 0
+		for i := 0; i < 5; i++ {
+			s.Release()
+		}
+		for done := false; !done; {
+			select {
+			case msg := <-listener: // redelivered on another goroutine
+				if !s.Admit(msg) {
+					t.Errorf("%v: redelivered requests should be admitted", policy)
+				}
+				redelivered++
+			case <-time.After(100 * time.Millisecond):
+				done = true
+			}
+		}
+		want := 1
+		if policy == Block {
+			want = 3 // blocked senders get in as the queue drains
+		}
+		if redelivered != want {
+			t.Errorf("%v: redelivered %v not %v", policy, redelivered, want)
+		}
+	}
+	archaius.Conf.Capacity = nil
+}
+
+// Test a sender blocked on a full queue is held, getting no messages until its request is let in
+func TestBlock(t *testing.T) {
+	archaius.Conf.Capacity = map[string]archaius.Capacity{"store": {Workers: 1, Queue: 1, Policy: Block}}
+	defer func() { archaius.Conf.Capacity = nil }()
+	listener := make(chan gotocol.Message, 10)
+	s := NewService("test.us-east-1.zoneA..store00...store.store", rand.New(rand.NewSource(1)), listener)
+	caller := make(chan gotocol.Message, 10)
+	for i := 0; i < 3; i++ {
+		s.Admit(gotocol.Message{gotocol.GetRequest, caller, time.Now(), gotocol.NewTrace(), "why?"})
+	}
+	gotocol.Send(caller, gotocol.Message{gotocol.GetResponse, nil, time.Now(), gotocol.NilContext, "earlier"})
+	select {
+	case msg := <-caller:
+		t.Fatalf("blocked caller got %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Release() // the queued request gets the worker, and the blocked one gets into the queue
+	select {
+	case msg := <-caller:
+		if msg.Intention != "earlier" {
+			t.Errorf("caller got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("caller is still held once its request was let in")
+	}
+	s.Admit(gotocol.Message{gotocol.GetRequest, caller, time.Now(), gotocol.NewTrace(), "why?"})
+	s.Stop() // an instance going away lets go of the senders it blocked
+	gotocol.Send(caller, gotocol.Message{gotocol.GetResponse, nil, time.Now(), gotocol.NilContext, "later"})
+	select {
+	case <-caller:
+	case <-time.After(time.Second):
+		t.Fatal("caller is still held once the service stopped")
+	}
+}
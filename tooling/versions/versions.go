@@ -0,0 +1,235 @@
+// Package versions attaches a version to each value written to a key value store, a timestamp and a vector clock,
+// so replicas can resolve conflicting writes by last write wins, or keep concurrent writes as siblings
+// Reads that return an older version than the latest committed write are counted as stale
+package versions
+
+import (
+	"fmt"
+	"github.com/adrianco/spigo/tooling/archaius"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/names"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolutions of conflicting writes, set by the versions.resolution property
+const (
+	LastWriteWins = "lww"      // the write with the latest timestamp, the default
+	Siblings      = "siblings" // every write that doesn't descend from another, read back together
+)
+
+// Version of a value, values are single words as they travel in messages after their key
+type Version struct {
+	Value string
+	Stamp int64          // nanoseconds of the clock at the write
+	Clock map[string]int // writes each node has coordinated that this one descends from
+}
+
+// Values of a key, one version with last write wins, or siblings sorted by timestamp
+type Values []Version
+
+// Resolution a node uses for conflicting writes
+func Resolution(name string) string {
+	return archaius.String(name, "versions.resolution", LastWriteWins)
+}
+
+// New version of a value written by a node, it descends from the versions the node has
+func New(name, value string, old Values) Version {
+	v := Version{value, clock.Now().UnixNano(), make(map[string]int)}
+	for _, o := range old {
+		for n, c := range o.Clock {
+			if c > v.Clock[n] {
+				v.Clock[n] = c
+			}
+		}
+	}
+	v.Clock[name]++
+	return v
+}
+
+// Descends is true if a version has seen every write the other one has
+func (v Version) Descends(w Version) bool {
+	for n, c := range w.Clock {
+		if v.Clock[n] < c {
+			return false
+		}
+	}
+	return len(w.Clock) > 0 || v.Stamp >= w.Stamp
+}
+
+// newer is true if a version wins over another with last write wins, ties go to the larger value so replicas agree
+func (v Version) newer(w Version) bool {
+	if v.Stamp != w.Stamp {
+		return v.Stamp > w.Stamp
+	}
+	if v.Value != w.Value {
+		return v.Value > w.Value
+	}
+	return v.String() > w.String()
+}
+
+// String encodes a version as value@stamp@node=count|node=count, a value that was stored without a version is just itself
+func (v Version) String() string {
+	if v.Stamp == 0 && len(v.Clock) == 0 {
+		return v.Value
+	}
+	ns := make([]string, 0, len(v.Clock))
+	for n := range v.Clock {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	for i, n := range ns {
+		ns[i] = fmt.Sprintf("%v=%v", n, v.Clock[n])
+	}
+	return fmt.Sprintf("%v@%v@%v", v.Value, v.Stamp, strings.Join(ns, "|"))
+}
+
+// String encodes the values of a key as a comma separated list of versions
+func (vs Values) String() string {
+	s := make([]string, len(vs))
+	for i, v := range vs {
+		s[i] = v.String()
+	}
+	return strings.Join(s, ",")
+}
+
+// Data is what a client reads, the value, or the comma separated values of the siblings
+func (vs Values) Data() string {
+	s := make([]string, len(vs))
+	for i, v := range vs {
+		s[i] = v.Value
+	}
+	return strings.Join(s, ",")
+}
+
+// Parse the encoded values of a key, a value without a version is older than any with one
+func Parse(s string) Values {
+	if s == "" {
+		return nil
+	}
+	var vs Values
+	for _, e := range strings.Split(s, ",") {
+		f := strings.Split(e, "@")
+		if len(f) != 3 {
+			vs = append(vs, Version{Value: e})
+			continue
+		}
+		v := Version{Value: f[0], Clock: make(map[string]int)}
+		fmt.Sscanf(f[1], "%d", &v.Stamp)
+		for _, c := range strings.Split(f[2], "|") {
+			if i := strings.LastIndex(c, "="); i > 0 {
+				var n int
+				fmt.Sscanf(c[i+1:], "%d", &n)
+				v.Clock[c[:i]] = n
+			}
+		}
+		vs = append(vs, v)
+	}
+	return vs
+}
+
+// Merge the values of a key, keeping the latest write, or the siblings that no other version descends from
+func Merge(resolution string, a, b Values) Values {
+	all := append(append(Values{}, a...), b...)
+	if len(all) == 0 {
+		return nil
+	}
+	if resolution != Siblings {
+		best := all[0]
+		for _, v := range all[1:] {
+			if v.newer(best) {
+				best = v
+			}
+		}
+		return Values{best}
+	}
+	var vs Values
+	for i, v := range all {
+		dominated := false
+		for j, w := range all {
+			// an identical version is kept once, the first time it's seen
+			if i != j && w.Descends(v) && (!v.Descends(w) || j < i) {
+				dominated = true
+				break
+			}
+		}
+		if !dominated {
+			vs = append(vs, v)
+		}
+	}
+	sort.Sort(byStamp(vs))
+	return vs
+}
+
+// byStamp sorts siblings so every replica encodes them the same way
+type byStamp Values
+
+func (a byStamp) Len() int           { return len(a) }
+func (a byStamp) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byStamp) Less(i, j int) bool { return a[j].newer(a[i]) }
+
+// Covers is true if the values of a key include the latest write, or with siblings a write that descends from each of the latest
+func (vs Values) Covers(resolution string, latest Values) bool {
+	for _, l := range latest {
+		covered := false
+		for _, v := range vs {
+			if resolution == Siblings && v.Descends(l) || resolution != Siblings && !l.newer(v) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+// stamp of the latest version
+func (vs Values) stamp() int64 {
+	var s int64
+	for _, v := range vs {
+		if v.Stamp > s {
+			s = v.Stamp
+		}
+	}
+	return s
+}
+
+// latest committed values of each key of each service
+var (
+	committed = make(map[string]Values)
+	lock      sync.Mutex
+)
+
+// Committed write of a key to a service, once it's met its consistency level
+func Committed(name, key string, vs Values) {
+	k := names.Service(name) + " " + key
+	lock.Lock()
+	committed[k] = Merge(Resolution(name), committed[k], vs)
+	lock.Unlock()
+}
+
+// Latest committed values of a key in a service
+func Latest(name, key string) Values {
+	lock.Lock()
+	defer lock.Unlock()
+	return committed[names.Service(name)+" "+key]
+}
+
+// Check a read of a key that returned values, against the latest committed when the read started. A stale read is
+// counted in <service>_stale_reads, and how long after the latest write it was saved to csv_metrics/<arch>_<service>_staleness.csv,
+// reads that returned siblings are counted in <service>_sibling_reads.
+func Check(name string, latest, got Values) {
+	if len(got) > 1 {
+		collect.ServiceCount(name, "_sibling_reads")
+	}
+	if got.Covers(Resolution(name), latest) {
+		return
+	}
+	collect.ServiceCount(name, "_stale_reads")
+	collect.Measure(collect.ServiceHist(name, "_staleness"), time.Duration(clock.Now().UnixNano()-latest.stamp()))
+}
@@ -0,0 +1,61 @@
+package versions
+
+import (
+	"testing"
+)
+
+// Test versions round trip through their encoding
+func TestParse(t *testing.T) {
+	v := Version{"me", 1000, map[string]int{"a.b": 2, "c": 1}}
+	s := Values{v, {Value: "old"}}.String()
+	if s != "me@1000@a.b=2|c=1,old" {
+		t.Fatalf("encoded %v", s)
+	}
+	vs := Parse(s)
+	if len(vs) != 2 || vs[0].String() != v.String() || vs[1].Value != "old" || vs[1].Stamp != 0 {
+		t.Errorf("parsed %v", vs)
+	}
+	if vs.Data() != "me,old" || Parse("") != nil {
+		t.Errorf("data %v", vs.Data())
+	}
+}
+
+// Test concurrent writes are resolved by timestamp, or kept as siblings until a write descends from both
+func TestMerge(t *testing.T) {
+	base := Version{"a", 100, map[string]int{"x": 1}}
+	left := Version{"b", 200, map[string]int{"x": 2}}
+	right := Version{"c", 150, map[string]int{"x": 1, "y": 1}}
+	if lww := Merge(LastWriteWins, Values{base, right}, Values{left}); len(lww) != 1 || lww[0].Value != "b" {
+		t.Errorf("last write wins got %v", lww)
+	}
+	sib := Merge(Siblings, Values{base, right}, Values{left, right})
+	if len(sib) != 2 || sib.Data() != "c,b" {
+		t.Fatalf("siblings got %v", sib)
+	}
+	both := Version{"d", 300, map[string]int{"x": 2, "y": 2}}
+	if m := Merge(Siblings, sib, Values{both}); len(m) != 1 || m[0].Value != "d" {
+		t.Errorf("a write that descends from both siblings got %v", m)
+	}
+	if Merge(LastWriteWins, nil, nil) != nil {
+		t.Error("merged nothing")
+	}
+}
+
+// Test a read is stale unless it covers the latest committed write
+func TestCovers(t *testing.T) {
+	old := Version{"a", 100, map[string]int{"x": 1}}
+	latest := Values{{"b", 200, map[string]int{"x": 2}}}
+	for _, r := range []string{LastWriteWins, Siblings} {
+		if (Values{old}).Covers(r, latest) || Values(nil).Covers(r, latest) {
+			t.Errorf("%v old read covers the latest", r)
+		}
+		if !latest.Covers(r, latest) || !latest.Covers(r, nil) {
+			t.Errorf("%v latest read is stale", r)
+		}
+	}
+	// a concurrent write with a later timestamp wins with last write wins, but doesn't descend from the latest
+	later := Values{{"c", 300, map[string]int{"x": 1, "y": 1}}}
+	if !later.Covers(LastWriteWins, latest) || later.Covers(Siblings, latest) {
+		t.Error("concurrent write")
+	}
+}
@@ -0,0 +1,365 @@
+// Package workload describes the load that root services generate, read from named profiles in json_arch/workloads.json
+// A profile sets the mix of requests, how popular each key is, how the request rate changes over time
+// and whether requests arrive regularly, as a poisson process, replayed from a file, or from a closed loop of users
+package workload
+
+import (
+	"encoding/json"
+	"github.com/adrianco/spigo/tooling/clock"
+	"github.com/adrianco/spigo/tooling/collect"
+	"github.com/adrianco/spigo/tooling/random"
+	"github.com/go-kit/kit/metrics/generic"
+	"io/ioutil"
+	"log"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of request in the mix
+const (
+	Miss   = iota // get a key that doesn't exist
+	Get           // get a key that has already been put
+	Put           // put a new key
+	Update        // put a new value for a key that has already been put
+)
+
+// Key popularity
+const (
+	Uniform = "uniform" // every key that has been put is as likely as any other
+	Zipf    = "zipf"    // a few of the oldest keys are requested far more than the rest
+	Hotspot = "hotspot" // a hot fraction of the keys gets a fixed share of the requests
+)
+
+// Rate curves
+const (
+	Constant = "constant" // base rate all the time
+	Ramp     = "ramp"     // base rate rising linearly to the peak over the length of the ramp, then staying there
+	Step     = "step"     // base rate until the step time, then the peak
+	Sine     = "diurnal"  // base rate rising to the peak half way through each period, then falling again
+	Spike    = "spike"    // peak rate for the length of the spike at the given time, base rate otherwise
+)
+
+// Arrival processes
+const (
+	Regular = "regular" // evenly spaced at the current rate
+	Poisson = "poisson" // exponential gaps with a mean of the current interval
+	Replay  = "replay"  // gaps read from a file, repeated when they run out
+	Closed  = "closed"  // a fixed number of users, each waits for a response then thinks before sending the next request
+)
+
+// Profile of the load a root service generates
+type Profile struct {
+	// Mix of requests as relative weights
+	Mix Mix `json:"mix"`
+
+	// Keys sets how popular each key is
+	Keys Keys `json:"keys"`
+
+	// Rate of requests over time
+	Rate Rate `json:"rate"`
+
+	// Arrivals sets how the requests are spaced out
+	Arrivals Arrivals `json:"arrivals"`
+
+	gaps     []time.Duration // read from the replay file
+	think    time.Duration   // mean think time for closed loop users
+	patience time.Duration   // how long they wait for a response
+}
+
+// Mix of requests, all zero is an even mix
+type Mix struct {
+	Miss   float64 `json:"miss"`   // gets for keys that don't exist
+	Get    float64 `json:"get"`    // gets for keys that have been put
+	Put    float64 `json:"put"`    // puts of new keys
+	Update float64 `json:"update"` // puts of keys that have been put, picked by popularity, so writes can conflict
+}
+
+// Keys popularity, uniform, zipf or hotspot
+type Keys struct {
+	Popularity string  `json:"popularity"`
+	Skew       float64 `json:"skew"`     // zipf exponent, greater than 1, defaults to 1.1
+	Hot        float64 `json:"hot"`      // fraction of the keys that are hot
+	HotShare   float64 `json:"hotshare"` // fraction of the gets that go to hot keys
+}
+
+// Rate curve, in requests per second
+type Rate struct {
+	Shape    string  `json:"shape"`    // constant, ramp, step, diurnal or spike
+	Base     float64 `json:"base"`     // base rate, defaults to the chat interval
+	Peak     float64 `json:"peak"`     // peak rate
+	At       string  `json:"at"`       // time of the step or spike
+	Duration string  `json:"duration"` // length of the ramp or spike
+	Period   string  `json:"period"`   // period of the diurnal cycle
+}
+
+// Arrivals process, the rate curve sets the mean interval for regular and poisson arrivals
+type Arrivals struct {
+	Process      string `json:"process"`      // regular, poisson, replay or closed, defaults to regular
+	File         string `json:"file"`         // replay file next to the profiles, with one duration per line
+	Users        int    `json:"users"`        // closed loop virtual users
+	Think        string `json:"think"`        // closed loop mean think time between a response and the next request
+	Distribution string `json:"distribution"` // think time distribution, fixed, uniform or exponential
+	Patience     string `json:"patience"`     // how long a closed loop user waits for a response before moving on, default 1s
+}
+
+var (
+	lock     sync.Mutex
+	profiles map[string]*Profile // read from the file the first time one is looked up
+)
+
+// File holding the named profiles
+var File = "json_arch/workloads.json"
+
+// Lookup a named profile
+func Lookup(name string) *Profile {
+	lock.Lock()
+	defer lock.Unlock()
+	if profiles == nil {
+		log.Println("Loading workload profiles from " + File)
+		data, err := ioutil.ReadFile(File)
+		if err != nil {
+			log.Fatal(err)
+		}
+		profiles = make(map[string]*Profile)
+		if err := json.Unmarshal(data, &profiles); err != nil {
+			log.Fatalf("workload: %v: %v\n", File, err)
+		}
+		for n, p := range profiles {
+			p.check(n)
+		}
+	}
+	p, ok := profiles[name]
+	if !ok {
+		log.Fatalf("workload: no profile named %v in %v\n", name, File)
+	}
+	return p
+}
+
+// check a profile can be used
+func (p *Profile) check(name string) {
+	switch p.Keys.Popularity {
+	case "", Uniform, Zipf, Hotspot:
+	default:
+		log.Fatalf("workload: unknown key popularity %v for %v\n", p.Keys.Popularity, name)
+	}
+	switch p.Rate.Shape {
+	case "", Constant, Ramp, Step, Sine, Spike:
+	default:
+		log.Fatalf("workload: unknown rate shape %v for %v\n", p.Rate.Shape, name)
+	}
+	for _, d := range []string{p.Rate.At, p.Rate.Duration, p.Rate.Period} {
+		if d != "" {
+			if _, err := time.ParseDuration(d); err != nil {
+				log.Fatalf("workload: bad rate for %v: %v\n", name, err)
+			}
+		}
+	}
+	a := p.Arrivals
+	switch a.Process {
+	case "", Regular, Poisson:
+	case Replay:
+		p.gaps = read(filepath.Join(filepath.Dir(File), a.File), name)
+	case Closed:
+		if a.Users < 1 {
+			log.Fatalf("workload: closed loop %v needs some users\n", name)
+		}
+		if a.Think != "" {
+			var err error
+			if p.think, err = time.ParseDuration(a.Think); err != nil {
+				log.Fatalf("workload: bad think time for %v: %v\n", name, err)
+			}
+		}
+		p.patience = time.Second
+		if a.Patience != "" {
+			var err error
+			if p.patience, err = time.ParseDuration(a.Patience); err != nil || p.patience <= 0 {
+				log.Fatalf("workload: bad patience for %v: %v\n", name, a.Patience)
+			}
+		}
+		if !random.Valid(a.Distribution) {
+			log.Fatalf("workload: unknown think time distribution %v for %v\n", a.Distribution, name)
+		}
+	default:
+		log.Fatalf("workload: unknown arrival process %v for %v\n", a.Process, name)
+	}
+}
+
+// read the gaps between arrivals from a file, one duration per line
+func read(file, name string) []time.Duration {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatalf("workload: replay for %v: %v\n", name, err)
+	}
+	var gaps []time.Duration
+	for _, l := range strings.Split(string(data), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		d, err := time.ParseDuration(l)
+		if err != nil || d <= 0 {
+			log.Fatalf("workload: bad gap %q in %v\n", l, file)
+		}
+		gaps = append(gaps, d)
+	}
+	if len(gaps) == 0 {
+		log.Fatalf("workload: no gaps to replay in %v\n", file)
+	}
+	return gaps
+}
+
+// duration that's already been checked, zero if empty
+func duration(d string) time.Duration {
+	t, _ := time.ParseDuration(d)
+	return t
+}
+
+// Kind of the next request, Miss, Get, Put or Update
+func (p *Profile) Kind(r *rand.Rand) int {
+	m := p.Mix
+	total := m.Miss + m.Get + m.Put + m.Update
+	if total <= 0 {
+		return r.Intn(3)
+	}
+	x := r.Float64() * total
+	switch {
+	case x < m.Miss:
+		return Miss
+	case x < m.Miss+m.Get:
+		return Get
+	case x < m.Miss+m.Get+m.Put:
+		return Put
+	}
+	return Update
+}
+
+// Key to get or update, out of the n keys put so far
+func (p *Profile) Key(r *rand.Rand, n int) int {
+	if n <= 1 {
+		return 0
+	}
+	switch p.Keys.Popularity {
+	case Zipf:
+		s := p.Keys.Skew
+		if s <= 1 {
+			s = 1.1
+		}
+		return int(rand.NewZipf(r, s, 1, uint64(n-1)).Uint64())
+	case Hotspot:
+		hot := int(p.Keys.Hot * float64(n))
+		if hot < 1 {
+			hot = 1
+		}
+		if hot >= n || r.Float64() < p.Keys.HotShare {
+			return r.Intn(hot)
+		}
+		return hot + r.Intn(n-hot)
+	}
+	return r.Intn(n)
+}
+
+// PerSecond is the request rate at a time since the load started, base is used if the profile doesn't set one
+func (p *Profile) PerSecond(t time.Duration, base float64) float64 {
+	rt := p.Rate
+	if rt.Base > 0 {
+		base = rt.Base
+	}
+	switch rt.Shape {
+	case Ramp:
+		d := duration(rt.Duration)
+		if d <= 0 || t >= d {
+			return rt.Peak
+		}
+		return base + (rt.Peak-base)*float64(t)/float64(d)
+	case Step:
+		if t >= duration(rt.At) {
+			return rt.Peak
+		}
+	case Sine:
+		if d := duration(rt.Period); d > 0 {
+			return base + (rt.Peak-base)*(1-math.Cos(2*math.Pi*float64(t)/float64(d)))/2
+		}
+	case Spike:
+		at := duration(rt.At)
+		if t >= at && t < at+duration(rt.Duration) {
+			return rt.Peak
+		}
+	}
+	return base
+}
+
+// Interval between requests at a time since the load started, given the default interval, between 1ms and an hour
+func (p *Profile) Interval(t, interval time.Duration) time.Duration {
+	rate := p.PerSecond(t, float64(time.Second)/float64(interval))
+	if rate <= 1.0/3600 {
+		return time.Hour
+	}
+	d := time.Duration(float64(time.Second) / rate)
+	if d < time.Millisecond {
+		return time.Millisecond
+	}
+	return d
+}
+
+// Gap until the next request for an open arrival process, n counts the requests sent so far
+func (p *Profile) Gap(r *rand.Rand, t, interval time.Duration, n int) time.Duration {
+	switch p.Arrivals.Process {
+	case Poisson:
+		if d := random.Sample(r, "exponential", p.Interval(t, interval)); d > time.Microsecond {
+			return d
+		}
+		return time.Microsecond
+	case Replay:
+		return p.gaps[n%len(p.gaps)]
+	}
+	return p.Interval(t, interval)
+}
+
+// ThinkTime of a closed loop user before it sends its next request
+func (p *Profile) ThinkTime(r *rand.Rand) time.Duration {
+	return random.Sample(r, p.Arrivals.Distribution, p.think)
+}
+
+// Patience of a closed loop user waiting for a response
+func (p *Profile) Patience() time.Duration {
+	return p.patience
+}
+
+// Recorder keeps the gaps between the requests a root service sends, so runs with different arrivals can be compared
+type Recorder struct {
+	lock  sync.Mutex // closed loop requests are sent once a think time has passed, on another goroutine
+	last  time.Time
+	hist  *generic.Histogram
+	count *generic.Counter
+}
+
+// NewRecorder for a named root service, it doesn't keep anything until it has a name
+func NewRecorder(name string) *Recorder {
+	if name == "" {
+		return &Recorder{}
+	}
+	return &Recorder{hist: collect.NewHist(name + "_arrivals"), count: collect.NewCounter(name + "_requests")}
+}
+
+// Record a request being sent now
+func (a *Recorder) Record() {
+	now := clock.Now()
+	a.lock.Lock()
+	if !a.last.IsZero() {
+		collect.Measure(a.hist, now.Sub(a.last))
+	}
+	a.last = now
+	a.lock.Unlock()
+	collect.Count(a.count)
+}
+
+// Save the gaps to csv_metrics
+func (a *Recorder) Save(name string) {
+	if a.hist != nil {
+		collect.SaveHist(a.hist, name, "_arrivals")
+	}
+}
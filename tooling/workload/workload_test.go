@@ -0,0 +1,109 @@
+package workload
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// Test the profiles shipped in json_arch all load
+func TestLookup(t *testing.T) {
+	File = "../../json_arch/workloads.json"
+	for _, n := range []string{"even", "readmostly", "hotkeys", "ramp", "step", "diurnal", "spike", "poisson", "replay", "closed"} {
+		if Lookup(n) == nil {
+			t.Errorf("missing profile %v", n)
+		}
+	}
+}
+
+// Test the mix and key popularity
+func TestMix(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	p := &Profile{Mix: Mix{Get: 3, Put: 1}, Keys: Keys{Popularity: Hotspot, Hot: 0.1, HotShare: 0.9}}
+	var kinds [3]int
+	hot := 0
+	for i := 0; i < 10000; i++ {
+		kinds[p.Kind(r)]++
+		k := p.Key(r, 100)
+		if k < 0 || k >= 100 {
+			t.Fatalf("key %v out of range", k)
+		}
+		if k < 10 {
+			hot++
+		}
+	}
+	if kinds[Miss] != 0 || kinds[Get] < 7000 || kinds[Get] > 8000 {
+		t.Errorf("mix %v", kinds)
+	}
+	if hot < 8800 || hot > 9200 {
+		t.Errorf("%v hot keys", hot)
+	}
+	if u := (&Profile{Mix: Mix{Update: 1}}).Kind(r); u != Update {
+		t.Errorf("update mix got %v", u)
+	}
+	p.Keys = Keys{Popularity: Zipf}
+	first := 0
+	for i := 0; i < 10000; i++ {
+		k := p.Key(r, 100)
+		if k < 0 || k >= 100 {
+			t.Fatalf("key %v out of range", k)
+		}
+		if k == 0 {
+			first++
+		}
+	}
+	if first < 1000 {
+		t.Errorf("zipf picked the most popular key %v times", first)
+	}
+}
+
+// Test the rate curves
+func TestRate(t *testing.T) {
+	s := time.Second
+	for _, c := range []struct {
+		rate Rate
+		at   time.Duration
+		want float64
+	}{
+		{Rate{Shape: Constant}, 5 * s, 100},
+		{Rate{Shape: Ramp, Base: 10, Peak: 110, Duration: "10s"}, 5 * s, 60},
+		{Rate{Shape: Ramp, Base: 10, Peak: 110, Duration: "10s"}, 20 * s, 110},
+		{Rate{Shape: Step, Peak: 200, At: "5s"}, 4 * s, 100},
+		{Rate{Shape: Step, Peak: 200, At: "5s"}, 5 * s, 200},
+		{Rate{Shape: Sine, Base: 20, Peak: 200, Period: "10s"}, 0, 20},
+		{Rate{Shape: Sine, Base: 20, Peak: 200, Period: "10s"}, 5 * s, 200},
+		{Rate{Shape: Spike, Peak: 500, At: "4s", Duration: "1s"}, 4500 * time.Millisecond, 500},
+		{Rate{Shape: Spike, Peak: 500, At: "4s", Duration: "1s"}, 5 * s, 100},
+	} {
+		p := &Profile{Rate: c.rate}
+		if got := p.PerSecond(c.at, 100); got < c.want-0.001 || got > c.want+0.001 {
+			t.Errorf("%v at %v: %v want %v", c.rate, c.at, got, c.want)
+		}
+	}
+	p := &Profile{Rate: Rate{Shape: Constant, Base: 50}}
+	if d := p.Interval(0, 10*time.Millisecond); d != 20*time.Millisecond {
+		t.Errorf("interval %v", d)
+	}
+}
+
+// Test the arrival processes
+func TestArrivals(t *testing.T) {
+	File = "../../json_arch/workloads.json"
+	r := rand.New(rand.NewSource(1))
+	p := Lookup("poisson")
+	var sum time.Duration
+	for i := 0; i < 10000; i++ {
+		sum += p.Gap(r, 0, 10*time.Millisecond, i)
+	}
+	if mean := sum / 10000; mean < 9*time.Millisecond || mean > 11*time.Millisecond {
+		t.Errorf("poisson mean gap %v", mean)
+	}
+	p = Lookup("replay")
+	if len(p.gaps) == 0 || p.Gap(r, 0, 0, len(p.gaps)) != p.gaps[0] {
+		t.Errorf("replay should repeat the gaps")
+	}
+	p = Lookup("closed")
+	if p.Arrivals.Users != 20 || p.think != 100*time.Millisecond {
+		t.Errorf("closed loop %v", p.Arrivals)
+	}
+}
@@ -97,7 +97,8 @@ export default React.createClass({
 			.data(dataset.edges)
 			.enter()
 			.append('line')
-			.attr('class', 'link');
+			.attr('class', 'link')
+			.classed('open', (d) => d.circuit === 'open');
 
 		this.nodes = this.svg
 			.selectAll('.nodes')
@@ -106,6 +107,7 @@ export default React.createClass({
 			.append('circle')
 			.attr('class', 'node')
 			.attr('r', (d) => Math.sqrt(d.size) * 2.6)
+			.classed('chaos', (d) => !!d.chaos && d.chaos !== 'resume')
 			.style('fill', pickColor)
 			.call(pinNodes(fisheyeD3, this.force, bind(this._onTick, this)));
 
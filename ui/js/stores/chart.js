@@ -78,11 +78,29 @@ const ChartStore = assign({}, eventMixin, {
 			edges.push({ source: sn, target: tn });
 		};
 
+		// the last circuit breaker state logged for an edge wins
+		const setCircuit = function (source, target, state) {
+			each(edges, (e) => {
+				if (e.source[0].node === source && e.target[0].node === target) e.circuit = state;
+			});
+		};
+
+		// the last chaos action logged for a node wins, a resume ends a pause
+		const setChaos = function (victim, action) {
+			each(nodes, (n) => {
+				if (n[0].node === victim) n.chaos = action;
+			});
+		};
+
 		const unprocessedNodes = filter(data.body.graph, (e) => !!e.node);
 		const unprocessedEdges = filter(data.body.graph, (e) => !!e.edge);
+		const unprocessedCircuits = filter(data.body.graph, (e) => !!e.circuit);
+		const unprocessedChaos = filter(data.body.graph, (e) => !!e.chaos);
 
 		each(unprocessedNodes, (n) => addNode(n));
 		each(unprocessedEdges, (e) => addEdge(e.source, e.target));
+		each(unprocessedCircuits, (e) => setCircuit(e.source, e.target, e.state));
+		each(unprocessedChaos, (e) => setChaos(e.victim, e.chaos));
 
 		nodes = sortBy(nodes, 'timestamp');
 		edges = sortBy(edges, 'timestamp');